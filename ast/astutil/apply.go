@@ -0,0 +1,252 @@
+// Package astutil implements utilities for rewriting twik syntax trees.
+package astutil
+
+import (
+	"fmt"
+
+	"gopkg.in/twik.v1/ast"
+)
+
+// An ApplyFunc is invoked by Apply for each node n before and/or after the node's children, using a Cursor describing
+// the current node and providing operations on it.
+//
+// The return value of ApplyFunc controls the syntax tree traversal.
+// See Apply for details.
+type ApplyFunc func(*Cursor) bool
+
+// Apply traverses a syntax tree recursively, starting with root, and
+// calling pre and post for each node:
+//
+//   - If pre is not nil, it is called for each node before the node's
+//     children are traversed (pre-order). If pre returns false, no
+//     children are traversed, and post is not called for that node.
+//
+//   - If post is not nil, and a prior call of pre didn't return false,
+//     post is called for each node after its children are traversed
+//     (post-order). If post returns false, traversal is terminated and
+//     Apply returns immediately.
+//
+// Only the code of a tree is traversed: the nodes of roots, lists and
+// maps, and the node of quotes. Comment groups and comments are not.
+//
+// Children are traversed in the order in which they appear in the
+// source. Apply returns the root node, which differs from the provided
+// one if it was replaced.
+//
+// Nodes given to the Replace, InsertBefore, and InsertAfter methods of
+// the Cursor that hold no position, such as the ones built by hand, are
+// positioned at the node they replace or are inserted next to, so that
+// errors reported against them point to the rewritten code.
+func Apply(root ast.Node, pre, post ApplyFunc) (result ast.Node) {
+	defer func() {
+		if r := recover(); r != nil && r != abort {
+			panic(r)
+		}
+		result = root
+	}()
+	a := &application{pre: pre, post: post}
+	a.apply(nil, nil, func(n ast.Node) { root = n }, root)
+	return
+}
+
+var abort = new(int) // singleton, to signal termination of Apply
+
+// A Cursor describes a node encountered during Apply. Information about
+// the node and its parent is available from the Node, Parent, and Index
+// methods.
+//
+// The methods Replace, Delete, InsertBefore, and InsertAfter can be
+// used to change the syntax tree around the current node.
+type Cursor struct {
+	parent ast.Node
+	node   ast.Node
+	list   *[]ast.Node      // the list holding node, or nil
+	set    func(n ast.Node) // replaces node when not in a list
+	iter   *iterator        // valid if list is not nil
+}
+
+// Node returns the current node.
+func (c *Cursor) Node() ast.Node { return c.node }
+
+// Parent returns the parent of the current node, or nil for the root.
+func (c *Cursor) Parent() ast.Node { return c.parent }
+
+// Index reports the index of the current node in the nodes of its
+// parent root, list, or map, or a value < 0 if it is the node of a
+// quote or the root node.
+func (c *Cursor) Index() int {
+	if c.list != nil {
+		return c.iter.index
+	}
+	return -1
+}
+
+// Replace replaces the current node with n.
+// The replacement node is not walked by Apply.
+func (c *Cursor) Replace(n ast.Node) {
+	checkNode("Replace", n)
+	setPos(n, c.node.Pos())
+	if c.list != nil {
+		(*c.list)[c.iter.index] = n
+	} else {
+		c.set(n)
+	}
+	c.node = n
+}
+
+// Delete deletes the current node from the nodes of its parent.
+// If the current node is not part of a list of nodes, Delete panics.
+func (c *Cursor) Delete() {
+	c.checkList("Delete")
+	i := c.iter.index
+	*c.list = append((*c.list)[:i], (*c.list)[i+1:]...)
+	c.iter.step--
+}
+
+// InsertBefore inserts n before the current node in the nodes of its
+// parent. If the current node is not part of a list of nodes,
+// InsertBefore panics. Apply does not walk n.
+func (c *Cursor) InsertBefore(n ast.Node) {
+	c.checkList("InsertBefore")
+	checkNode("InsertBefore", n)
+	setPos(n, c.node.Pos())
+	c.insert(c.iter.index, n)
+	c.iter.index++
+}
+
+// InsertAfter inserts n after the current node in the nodes of its
+// parent. If the current node is not part of a list of nodes,
+// InsertAfter panics. Apply does not walk n.
+func (c *Cursor) InsertAfter(n ast.Node) {
+	c.checkList("InsertAfter")
+	checkNode("InsertAfter", n)
+	setPos(n, c.node.End())
+	c.insert(c.iter.index+1, n)
+	c.iter.step++
+}
+
+func (c *Cursor) checkList(method string) {
+	if c.list == nil {
+		panic(fmt.Sprintf("astutil: %s called on a node that is not part of a list", method))
+	}
+}
+
+func checkNode(method string, n ast.Node) {
+	if n == nil {
+		panic(fmt.Sprintf("astutil: %s called with a nil node", method))
+	}
+}
+
+func (c *Cursor) insert(i int, n ast.Node) {
+	list := append(*c.list, nil)
+	copy(list[i+1:], list[i:])
+	list[i] = n
+	*c.list = list
+}
+
+// An iterator controls the iteration over a list of nodes.
+type iterator struct {
+	index, step int
+}
+
+type application struct {
+	pre, post ApplyFunc
+	cursor    Cursor
+	iter      iterator
+}
+
+func (a *application) apply(parent ast.Node, list *[]ast.Node, set func(ast.Node), n ast.Node) {
+	saved := a.cursor
+	a.cursor = Cursor{parent: parent, node: n, list: list, set: set}
+	if list != nil {
+		a.cursor.iter = &a.iter
+	}
+	if a.pre != nil && !a.pre(&a.cursor) {
+		a.cursor = saved
+		return
+	}
+
+	switch n := n.(type) {
+	case *ast.Root:
+		a.applyList(n, &n.Nodes)
+	case *ast.List:
+		a.applyList(n, &n.Nodes)
+	case *ast.Map:
+		a.applyList(n, &n.Nodes)
+	case *ast.Quote:
+		a.apply(n, nil, func(x ast.Node) { n.Node = x }, n.Node)
+	}
+
+	if a.post != nil && !a.post(&a.cursor) {
+		panic(abort)
+	}
+	a.cursor = saved
+}
+
+func (a *application) applyList(parent ast.Node, list *[]ast.Node) {
+	saved := a.iter
+	a.iter.index = 0
+	for a.iter.index < len(*list) {
+		a.iter.step = 1
+		a.apply(parent, list, nil, (*list)[a.iter.index])
+		a.iter.index += a.iter.step
+	}
+	a.iter = saved
+}
+
+// setPos positions at pos the nodes within n that hold no position.
+func setPos(n ast.Node, pos ast.Pos) {
+	ast.Inspect(n, func(node ast.Node) bool {
+		switch node := node.(type) {
+		case *ast.Int:
+			if node.InputPos == ast.NoPos {
+				node.InputPos = pos
+			}
+		case *ast.Float:
+			if node.InputPos == ast.NoPos {
+				node.InputPos = pos
+			}
+		case *ast.Ratio:
+			if node.InputPos == ast.NoPos {
+				node.InputPos = pos
+			}
+		case *ast.Decimal:
+			if node.InputPos == ast.NoPos {
+				node.InputPos = pos
+			}
+		case *ast.String:
+			if node.InputPos == ast.NoPos {
+				node.InputPos = pos
+			}
+		case *ast.Symbol:
+			if node.NamePos == ast.NoPos {
+				node.NamePos = pos
+			}
+		case *ast.List:
+			if node.LParens == ast.NoPos && node.RParens == ast.NoPos {
+				node.LParens = pos
+				node.RParens = pos
+			}
+		case *ast.Map:
+			if node.LBrace == ast.NoPos && node.RBrace == ast.NoPos {
+				node.LBrace = pos
+				node.RBrace = pos
+			}
+		case *ast.Quote:
+			if node.MarkPos == ast.NoPos {
+				node.MarkPos = pos
+			}
+		case *ast.Bad:
+			if node.From == ast.NoPos && node.To == ast.NoPos {
+				node.From = pos
+				node.To = pos
+			}
+		case *ast.Root:
+			if node.First == ast.NoPos && node.After == ast.NoPos {
+				node.First = pos
+				node.After = pos
+			}
+		}
+		return true
+	})
+}
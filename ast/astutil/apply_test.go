@@ -0,0 +1,207 @@
+package astutil_test
+
+import (
+	"bytes"
+	"testing"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/twik.v1/ast"
+	"gopkg.in/twik.v1/ast/astutil"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+var _ = Suite(S{})
+
+type S struct{}
+
+func symbolName(node ast.Node) string {
+	if sym, ok := node.(*ast.Symbol); ok {
+		return sym.Name
+	}
+	return ""
+}
+
+var applyTests = []struct {
+	code   string
+	pre    astutil.ApplyFunc
+	output string
+}{{
+	"(a b c)",
+	func(c *astutil.Cursor) bool {
+		if symbolName(c.Node()) == "b" {
+			c.Replace(&ast.Symbol{Name: "x"})
+		}
+		return true
+	},
+	"(a x c)\n",
+}, {
+	"(a 1 b 2 3 c)",
+	func(c *astutil.Cursor) bool {
+		if _, ok := c.Node().(*ast.Int); ok {
+			c.Delete()
+		}
+		return true
+	},
+	"(a b c)\n",
+}, {
+	"(a b) (b)",
+	func(c *astutil.Cursor) bool {
+		if symbolName(c.Node()) == "b" {
+			c.InsertBefore(&ast.Symbol{Name: "x"})
+			c.InsertAfter(&ast.Symbol{Name: "y"})
+		}
+		return true
+	},
+	"(a x b y)\n(x b y)\n",
+}, {
+	"(a) (b) (c)",
+	func(c *astutil.Cursor) bool {
+		if list, ok := c.Node().(*ast.List); ok && symbolName(list.Nodes[0]) != "b" {
+			c.Delete()
+		}
+		return true
+	},
+	"(b)\n",
+}, {
+	"'a '(b a)",
+	func(c *astutil.Cursor) bool {
+		if symbolName(c.Node()) == "a" {
+			c.Replace(&ast.Int{Input: "1", Value: 1})
+		}
+		return true
+	},
+	"'1\n'(b 1)\n",
+}, {
+	"(when a (when b c))",
+	func(c *astutil.Cursor) bool {
+		if _, ok := c.Node().(*ast.List); ok && c.Index() > 0 {
+			c.Replace(&ast.Symbol{Name: "inner"})
+		}
+		return true
+	},
+	"(when a\n  inner)\n",
+}}
+
+func (S) TestApply(c *C) {
+	for _, test := range applyTests {
+		fset := ast.NewFileSet()
+		root, err := ast.ParseString(fset, "", test.code)
+		c.Assert(err, IsNil)
+		result := astutil.Apply(root, test.pre, nil)
+		c.Assert(result, Equals, root)
+		var buf bytes.Buffer
+		err = ast.Fprint(&buf, nil, result)
+		c.Assert(err, IsNil)
+		c.Assert(buf.String(), Equals, test.output, Commentf("Code: %q", test.code))
+	}
+}
+
+func (S) TestApplyPositions(c *C) {
+	fset := ast.NewFileSet()
+	root, err := ast.ParseString(fset, "", "(a b)")
+	c.Assert(err, IsNil)
+	b := root.(*ast.Root).Nodes[0].(*ast.List).Nodes[1]
+
+	var replacement, after *ast.List
+	astutil.Apply(root, func(cur *astutil.Cursor) bool {
+		if cur.Node() == b {
+			replacement = &ast.List{Nodes: []ast.Node{&ast.Symbol{Name: "x"}}}
+			after = &ast.List{Nodes: []ast.Node{&ast.Symbol{Name: "y"}}}
+			cur.Replace(replacement)
+			cur.InsertAfter(after)
+		}
+		return true
+	}, nil)
+
+	c.Assert(fset.PosInfo(replacement.Pos()).String(), Equals, "twik source:1:4:")
+	c.Assert(fset.PosInfo(replacement.Nodes[0].Pos()).String(), Equals, "twik source:1:4:")
+	c.Assert(fset.PosInfo(after.Pos()).String(), Equals, "twik source:1:5:")
+
+	// Positions already held are preserved.
+	sym := &ast.Symbol{Name: "z", NamePos: b.Pos()}
+	astutil.Apply(root, func(cur *astutil.Cursor) bool {
+		if cur.Node() == replacement {
+			cur.Replace(sym)
+		}
+		return true
+	}, nil)
+	c.Assert(sym.NamePos, Equals, b.Pos())
+}
+
+func (S) TestApplyCursor(c *C) {
+	fset := ast.NewFileSet()
+	root, err := ast.ParseString(fset, "", "(a 'b)")
+	c.Assert(err, IsNil)
+	list := root.(*ast.Root).Nodes[0].(*ast.List)
+
+	type info struct {
+		node   ast.Node
+		parent ast.Node
+		index  int
+	}
+	var pre, post []info
+	astutil.Apply(root, func(cur *astutil.Cursor) bool {
+		pre = append(pre, info{cur.Node(), cur.Parent(), cur.Index()})
+		return true
+	}, func(cur *astutil.Cursor) bool {
+		post = append(post, info{cur.Node(), cur.Parent(), cur.Index()})
+		return true
+	})
+	quote := list.Nodes[1].(*ast.Quote)
+	c.Assert(pre, DeepEquals, []info{
+		{root, nil, -1},
+		{list, root, 0},
+		{list.Nodes[0], list, 0},
+		{quote, list, 1},
+		{quote.Node, quote, -1},
+	})
+	c.Assert(post, DeepEquals, []info{
+		{list.Nodes[0], list, 0},
+		{quote.Node, quote, -1},
+		{quote, list, 1},
+		{list, root, 0},
+		{root, nil, -1},
+	})
+}
+
+func (S) TestApplyReplaceRoot(c *C) {
+	fset := ast.NewFileSet()
+	root, err := ast.ParseString(fset, "", "(a)")
+	c.Assert(err, IsNil)
+	sym := &ast.Symbol{Name: "x"}
+	result := astutil.Apply(root, nil, func(cur *astutil.Cursor) bool {
+		if cur.Parent() == nil {
+			cur.Replace(sym)
+		}
+		return true
+	})
+	c.Assert(result, Equals, sym)
+}
+
+func (S) TestApplyAbort(c *C) {
+	fset := ast.NewFileSet()
+	root, err := ast.ParseString(fset, "", "(a b c)")
+	c.Assert(err, IsNil)
+	var visited []string
+	result := astutil.Apply(root, nil, func(cur *astutil.Cursor) bool {
+		visited = append(visited, symbolName(cur.Node()))
+		return symbolName(cur.Node()) != "b"
+	})
+	c.Assert(result, Equals, root)
+	c.Assert(visited, DeepEquals, []string{"a", "b"})
+}
+
+func (S) TestApplyNotInList(c *C) {
+	fset := ast.NewFileSet()
+	root, err := ast.ParseString(fset, "", "'a")
+	c.Assert(err, IsNil)
+	c.Assert(func() {
+		astutil.Apply(root, func(cur *astutil.Cursor) bool {
+			if symbolName(cur.Node()) == "a" {
+				cur.Delete()
+			}
+			return true
+		}, nil)
+	}, PanicMatches, "astutil: Delete called on a node that is not part of a list")
+}
@@ -1,9 +1,12 @@
 package ast
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
+	"math/big"
+	"sort"
 	"strconv"
 	"strings"
 	"unicode"
@@ -14,6 +17,10 @@ import (
 // method to obtain human-oriented details for the position.
 type Pos int
 
+// NoPos is the zero value for Pos, which holds no position. Positions in
+// a file set are always greater than NoPos.
+const NoPos Pos = 0
+
 // The Node interface is implemented by all AST nodes that result
 // from parsing twik code.
 type Node interface {
@@ -26,6 +33,10 @@ type Int struct {
 	Input    string
 	InputPos Pos
 	Value    int64
+
+	// Big holds the value of literals that do not fit in an int64,
+	// in which case Value is zero.
+	Big *big.Int
 }
 
 func (l *Int) Pos() Pos { return l.InputPos }
@@ -41,6 +52,29 @@ type Float struct {
 func (l *Float) Pos() Pos { return l.InputPos }
 func (l *Float) End() Pos { return l.InputPos + Pos(len(l.Input)) }
 
+// Ratio represents an exact rational literal such as 1/3 in parsed
+// twik code.
+type Ratio struct {
+	Input    string
+	InputPos Pos
+	Value    *big.Rat
+}
+
+func (l *Ratio) Pos() Pos { return l.InputPos }
+func (l *Ratio) End() Pos { return l.InputPos + Pos(len(l.Input)) }
+
+// Decimal represents a fixed-point decimal literal such as 12.50m in
+// parsed twik code, holding the value Unscaled * 10^-Scale.
+type Decimal struct {
+	Input    string
+	InputPos Pos
+	Unscaled *big.Int
+	Scale    int
+}
+
+func (l *Decimal) Pos() Pos { return l.InputPos }
+func (l *Decimal) End() Pos { return l.InputPos + Pos(len(l.Input)) }
+
 // String represents a string literal in parsed twik code.
 type String struct {
 	Input    string
@@ -65,21 +99,151 @@ type List struct {
 	LParens Pos
 	RParens Pos
 	Nodes   []Node
+
+	// Doc holds the comments leading the list, when parsed with the
+	// ParseComments mode. These are the comments in the lines right
+	// above the list, as done to document functions:
+	//
+	//	; add returns the sum of a and b.
+	//	(func add (a b) (+ a b))
+	//
+	Doc *CommentGroup
 }
 
 func (s *List) Pos() Pos { return s.LParens }
 func (s *List) End() Pos { return s.RParens + 1 }
 
+// Map represents a map literal from parsed twik code, holding
+// alternating key and value entries.
+type Map struct {
+	LBrace Pos
+	RBrace Pos
+	Nodes  []Node
+}
+
+func (m *Map) Pos() Pos { return m.LBrace }
+func (m *Map) End() Pos { return m.RBrace + 1 }
+
+// Quote represents an expression preceded by one of the quoting marks
+// ', `, , or ,@ in parsed twik code. It is evaluated in the same way as
+// a list holding the symbol returned by Name followed by the expression,
+// so 'x is the same as (quote x).
+type Quote struct {
+	Mark    string
+	MarkPos Pos
+	Node    Node
+}
+
+func (q *Quote) Pos() Pos { return q.MarkPos }
+func (q *Quote) End() Pos { return q.Node.End() }
+
+// Name returns the name of the special form the quoting mark stands for:
+// quote, quasiquote, unquote, or unquote-splicing.
+func (q *Quote) Name() string {
+	switch q.Mark {
+	case "`":
+		return "quasiquote"
+	case ",":
+		return "unquote"
+	case ",@":
+		return "unquote-splicing"
+	}
+	return "quote"
+}
+
+// List returns the list q is evaluated as.
+func (q *Quote) List() *List {
+	return &List{
+		LParens: q.MarkPos,
+		RParens: q.End() - 1,
+		Nodes:   []Node{&Symbol{Name: q.Name(), NamePos: q.MarkPos}, q.Node},
+	}
+}
+
+// Comment represents a single ; comment in parsed twik code.
+type Comment struct {
+	Semicolon Pos
+	Text      string // The comment text, including the semicolon.
+}
+
+func (c *Comment) Pos() Pos { return c.Semicolon }
+func (c *Comment) End() Pos { return c.Semicolon + Pos(len(c.Text)) }
+
+// CommentGroup represents a sequence of comments in consecutive lines,
+// with no other nodes between them.
+type CommentGroup struct {
+	List []*Comment
+}
+
+func (g *CommentGroup) Pos() Pos { return g.List[0].Pos() }
+func (g *CommentGroup) End() Pos { return g.List[len(g.List)-1].End() }
+
+// Text returns the text of the comments in g, with their semicolons,
+// the first space following them, and trailing spaces removed, and
+// leading and trailing empty lines dropped. Lines are terminated by a
+// line break, unless g is nil or holds no text.
+func (g *CommentGroup) Text() string {
+	if g == nil {
+		return ""
+	}
+	var lines []string
+	for _, c := range g.List {
+		line := strings.TrimLeft(c.Text, ";")
+		line = strings.TrimPrefix(line, " ")
+		lines = append(lines, strings.TrimRightFunc(line, unicode.IsSpace))
+	}
+	for len(lines) > 0 && lines[0] == "" {
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// Bad represents a region of code holding syntax errors, which the parser
+// skipped when parsing with the AllErrors mode.
+type Bad struct {
+	From Pos
+	To   Pos
+}
+
+func (b *Bad) Pos() Pos { return b.From }
+func (b *Bad) End() Pos { return b.To }
+
 // Root represents the root of parsed twik code.
 type Root struct {
 	First Pos
 	After Pos
 	Nodes []Node
+
+	// Comments holds all comment groups in the code, in the order they
+	// appear, when parsed with the ParseComments mode.
+	Comments []*CommentGroup
 }
 
 func (s *Root) Pos() Pos { return s.First }
 func (s *Root) End() Pos { return s.After }
 
+// Mode is a set of flags controlling optional parser functionality.
+type Mode uint
+
+const (
+	// ParseComments makes the parser retain the comments in the code,
+	// holding them in the Comments field of the resulting Root, and
+	// leading comments in the Doc field of the lists they lead.
+	ParseComments Mode = 1 << iota
+
+	// AllErrors makes the parser recover from syntax errors, skipping
+	// the broken regions of code up to the boundary of the enclosing
+	// list, and report all of them at once in an ErrorList. The
+	// resulting Root holds a Bad node in place of each broken region.
+	AllErrors
+)
+
 // Parse parses a byte slice containing twik code and returns
 // the resulting parsed tree.
 //
@@ -95,23 +259,42 @@ func Parse(fset *FileSet, name string, code []byte) (Node, error) {
 // Positioning information for the parsed code will be stored in
 // fset under the given name.
 func ParseString(fset *FileSet, name string, code string) (Node, error) {
+	return ParseMode(fset, name, code, 0)
+}
+
+// ParseMode parses a string containing twik code as done by ParseString,
+// with the optional functionality enabled in mode.
+//
+// With the AllErrors mode, syntax errors do not stop the parsing. The
+// resulting Root is returned even when errors are found, along with an
+// ErrorList holding all of them sorted by position.
+func ParseMode(fset *FileSet, name string, code string, mode Mode) (Node, error) {
 	base := fset.nextBase()
-	fset.files = append(fset.files, file{name: name, code: code, base: base})
+	fset.files = append(fset.files, file{name: name, code: code, base: base, lines: lineStarts(code)})
 
-	p := parser{fset: fset, code: code, base: base}
+	p := parser{fset: fset, code: code, base: base, mode: mode}
 	root := Root{First: p.pos(0)}
-	node, err := p.next()
-	for err == nil {
-		root.Nodes = append(root.Nodes, node)
-		node, err = p.next()
-	}
-	if err != io.EOF {
-		if err == errOpened || err == errClosed {
-			return nil, p.ierrorf(p.i, "%v", err)
+	for {
+		node, err := p.next()
+		if err == io.EOF {
+			break
 		}
-		return nil, err
+		if err == errClosed || err == errClosedBrace {
+			node, err = p.bad(p.i-1, p.ierrorf(p.i, p.i, "%v", err))
+		} else if err == errOpened || err == errOpenedBrace {
+			err = p.ierrorf(p.i, p.i, "%v", err)
+		}
+		if err != nil {
+			return nil, err
+		}
+		root.Nodes = append(root.Nodes, node)
 	}
 	root.After = p.pos(p.i)
+	root.Comments = p.comments
+	if len(p.errors) > 0 {
+		p.errors.Sort()
+		return &root, p.errors
+	}
 	return &root, nil
 }
 
@@ -120,10 +303,21 @@ type parser struct {
 	code string
 	base Pos
 	i    int
+	mode Mode
+
+	// comments holds the comment groups found so far, and lead holds
+	// the group leading the next node, if any.
+	comments []*CommentGroup
+	lead     *CommentGroup
+
+	// errors holds the errors found so far with AllErrors.
+	errors ErrorList
 }
 
 var errClosed = errors.New("unexpected )")
 var errOpened = errors.New("missing )")
+var errClosedBrace = errors.New("unexpected }")
+var errOpenedBrace = errors.New("missing }")
 
 type closedError struct {
 }
@@ -132,36 +326,151 @@ func (p *parser) pos(i int) Pos {
 	return p.base + Pos(i)
 }
 
-func (p *parser) ierrorf(i int, format string, args ...interface{}) error {
-	pinfo := p.fset.PosInfo(p.pos(i))
-	return fmt.Errorf("%s %s", pinfo, fmt.Sprintf(format, args...))
+// Error holds a parsing error and the source range where it was found.
+type Error struct {
+	Msg     string
+	PosInfo *PosInfo
+	Pos     Pos
+	End     Pos
 }
 
-func (p *parser) next() (Node, error) {
-	if p.i == len(p.code) {
-		return nil, io.EOF
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s %s", e.PosInfo, e.Msg)
+}
+
+func (p *parser) ierrorf(start, end int, format string, args ...interface{}) error {
+	return &Error{
+		Msg:     fmt.Sprintf(format, args...),
+		PosInfo: p.fset.PosInfo(p.pos(start)),
+		Pos:     p.pos(start),
+		End:     p.pos(end),
 	}
+}
 
-	r, size := utf8.DecodeRuneInString(p.code[p.i:])
-	for r == ';' || unicode.IsSpace(r) {
-		p.i += size
+// bad returns err when parsing without AllErrors. Otherwise it records
+// err, unless it repeats the last error recorded, and returns a Bad node
+// spanning the code from start to the current position.
+func (p *parser) bad(start int, err error) (Node, error) {
+	if p.mode&AllErrors == 0 {
+		return nil, err
+	}
+	e := err.(*Error)
+	if n := len(p.errors); n == 0 || p.errors[n-1].Pos != e.Pos || p.errors[n-1].Msg != e.Msg {
+		p.errors = append(p.errors, e)
+	}
+	return &Bad{From: p.pos(start), To: p.pos(p.i)}, nil
+}
+
+// ErrorList is a list of parsing errors, as reported by ParseMode with
+// the AllErrors mode. Its Len, Less, and Swap methods allow sorting the
+// errors by position with sort.Sort.
+type ErrorList []*Error
+
+func (l ErrorList) Len() int      { return len(l) }
+func (l ErrorList) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+
+func (l ErrorList) Less(i, j int) bool {
+	a, b := l[i].PosInfo, l[j].PosInfo
+	if a.Name != b.Name {
+		return a.Name < b.Name
+	}
+	if a.Line != b.Line {
+		return a.Line < b.Line
+	}
+	if a.Column != b.Column {
+		return a.Column < b.Column
+	}
+	return l[i].Msg < l[j].Msg
+}
+
+// Sort sorts the errors in l by position.
+func (l ErrorList) Sort() {
+	sort.Stable(l)
+}
+
+// Error reports the first error in l, and how many more there are.
+func (l ErrorList) Error() string {
+	switch len(l) {
+	case 0:
+		return "no errors"
+	case 1:
+		return l[0].Error()
+	}
+	return fmt.Sprintf("%s (and %d more errors)", l[0], len(l)-1)
+}
+
+// Err returns an error equivalent to l, or nil if l is empty.
+func (l ErrorList) Err() error {
+	if len(l) == 0 {
+		return nil
+	}
+	return l
+}
+
+// skip skips the white space and comments found at the current position.
+// With ParseComments, it records the comments, grouping the ones found in
+// consecutive lines unless the first one follows a node in its line, and
+// holds in lead the last group if it both starts a line and ends in the
+// line before the next node.
+func (p *parser) skip() {
+	p.lead = nil
+	from := p.i
+	var group *CommentGroup
+	var groupEnd int
+	var startsLine bool
+	for p.i < len(p.code) {
+		r, size := utf8.DecodeRuneInString(p.code[p.i:])
 		if r == ';' {
-			for p.i < len(p.code) && r != '\n' {
-				r, size = utf8.DecodeRuneInString(p.code[p.i:])
-				p.i += size
+			start := p.i
+			if i := strings.IndexByte(p.code[start:], '\n'); i >= 0 {
+				p.i += i
+			} else {
+				p.i = len(p.code)
+			}
+			if p.mode&ParseComments == 0 {
+				continue
 			}
+			comment := &Comment{Semicolon: p.pos(start), Text: strings.TrimSuffix(p.code[start:p.i], "\r")}
+			if group != nil && startsLine && strings.Count(p.code[groupEnd:start], "\n") == 1 {
+				group.List = append(group.List, comment)
+			} else {
+				group = &CommentGroup{List: []*Comment{comment}}
+				p.comments = append(p.comments, group)
+				startsLine = from == 0 || strings.Contains(p.code[from:start], "\n")
+			}
+			groupEnd = p.i
+			continue
 		}
-		if p.i == len(p.code) {
-			return nil, io.EOF
+		if !unicode.IsSpace(r) {
+			break
 		}
-		r, size = utf8.DecodeRuneInString(p.code[p.i:])
+		p.i += size
+	}
+	if group != nil && startsLine && p.i < len(p.code) && strings.Count(p.code[groupEnd:p.i], "\n") == 1 {
+		p.lead = group
+	}
+}
+
+func (p *parser) next() (Node, error) {
+	if p.i == len(p.code) {
+		return nil, io.EOF
+	}
+
+	p.skip()
+	if p.i == len(p.code) {
+		return nil, io.EOF
 	}
+	doc := p.lead
+	r, size := utf8.DecodeRuneInString(p.code[p.i:])
 	start := p.i
 	p.i += size
 
 	if r == ')' {
 		return nil, errClosed
 	}
+	if r == '}' {
+		return nil, errClosedBrace
+	}
 	if r == '(' {
 		var nodes []Node
 		for {
@@ -170,7 +479,13 @@ func (p *parser) next() (Node, error) {
 				break
 			}
 			if err == io.EOF {
-				return nil, errOpened
+				if p.mode&AllErrors == 0 {
+					return nil, errOpened
+				}
+				return p.bad(start, p.ierrorf(p.i, p.i, "%v", errOpened))
+			}
+			if err == errClosedBrace {
+				node, err = p.bad(p.i-1, p.ierrorf(p.i, p.i, "%v", err))
 			}
 			if err != nil {
 				return nil, err
@@ -181,9 +496,41 @@ func (p *parser) next() (Node, error) {
 			LParens: p.pos(start),
 			RParens: p.pos(p.i - 1),
 			Nodes:   nodes,
+			Doc:     doc,
 		}
 		return list, nil
 	}
+	if r == '{' {
+		var nodes []Node
+		for {
+			node, err := p.next()
+			if err == errClosedBrace {
+				break
+			}
+			if err == io.EOF {
+				if p.mode&AllErrors == 0 {
+					return nil, errOpenedBrace
+				}
+				return p.bad(start, p.ierrorf(p.i, p.i, "%v", errOpenedBrace))
+			}
+			if err == errClosed {
+				node, err = p.bad(p.i-1, p.ierrorf(p.i, p.i, "%v", err))
+			}
+			if err != nil {
+				return nil, err
+			}
+			nodes = append(nodes, node)
+		}
+		if len(nodes)%2 != 0 {
+			return p.bad(start, p.ierrorf(start, p.i, "map literal takes an even number of entries"))
+		}
+		m := &Map{
+			LBrace: p.pos(start),
+			RBrace: p.pos(p.i - 1),
+			Nodes:  nodes,
+		}
+		return m, nil
+	}
 
 	if r == '-' && p.i < len(p.code) {
 		r, size = utf8.DecodeRuneInString(p.code[p.i:])
@@ -200,48 +547,77 @@ func (p *parser) next() (Node, error) {
 			r, size = utf8.DecodeRuneInString(p.code[p.i:])
 			if r == '.' {
 				dot = true
-			} else if r == ')' || unicode.IsSpace(r) {
+			} else if r == ')' || r == '}' || unicode.IsSpace(r) {
 				break
 			}
 			p.i += size
 		}
 		input := p.code[start:p.i]
+		if strings.HasSuffix(input, "m") {
+			unscaled, scale, ok := parseDecimal(input[:len(input)-1])
+			if !ok {
+				return p.bad(start, p.ierrorf(start, p.i, "invalid decimal literal: %s", input))
+			}
+			return &Decimal{Input: input, InputPos: p.pos(start), Unscaled: unscaled, Scale: scale}, nil
+		}
+		if i := strings.Index(input, "/"); i >= 0 {
+			num, ok1 := new(big.Int).SetString(input[:i], 10)
+			den, ok2 := new(big.Int).SetString(input[i+1:], 10)
+			if !ok1 || !ok2 || den.Sign() <= 0 {
+				return p.bad(start, p.ierrorf(start, p.i, "invalid ratio literal: %s", input))
+			}
+			return &Ratio{Input: input, InputPos: p.pos(start), Value: new(big.Rat).SetFrac(num, den)}, nil
+		}
+		// Digit separators and hexadecimal floats are accepted by strconv,
+		// but are not part of the syntax.
 		if dot {
 			value, err := strconv.ParseFloat(input, 64)
-			if err != nil {
-				return nil, p.ierrorf(start, "invalid float literal: %s", input)
+			if err != nil || strings.ContainsAny(input, "_xX") {
+				return p.bad(start, p.ierrorf(start, p.i, "invalid float literal: %s", input))
 			}
 			return &Float{Input: input, InputPos: p.pos(start), Value: value}, nil
 		} else {
+			if strings.Contains(input, "_") {
+				return p.bad(start, p.ierrorf(start, p.i, "invalid int literal: %s", input))
+			}
 			value, err := strconv.ParseInt(input, 0, 64)
 			if err != nil {
-				return nil, p.ierrorf(start, "invalid int literal: %s", input)
+				if z, ok := new(big.Int).SetString(input, 0); ok {
+					return &Int{Input: input, InputPos: p.pos(start), Big: z}, nil
+				}
+				return p.bad(start, p.ierrorf(start, p.i, "invalid int literal: %s", input))
 			}
 			return &Int{Input: input, InputPos: p.pos(start), Value: value}, nil
 		}
 	}
 
+	// char, or else quote
 	if r == '\'' {
-		var c rune
-		if p.i < len(p.code) {
-			c, size = utf8.DecodeRuneInString(p.code[p.i:])
-			p.i += size
-			if c == '\\' && p.i < len(p.code) {
-				c, size = utf8.DecodeRuneInString(p.code[p.i:])
-				p.i += size
-			} else if c == '\'' {
-				return nil, p.ierrorf(start, "invalid single quote")
-			}
+		if c, n := charLiteral(p.code[p.i:]); n > 0 {
+			p.i += n
+			return &Int{Input: p.code[start:p.i], InputPos: p.pos(start), Value: int64(c)}, nil
 		}
-		if p.i == len(p.code) {
-			return nil, p.ierrorf(start, "invalid single quote")
+	}
+	if r == '\'' || r == '`' || r == ',' {
+		mark := p.code[start:p.i]
+		if r == ',' && strings.HasPrefix(p.code[p.i:], "@") {
+			p.i++
+			mark = ",@"
 		}
-		r, size = utf8.DecodeRuneInString(p.code[p.i:])
-		p.i += size
-		if r != '\'' {
-			return nil, p.ierrorf(start, "unclosed single quote")
+		node, err := p.next()
+		if err == io.EOF || err == errClosed || err == errClosedBrace {
+			qerr := p.ierrorf(start, p.i, "missing expression after %s", mark)
+			if err != io.EOF && p.mode&AllErrors != 0 {
+				// Leave the closing parenthesis or brace to the
+				// enclosing list or map.
+				p.i--
+			}
+			return p.bad(start, qerr)
+		}
+		if err != nil {
+			return nil, err
 		}
-		return &Int{Input: p.code[start:p.i], InputPos: p.pos(start), Value: int64(c)}, nil
+		return &Quote{Mark: mark, MarkPos: p.pos(start), Node: node}, nil
 	}
 
 	// string
@@ -249,7 +625,7 @@ func (p *parser) next() (Node, error) {
 		escaped := false
 		for {
 			if p.i == len(p.code) {
-				return nil, p.ierrorf(start, "unclosed string literal: %s", p.code[start:])
+				return p.bad(start, p.ierrorf(start, p.i, "unclosed string literal: %s", p.code[start:]))
 			}
 			r, size = utf8.DecodeRuneInString(p.code[p.i:])
 			p.i += size
@@ -261,7 +637,7 @@ func (p *parser) next() (Node, error) {
 		input := p.code[start:p.i]
 		value, err := strconv.Unquote(input)
 		if err != nil {
-			return nil, p.ierrorf(start, "invalid string literal: %s", input)
+			return p.bad(start, p.ierrorf(start, p.i, "invalid string literal: %s", input))
 		}
 		return &String{Input: input, InputPos: p.pos(start), Value: value}, nil
 	}
@@ -269,18 +645,61 @@ func (p *parser) next() (Node, error) {
 	// symbol
 	for p.i < len(p.code) {
 		r, size = utf8.DecodeRuneInString(p.code[p.i:])
-		if r == ')' || unicode.IsSpace(r) {
+		if r == ')' || r == '}' || unicode.IsSpace(r) {
 			break
 		}
 		p.i += size
 	}
+	name := p.code[start:p.i]
+	if strings.Contains(name, "'") {
+		// Quotes only start quoted expressions and char literals.
+		return p.bad(start, p.ierrorf(start, p.i, "invalid symbol: %s", name))
+	}
 	symbol := &Symbol{
-		Name:    p.code[start:p.i],
+		Name:    name,
 		NamePos: p.pos(start),
 	}
 	return symbol, nil
 }
 
+// parseDecimal returns the unscaled value and the scale of the decimal
+// number in s, such as 12.50, which has digits in base 10 and at most
+// one dot.
+func parseDecimal(s string) (unscaled *big.Int, scale int, ok bool) {
+	digits := s
+	if i := strings.Index(s, "."); i >= 0 {
+		digits = s[:i] + s[i+1:]
+		scale = len(s) - i - 1
+	}
+	for i, r := range digits {
+		if (r < '0' || r > '9') && (i > 0 || r != '-') {
+			return nil, 0, false
+		}
+	}
+	unscaled, ok = new(big.Int).SetString(digits, 10)
+	return unscaled, scale, ok
+}
+
+// charLiteral returns the character in a literal such as 'a' or '\''
+// found at the start of code after the opening quote, and the length of
+// the rest of the literal. The length is zero if there is no literal.
+// Opening parentheses and braces, and quote marks, must be escaped as in
+// '\(', since '(' starts a quoted list such as '('a 'b).
+func charLiteral(code string) (c rune, n int) {
+	c, size := utf8.DecodeRuneInString(code)
+	switch c {
+	case '\\':
+		c, n = utf8.DecodeRuneInString(code[size:])
+		size += n
+	case '\'', '`', ',', '(', '{':
+		return 0, 0
+	}
+	if size == 0 || c == utf8.RuneError || !strings.HasPrefix(code[size:], "'") {
+		return 0, 0
+	}
+	return c, size + 1
+}
+
 // NewFileSet returns a new FileSet.
 func NewFileSet() *FileSet {
 	return &FileSet{}
@@ -295,6 +714,28 @@ type file struct {
 	name string
 	code string
 	base Pos
+
+	// lines holds the offset in code where each line starts.
+	lines []int
+}
+
+// lineStarts returns the offsets in code where each line starts.
+func lineStarts(code string) []int {
+	lines := []int{0}
+	for i := 0; i < len(code); i++ {
+		if code[i] == '\n' {
+			lines = append(lines, i+1)
+		}
+	}
+	return lines
+}
+
+// line returns the line holding pos, starting at 1, and the offset in
+// the file code where that line starts. The position must be within f.
+func (f *file) line(pos Pos) (line, start int) {
+	offset := int(pos - f.base)
+	line = sort.Search(len(f.lines), func(i int) bool { return f.lines[i] > offset })
+	return line, f.lines[line-1]
 }
 
 func (fset *FileSet) nextBase() Pos {
@@ -306,26 +747,81 @@ func (fset *FileSet) nextBase() Pos {
 	}
 }
 
+// file returns the file holding pos, or nil if there is none.
+func (fset *FileSet) file(pos Pos) *file {
+	for i := range fset.files {
+		f := &fset.files[i]
+		if pos >= f.base && pos <= f.base+Pos(len(f.code)) {
+			return f
+		}
+	}
+	return nil
+}
+
 // PosInfo returns the line and column for pos, and the name the
 // file containing that position was parsed with.
 func (fset *FileSet) PosInfo(pos Pos) *PosInfo {
 	pinfo := &PosInfo{}
-	for _, f := range fset.files {
-		if pos <= f.base+Pos(len(f.code)) {
-			offset := int(pos - f.base)
-			code := f.code[:offset]
-			pinfo.Name = f.name
-			pinfo.Line = 1 + strings.Count(code, "\n")
-			if i := strings.LastIndex(code, "\n"); i >= 0 {
-				pinfo.Column = offset - i
-			} else {
-				pinfo.Column = 1 + len(code)
-			}
-		}
+	if f := fset.file(pos); f != nil {
+		line, start := f.line(pos)
+		pinfo.Name = f.name
+		pinfo.Line = line
+		pinfo.Column = 1 + int(pos-f.base) - start
 	}
 	return pinfo
 }
 
+// Snippet returns the source line holding pos followed by a line that
+// marks the range from pos to end with a caret and tildes, as in:
+//
+//	(+ 1 (foo 2))
+//	      ^~~
+//
+// The range is truncated at the end of the line holding pos. If color
+// is true, the marks are highlighted with ANSI escape sequences.
+func (fset *FileSet) Snippet(pos, end Pos, color bool) string {
+	f := fset.file(pos)
+	if f == nil {
+		return ""
+	}
+	offset := int(pos - f.base)
+	start := strings.LastIndex(f.code[:offset], "\n") + 1
+	stop := len(f.code)
+	if i := strings.Index(f.code[offset:], "\n"); i >= 0 {
+		stop = offset + i
+	}
+	line := strings.TrimSuffix(f.code[start:stop], "\r")
+	var buf bytes.Buffer
+	buf.WriteString(line)
+	buf.WriteByte('\n')
+	for _, r := range f.code[start:offset] {
+		if r == '\t' {
+			buf.WriteByte('\t')
+		} else {
+			buf.WriteByte(' ')
+		}
+	}
+	n := 1
+	if eoffset := int(end - f.base); eoffset > offset {
+		if eoffset > len(line)+start {
+			eoffset = len(line) + start
+		}
+		if c := utf8.RuneCountInString(f.code[offset:eoffset]); c > 1 {
+			n = c
+		}
+	}
+	if color {
+		buf.WriteString("\x1b[1;31m")
+	}
+	buf.WriteByte('^')
+	buf.WriteString(strings.Repeat("~", n-1))
+	if color {
+		buf.WriteString("\x1b[0m")
+	}
+	buf.WriteByte('\n')
+	return buf.String()
+}
+
 // PosInfo holds human-oriented positioning details about a Pos.
 type PosInfo struct {
 	Name   string
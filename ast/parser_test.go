@@ -2,6 +2,8 @@ package ast_test
 
 import (
 	"fmt"
+	"math/big"
+	"strings"
 	"testing"
 
 	"github.com/kr/pretty"
@@ -33,6 +35,14 @@ func (S) TestParser(c *C) {
 	}
 }
 
+func bigInt(s string) *big.Int {
+	z, ok := new(big.Int).SetString(s, 10)
+	if !ok {
+		panic("invalid big integer: " + s)
+	}
+	return z
+}
+
 func errorf(format string, args ...interface{}) error {
 	return fmt.Errorf(format, args...)
 }
@@ -61,9 +71,40 @@ var parserTests = []struct {
 		[]ast.Node{
 			&ast.Int{Input: "0x10", InputPos: 1, Value: 16},
 		},
+	}, {
+		`99999999999999999999`,
+		[]ast.Node{
+			&ast.Int{Input: "99999999999999999999", InputPos: 1, Big: bigInt("99999999999999999999")},
+		},
+	}, {
+		`-1/3`,
+		[]ast.Node{
+			&ast.Ratio{Input: "-1/3", InputPos: 1, Value: big.NewRat(-1, 3)},
+		},
+	}, {
+		`1/0`,
+		errorf(".*: invalid ratio literal: 1/0"),
+	}, {
+		`12.50m -3m`,
+		[]ast.Node{
+			&ast.Decimal{Input: "12.50m", InputPos: 1, Unscaled: big.NewInt(1250), Scale: 2},
+			&ast.Decimal{Input: "-3m", InputPos: 8, Unscaled: big.NewInt(-3), Scale: 0},
+		},
+	}, {
+		`1.2.3m`,
+		errorf(".*: invalid decimal literal: 1.2.3m"),
 	}, {
 		`0n10`,
 		errorf(".*: invalid int literal: 0n10"),
+	}, {
+		`1_000`,
+		errorf(".*: invalid int literal: 1_000"),
+	}, {
+		`1_0.5`,
+		errorf(".*: invalid float literal: 1_0.5"),
+	}, {
+		`0x1.8p1`,
+		errorf(".*: invalid float literal: 0x1.8p1"),
 	}, {
 		`'a'`,
 		[]ast.Node{
@@ -74,12 +115,85 @@ var parserTests = []struct {
 		[]ast.Node{
 			&ast.Int{Input: `'\''`, InputPos: 1, Value: '\''},
 		},
+	}, {
+		`'\('`,
+		[]ast.Node{
+			&ast.Int{Input: `'\('`, InputPos: 1, Value: '('},
+		},
+	}, {
+		`'('a)`,
+		[]ast.Node{
+			&ast.Quote{Mark: "'", MarkPos: 1, Node: &ast.List{
+				LParens: 2,
+				Nodes: []ast.Node{
+					&ast.Quote{Mark: "'", MarkPos: 3, Node: &ast.Symbol{Name: "a", NamePos: 4}},
+				},
+				RParens: 5,
+			}},
+		},
+	}, {
+		`'('a 'b)`,
+		[]ast.Node{
+			&ast.Quote{Mark: "'", MarkPos: 1, Node: &ast.List{
+				LParens: 2,
+				Nodes: []ast.Node{
+					&ast.Quote{Mark: "'", MarkPos: 3, Node: &ast.Symbol{Name: "a", NamePos: 4}},
+					&ast.Quote{Mark: "'", MarkPos: 6, Node: &ast.Symbol{Name: "b", NamePos: 7}},
+				},
+				RParens: 8,
+			}},
+		},
 	}, {
 		`'`,
-		errorf(".*: invalid single quote"),
+		errorf("twik source:1:1: missing expression after '"),
 	}, {
 		`''`,
-		errorf(".*: invalid single quote"),
+		errorf("twik source:1:2: missing expression after '"),
+	}, {
+		`'a`,
+		[]ast.Node{
+			&ast.Quote{Mark: "'", MarkPos: 1, Node: &ast.Symbol{Name: "a", NamePos: 2}},
+		},
+	}, {
+		`'ab'`,
+		errorf("twik source:1:2: invalid symbol: ab'"),
+	}, {
+		`(f a'b)`,
+		errorf("twik source:1:4: invalid symbol: a'b"),
+	}, {
+		`(f a')`,
+		errorf("twik source:1:4: invalid symbol: a'"),
+	}, {
+		"'(a 1)",
+		[]ast.Node{
+			&ast.Quote{Mark: "'", MarkPos: 1, Node: &ast.List{
+				LParens: 2,
+				Nodes: []ast.Node{
+					&ast.Symbol{Name: "a", NamePos: 3},
+					&ast.Int{Input: "1", InputPos: 5, Value: 1},
+				},
+				RParens: 6,
+			}},
+		},
+	}, {
+		"`(a ,b ,@c)",
+		[]ast.Node{
+			&ast.Quote{Mark: "`", MarkPos: 1, Node: &ast.List{
+				LParens: 2,
+				Nodes: []ast.Node{
+					&ast.Symbol{Name: "a", NamePos: 3},
+					&ast.Quote{Mark: ",", MarkPos: 5, Node: &ast.Symbol{Name: "b", NamePos: 6}},
+					&ast.Quote{Mark: ",@", MarkPos: 8, Node: &ast.Symbol{Name: "c", NamePos: 10}},
+				},
+				RParens: 11,
+			}},
+		},
+	}, {
+		"(a ')",
+		errorf("twik source:1:4: missing expression after '"),
+	}, {
+		"(a ,@)",
+		errorf("twik source:1:4: missing expression after ,@"),
 	}, {
 		` 1.0 `,
 		[]ast.Node{
@@ -135,6 +249,41 @@ var parserTests = []struct {
 		},
 	},
 
+	{
+		`{"a" 1}`,
+		[]ast.Node{
+			&ast.Map{
+				LBrace: 1,
+				Nodes: []ast.Node{
+					&ast.String{Input: `"a"`, InputPos: 2, Value: "a"},
+					&ast.Int{Input: "1", InputPos: 6, Value: 1},
+				},
+				RBrace: 7,
+			},
+		},
+	}, {
+		`(a {})`,
+		[]ast.Node{
+			&ast.List{
+				LParens: 1,
+				Nodes: []ast.Node{
+					&ast.Symbol{Name: "a", NamePos: 2},
+					&ast.Map{LBrace: 4, RBrace: 5},
+				},
+				RParens: 6,
+			},
+		},
+	}, {
+		`{"a"}`,
+		errorf(`twik source:1:1: map literal takes an even number of entries`),
+	}, {
+		`{"a" 1`,
+		errorf(`twik source:1:7: missing }`),
+	}, {
+		`(a})`,
+		errorf(`twik source:1:4: unexpected }`),
+	},
+
 	{
 		"(a\nb\nc",
 		errorf(`twik source:3:2: missing \)`),
@@ -162,3 +311,249 @@ var parserTests = []struct {
 		},
 	},
 }
+
+func (S) TestParserErrorRange(c *C) {
+	fset := ast.NewFileSet()
+	_, err := ast.ParseString(fset, "", `(+ 1 0n10)`)
+	c.Assert(err, FitsTypeOf, &ast.Error{})
+	e := err.(*ast.Error)
+	c.Assert(e.Msg, Equals, "invalid int literal: 0n10")
+	c.Assert(e.Pos, Equals, ast.Pos(6))
+	c.Assert(e.End, Equals, ast.Pos(10))
+	c.Assert(fset.Snippet(e.Pos, e.End, false), Equals, "(+ 1 0n10)\n     ^~~~\n")
+}
+
+func (S) TestQuoteList(c *C) {
+	fset := ast.NewFileSet()
+	root, err := ast.ParseString(fset, "", "(f ,@x)")
+	c.Assert(err, IsNil)
+	q := root.(*ast.Root).Nodes[0].(*ast.List).Nodes[1].(*ast.Quote)
+	c.Assert(q.Name(), Equals, "unquote-splicing")
+	c.Assert(q.End(), Equals, ast.Pos(7))
+	c.Assert(q.List(), DeepEquals, &ast.List{
+		LParens: 4,
+		Nodes: []ast.Node{
+			&ast.Symbol{Name: "unquote-splicing", NamePos: 4},
+			&ast.Symbol{Name: "x", NamePos: 6},
+		},
+		RParens: 6,
+	})
+}
+
+func (S) TestPosInfoMultipleFiles(c *C) {
+	fset := ast.NewFileSet()
+	root1, err := ast.ParseString(fset, "a", "1\n22")
+	c.Assert(err, IsNil)
+	root2, err := ast.ParseString(fset, "b", "\n333")
+	c.Assert(err, IsNil)
+	c.Assert(fset.PosInfo(root1.(*ast.Root).Nodes[1].Pos()).String(), Equals, "a:2:1:")
+	c.Assert(fset.PosInfo(root2.(*ast.Root).Nodes[0].Pos()).String(), Equals, "b:2:1:")
+}
+
+var snippetTests = []struct {
+	code       string
+	start, end int
+	color      bool
+	snippet    string
+}{{
+	"(+ 1 (foo 2))", 5, 12, false,
+	"(+ 1 (foo 2))\n     ^~~~~~~\n",
+}, {
+	"(+ 1\n\t(foo 2))", 7, 10, false,
+	"\t(foo 2))\n\t ^~~\n",
+}, {
+	"(foo\n  2)", 0, 10, false,
+	"(foo\n^~~~\n",
+}, {
+	"(\"ação\" x)", 1, 9, false,
+	"(\"ação\" x)\n ^~~~~~\n",
+}, {
+	"(foo)", 1, 4, true,
+	"(foo)\n \x1b[1;31m^~~\x1b[0m\n",
+}, {
+	"(foo", 4, 4, false,
+	"(foo\n    ^\n",
+}}
+
+func (S) TestSnippet(c *C) {
+	for _, test := range snippetTests {
+		fset := ast.NewFileSet()
+		ast.ParseString(fset, "", test.code)
+		c.Assert(fset.Snippet(ast.Pos(1+test.start), ast.Pos(1+test.end), test.color), Equals, test.snippet, Commentf("Code: %q", test.code))
+	}
+}
+
+func (S) TestParseComments(c *C) {
+	code := "; Package doc.\n\n;; add returns\n;; the sum.\n(func add (a b) ; trailing\n  ; inner\n  (+ a b))\n(b) ; c\n(c)"
+	fset := ast.NewFileSet()
+	node, err := ast.ParseMode(fset, "", code, ast.ParseComments)
+	c.Assert(err, IsNil)
+	root := node.(*ast.Root)
+
+	var texts []string
+	for _, group := range root.Comments {
+		var list []string
+		for _, comment := range group.List {
+			list = append(list, comment.Text)
+			c.Assert(code[comment.Pos()-1:comment.End()-1], Equals, comment.Text)
+		}
+		texts = append(texts, strings.Join(list, "|"))
+	}
+	c.Assert(texts, DeepEquals, []string{"; Package doc.", ";; add returns|;; the sum.", "; trailing", "; inner", "; c"})
+
+	add := root.Nodes[0].(*ast.List)
+	c.Assert(add.Doc, Equals, root.Comments[1])
+	c.Assert(add.Doc.Text(), Equals, "add returns\nthe sum.\n")
+	c.Assert(add.Nodes[3].(*ast.List).Doc, Equals, root.Comments[3])
+	c.Assert(root.Nodes[1].(*ast.List).Doc, IsNil)
+	c.Assert(root.Nodes[2].(*ast.List).Doc, IsNil)
+
+	// Comments are dropped by default.
+	node, err = ast.ParseString(fset, "", code)
+	c.Assert(err, IsNil)
+	c.Assert(node.(*ast.Root).Comments, IsNil)
+	c.Assert(node.(*ast.Root).Nodes[0].(*ast.List).Doc, IsNil)
+}
+
+func (S) TestCommentGroupText(c *C) {
+	group := &ast.CommentGroup{List: []*ast.Comment{{Text: ";"}, {Text: ";  indented  "}, {Text: ";;"}}}
+	c.Assert(group.Text(), Equals, " indented\n")
+	c.Assert((*ast.CommentGroup)(nil).Text(), Equals, "")
+}
+
+var allErrorsTests = []struct {
+	code   string
+	nodes  []ast.Node
+	errors []string
+}{{
+	"(a 1n) (b",
+	[]ast.Node{
+		&ast.List{
+			LParens: 1,
+			Nodes: []ast.Node{
+				&ast.Symbol{Name: "a", NamePos: 2},
+				&ast.Bad{From: 4, To: 6},
+			},
+			RParens: 6,
+		},
+		&ast.Bad{From: 8, To: 10},
+	},
+	[]string{
+		"twik source:1:4: invalid int literal: 1n",
+		"twik source:1:10: missing )",
+	},
+}, {
+	")a}",
+	[]ast.Node{
+		&ast.Bad{From: 1, To: 2},
+		&ast.Symbol{Name: "a", NamePos: 2},
+		&ast.Bad{From: 3, To: 4},
+	},
+	[]string{
+		"twik source:1:2: unexpected )",
+		"twik source:1:4: unexpected }",
+	},
+}, {
+	"(a ') {1}",
+	[]ast.Node{
+		&ast.List{
+			LParens: 1,
+			Nodes: []ast.Node{
+				&ast.Symbol{Name: "a", NamePos: 2},
+				&ast.Bad{From: 4, To: 5},
+			},
+			RParens: 5,
+		},
+		&ast.Bad{From: 7, To: 10},
+	},
+	[]string{
+		"twik source:1:4: missing expression after '",
+		"twik source:1:7: map literal takes an even number of entries",
+	},
+}, {
+	"(a (b}))\n\"c",
+	[]ast.Node{
+		&ast.List{
+			LParens: 1,
+			Nodes: []ast.Node{
+				&ast.Symbol{Name: "a", NamePos: 2},
+				&ast.List{
+					LParens: 4,
+					Nodes: []ast.Node{
+						&ast.Symbol{Name: "b", NamePos: 5},
+						&ast.Bad{From: 6, To: 7},
+					},
+					RParens: 7,
+				},
+			},
+			RParens: 8,
+		},
+		&ast.Bad{From: 10, To: 12},
+	},
+	[]string{
+		"twik source:1:7: unexpected }",
+		`twik source:2:1: unclosed string literal: "c`,
+	},
+}, {
+	"((a",
+	[]ast.Node{
+		&ast.Bad{From: 1, To: 4},
+	},
+	[]string{
+		"twik source:1:4: missing )",
+	},
+}, {
+	"(a b)",
+	[]ast.Node{
+		&ast.List{
+			LParens: 1,
+			Nodes: []ast.Node{
+				&ast.Symbol{Name: "a", NamePos: 2},
+				&ast.Symbol{Name: "b", NamePos: 4},
+			},
+			RParens: 5,
+		},
+	},
+	nil,
+}}
+
+func (S) TestParseAllErrors(c *C) {
+	for _, test := range allErrorsTests {
+		fset := ast.NewFileSet()
+		node, err := ast.ParseMode(fset, "", test.code, ast.AllErrors)
+		c.Assert(node.(*ast.Root).Nodes, DeepEquals, test.nodes, Commentf("Code: %q", test.code))
+		if test.errors == nil {
+			c.Assert(err, IsNil)
+			continue
+		}
+		c.Assert(err, FitsTypeOf, ast.ErrorList{})
+		var errors []string
+		for _, e := range err.(ast.ErrorList) {
+			errors = append(errors, e.Error())
+		}
+		c.Assert(errors, DeepEquals, test.errors, Commentf("Code: %q", test.code))
+	}
+}
+
+func (S) TestErrorList(c *C) {
+	fset := ast.NewFileSet()
+	_, err1 := ast.ParseMode(fset, "b", "1n\n(", ast.AllErrors)
+	_, err2 := ast.ParseMode(fset, "a", "x 2n", ast.AllErrors)
+	var list ast.ErrorList
+	list = append(list, err1.(ast.ErrorList)...)
+	list = append(list, err2.(ast.ErrorList)...)
+	list.Sort()
+	var errors []string
+	for _, e := range list {
+		errors = append(errors, e.Error())
+	}
+	c.Assert(errors, DeepEquals, []string{
+		"a:1:3: invalid int literal: 2n",
+		"b:1:1: invalid int literal: 1n",
+		"b:2:2: missing )",
+	})
+	c.Assert(list.Error(), Equals, "a:1:3: invalid int literal: 2n (and 2 more errors)")
+	c.Assert(list[:1].Error(), Equals, "a:1:3: invalid int literal: 2n")
+	c.Assert(list.Err(), NotNil)
+	c.Assert(ast.ErrorList(nil).Err(), IsNil)
+}
@@ -0,0 +1,297 @@
+package ast
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// Fprint writes node to w as twik code in canonical form.
+//
+// The elements of lists and maps are separated by a single space, or
+// start new lines where they started new lines in the source code they
+// were parsed from, keeping up to one blank line between them. Elements
+// starting a line are indented by two spaces past the opening parenthesis
+// in the body of known special forms such as func, for, range, if, and
+// do. In other lists, they are aligned with the first argument when it
+// follows the first element on the same line, or with the first element
+// otherwise. Closing parentheses never start a line, unless they follow
+// a comment. Top-level nodes in a Root always start new lines, and the
+// output of a Root ends with a new line.
+//
+// Comments are preserved when the node was parsed with the ParseComments
+// mode: all of them for a Root, and the ones in the Doc field of the
+// node and of the lists within it for other nodes. Nodes that were not
+// parsed from source code, such as the ones built by hand, have the body
+// of special forms starting new lines, and their other elements separated
+// by spaces. Literals are written as their Input field holds them, and
+// Bad nodes as the source code they span, so they cannot be printed
+// without it.
+func Fprint(w io.Writer, fset *FileSet, node Node) error {
+	p := &printer{}
+	if fset != nil {
+		p.file = fset.file(node.Pos())
+	}
+	if root, ok := node.(*Root); ok {
+		for _, group := range root.Comments {
+			p.comments = append(p.comments, group.List...)
+		}
+		p.root(root)
+	} else {
+		Inspect(node, func(node Node) bool {
+			if group, ok := node.(*CommentGroup); ok {
+				p.comments = append(p.comments, group.List...)
+			}
+			return true
+		})
+		if list, ok := node.(*List); ok && list.Doc != nil {
+			if breaks, _, _ := p.gap(list.Doc.Pos(), list.Pos(), 0); breaks > 0 {
+				p.newline(1, 0)
+			}
+		}
+		p.node(node)
+	}
+	if p.err != nil {
+		return p.err
+	}
+	_, err := w.Write(p.buf.Bytes())
+	return err
+}
+
+// bodyForms holds the number of arguments that precede the body of known
+// special forms, which is indented differently from other lists.
+var bodyForms = map[string]int{
+	"func":    1,
+	"macro":   2,
+	"for":     3,
+	"range":   2,
+	"if":      1,
+	"do":      0,
+	"let":     1,
+	"let*":    1,
+	"cond":    0,
+	"switch":  1,
+	"when":    1,
+	"unless":  1,
+	"try":     0,
+	"catch":   1,
+	"finally": 0,
+}
+
+// bodyStart returns the index of the first node in the body of the
+// special form held by nodes, or -1 if nodes do not hold a known form.
+func bodyStart(nodes []Node) int {
+	symbol, ok := nodes[0].(*Symbol)
+	if !ok {
+		return -1
+	}
+	n, ok := bodyForms[symbol.Name]
+	if !ok {
+		return -1
+	}
+	if symbol.Name == "func" && len(nodes) > 1 {
+		if _, ok := nodes[1].(*Symbol); ok {
+			n++
+		}
+	}
+	return n + 1
+}
+
+type printer struct {
+	buf bytes.Buffer
+	col int
+	err error
+
+	// file holds the source code of the nodes being printed, or is nil
+	// if there is no such code.
+	file *file
+
+	// comments holds the comments to print in order, and next the index
+	// of the first one not yet printed.
+	comments []*Comment
+	next     int
+}
+
+// write writes s, which holds no new lines, to the output.
+func (p *printer) write(s string) {
+	p.buf.WriteString(s)
+	p.col += utf8.RuneCountInString(s)
+}
+
+// newline writes n new lines, up to two of them, to the output, and
+// indents the next line by indent columns.
+func (p *printer) newline(n, indent int) {
+	if n > 2 {
+		n = 2
+	}
+	p.buf.WriteString(strings.Repeat("\n", n))
+	p.buf.WriteString(strings.Repeat(" ", indent))
+	p.col = indent
+}
+
+// sourced returns whether the source code between the from and to
+// positions is available.
+func (p *printer) sourced(from, to Pos) bool {
+	f := p.file
+	return f != nil && from >= f.base && from <= to && to <= f.base+Pos(len(f.code))
+}
+
+// gap writes the comments found between the from and to positions,
+// indenting the ones that start a line by indent columns. It returns the
+// number of line breaks the next node should be preceded by, which is
+// at least one after a comment, whether there were comments, and whether
+// the source code is available at all.
+func (p *printer) gap(from, to Pos, indent int) (breaks int, comments, sourced bool) {
+	if !p.sourced(from, to) {
+		return 0, false, false
+	}
+	for p.next < len(p.comments) && p.comments[p.next].Pos() < from {
+		p.next++
+	}
+	line, _ := p.file.line(from)
+	for p.next < len(p.comments) && p.comments[p.next].Pos() < to {
+		comment := p.comments[p.next]
+		p.next++
+		cline, _ := p.file.line(comment.Pos())
+		switch {
+		case p.buf.Len() == 0:
+		case cline == line:
+			p.write(" ")
+		default:
+			p.newline(cline-line, indent)
+		}
+		p.write(strings.TrimSpace(comment.Text))
+		line = cline
+		comments = true
+	}
+	end, _ := p.file.line(to)
+	breaks = end - line
+	if comments && breaks == 0 {
+		breaks = 1
+	}
+	return breaks, comments, true
+}
+
+func (p *printer) root(root *Root) {
+	end := root.First
+	for _, node := range root.Nodes {
+		breaks, _, _ := p.gap(end, node.Pos(), 0)
+		if p.buf.Len() > 0 {
+			if breaks == 0 {
+				breaks = 1
+			}
+			p.newline(breaks, 0)
+		}
+		p.node(node)
+		end = node.End()
+	}
+	p.gap(end, root.After, 0)
+	if p.buf.Len() > 0 {
+		p.buf.WriteByte('\n')
+	}
+}
+
+func (p *printer) node(node Node) {
+	switch node := node.(type) {
+	case *Symbol:
+		p.write(node.Name)
+	case *Int:
+		p.write(node.Input)
+	case *Float:
+		p.write(node.Input)
+	case *Ratio:
+		p.write(node.Input)
+	case *Decimal:
+		p.write(node.Input)
+	case *String:
+		p.write(node.Input)
+	case *List:
+		p.sequence("(", ")", node.LParens, node.Nodes, node.RParens)
+	case *Map:
+		p.sequence("{", "}", node.LBrace, node.Nodes, node.RBrace)
+	case *Quote:
+		p.write(node.Mark)
+		breaks, _, _ := p.gap(node.MarkPos+Pos(len(node.Mark)), node.Node.Pos(), p.col)
+		if breaks > 0 {
+			p.newline(1, p.col)
+		}
+		from := p.buf.Len()
+		p.node(node.Node)
+		if breaks == 0 && node.Mark == "'" {
+			p.separate(from)
+		}
+	case *Bad:
+		if !p.sourced(node.From, node.To) {
+			p.fail(node)
+			break
+		}
+		text := p.file.code[node.From-p.file.base : node.To-p.file.base]
+		if i := strings.LastIndex(text, "\n"); i >= 0 {
+			p.buf.WriteString(text)
+			p.col = utf8.RuneCountInString(text[i+1:])
+		} else {
+			p.write(text)
+		}
+	default:
+		p.fail(node)
+	}
+}
+
+// separate inserts a space after the quote mark that ends at the from
+// offset in the output when the node written after it would otherwise be
+// read together with the mark as a char literal, as in ' "'a".
+func (p *printer) separate(from int) {
+	text := p.buf.Bytes()[from:]
+	if _, n := charLiteral(string(text)); n == 0 {
+		return
+	}
+	text = append([]byte(" "), text...)
+	p.buf.Truncate(from)
+	p.buf.Write(text)
+	if bytes.IndexByte(text, '\n') < 0 {
+		p.col++
+	}
+}
+
+// fail records that node cannot be printed.
+func (p *printer) fail(node Node) {
+	if p.err == nil {
+		p.err = fmt.Errorf("cannot print %#v", node)
+	}
+}
+
+// sequence writes the nodes of a list or map delimited by the open and
+// close marks found at the lpos and rpos positions.
+func (p *printer) sequence(open, close string, lpos Pos, nodes []Node, rpos Pos) {
+	start := -1
+	indent := p.col + 1
+	if open == "(" && len(nodes) > 0 {
+		if start = bodyStart(nodes); start >= 0 {
+			indent = p.col + 2
+		}
+	}
+	p.write(open)
+	end := lpos + 1
+	for i, node := range nodes {
+		breaks, _, sourced := p.gap(end, node.Pos(), indent)
+		if !sourced && start >= 0 && i >= start {
+			breaks = 1
+		}
+		if breaks > 0 {
+			p.newline(breaks, indent)
+		} else if i > 0 {
+			p.write(" ")
+			if i == 1 && open == "(" && start < 0 {
+				indent = p.col
+			}
+		}
+		p.node(node)
+		end = node.End()
+	}
+	if _, comments, _ := p.gap(end, rpos, indent); comments {
+		p.newline(1, indent)
+	}
+	p.write(close)
+}
@@ -0,0 +1,147 @@
+package ast_test
+
+import (
+	"bytes"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/twik.v1/ast"
+)
+
+var printTests = []struct {
+	code   string
+	output string
+}{{
+	"(+   1\t2)  (- 3 4)",
+	"(+ 1 2)\n(- 3 4)\n",
+}, {
+	"\n\n(a)\n\n\n\n(b)\n\n",
+	"(a)\n\n(b)\n",
+}, {
+	"(func add (a b)\n(+ a b))",
+	"(func add (a b)\n  (+ a b))\n",
+}, {
+	"(func (a b)\n        (+ a b))",
+	"(func (a b)\n  (+ a b))\n",
+}, {
+	"(if (< a b)\n  a\n      b)",
+	"(if (< a b)\n  a\n  b)\n",
+}, {
+	"(if (< a b) a b)",
+	"(if (< a b) a b)\n",
+}, {
+	"(for (var i 0) (< i 10) (set i (+ i 1))\n(printf \"%d\\n\" i)\n)",
+	"(for (var i 0) (< i 10) (set i (+ i 1))\n  (printf \"%d\\n\" i))\n",
+}, {
+	"(range x (list 1 2)\n(do\n(f x)\n(g x)))",
+	"(range x (list 1 2)\n  (do\n    (f x)\n    (g x)))\n",
+}, {
+	"(foo 1\n2\n  3)",
+	"(foo 1\n     2\n     3)\n",
+}, {
+	"(foo\n1\n  2)",
+	"(foo\n 1\n 2)\n",
+}, {
+	"(list (foo 1\n2) 3\n4)",
+	"(list (foo 1\n           2) 3\n      4)\n",
+}, {
+	"{\"a\" 1\n\"b\" 2}",
+	"{\"a\" 1\n \"b\" 2}\n",
+}, {
+	"'(a   b) `(c ,d ,@e)",
+	"'(a b)\n`(c ,d ,@e)\n",
+}, {
+	"0x10 'a' 1.50 1/3 2.5m \"s\\n\" :k",
+	"0x10\n'a'\n1.50\n1/3\n2.5m\n\"s\\n\"\n:k\n",
+}, {
+	"; header\n\n; about f\n(func f () ; trailing\n  ; inside\n  1   ;  last   \n)\n; footer",
+	"; header\n\n; about f\n(func f () ; trailing\n  ; inside\n  1 ;  last\n  )\n; footer\n",
+}, {
+	"(a ; c\n b)",
+	"(a ; c\n b)\n",
+}, {
+	"(do ; c\n)",
+	"(do ; c\n  )\n",
+}, {
+	"",
+	"",
+}, {
+	"; only",
+	"; only\n",
+}}
+
+func (S) TestFprint(c *C) {
+	for _, test := range printTests {
+		fset := ast.NewFileSet()
+		root, err := ast.ParseMode(fset, "", test.code, ast.ParseComments)
+		c.Assert(err, IsNil)
+		var buf bytes.Buffer
+		err = ast.Fprint(&buf, fset, root)
+		c.Assert(err, IsNil)
+		c.Assert(buf.String(), Equals, test.output, Commentf("Code: %q", test.code))
+
+		// Formatting is idempotent.
+		root, err = ast.ParseMode(fset, "", buf.String(), ast.ParseComments)
+		c.Assert(err, IsNil)
+		var again bytes.Buffer
+		err = ast.Fprint(&again, fset, root)
+		c.Assert(err, IsNil)
+		c.Assert(again.String(), Equals, test.output, Commentf("Code: %q", test.code))
+	}
+}
+
+func (S) TestFprintNode(c *C) {
+	fset := ast.NewFileSet()
+	root, err := ast.ParseString(fset, "", "(a (b\n  c))")
+	c.Assert(err, IsNil)
+	var buf bytes.Buffer
+	err = ast.Fprint(&buf, fset, root.(*ast.Root).Nodes[0].(*ast.List).Nodes[1])
+	c.Assert(err, IsNil)
+	c.Assert(buf.String(), Equals, "(b\n c)")
+}
+
+func (S) TestFprintWithoutSource(c *C) {
+	sym := func(name string) *ast.Symbol { return &ast.Symbol{Name: name} }
+	node := &ast.List{Nodes: []ast.Node{
+		sym("func"), sym("f"), &ast.List{Nodes: []ast.Node{sym("x")}},
+		&ast.List{Nodes: []ast.Node{sym("if"), sym("x"), sym("a"), sym("b")}},
+		&ast.List{Nodes: []ast.Node{sym("g"), sym("x"), sym("y")}},
+	}}
+	var buf bytes.Buffer
+	err := ast.Fprint(&buf, nil, node)
+	c.Assert(err, IsNil)
+	c.Assert(buf.String(), Equals, "(func f (x)\n  (if x\n    a\n    b)\n  (g x y))")
+}
+
+func (S) TestFprintWithoutComments(c *C) {
+	fset := ast.NewFileSet()
+	root, err := ast.ParseString(fset, "", "; about f\n(f 1 ; one\n 2)")
+	c.Assert(err, IsNil)
+	var buf bytes.Buffer
+	err = ast.Fprint(&buf, fset, root)
+	c.Assert(err, IsNil)
+	c.Assert(buf.String(), Equals, "(f 1\n   2)\n")
+}
+
+func (S) TestFprintDoc(c *C) {
+	fset := ast.NewFileSet()
+	root, err := ast.ParseMode(fset, "", "(a\n ; about b\n (b\n  c) ; after\n)", ast.ParseComments)
+	c.Assert(err, IsNil)
+	var buf bytes.Buffer
+	err = ast.Fprint(&buf, fset, root.(*ast.Root).Nodes[0].(*ast.List).Nodes[1])
+	c.Assert(err, IsNil)
+	c.Assert(buf.String(), Equals, "; about b\n(b\n c)")
+}
+
+func (S) TestFprintBad(c *C) {
+	fset := ast.NewFileSet()
+	root, err := ast.ParseMode(fset, "", "(a   1n\n  b) ((c\n d", ast.AllErrors)
+	c.Assert(err, NotNil)
+	var buf bytes.Buffer
+	err = ast.Fprint(&buf, fset, root)
+	c.Assert(err, IsNil)
+	c.Assert(buf.String(), Equals, "(a 1n\n   b)\n((c\n d\n")
+
+	buf.Reset()
+	err = ast.Fprint(&buf, nil, &ast.Bad{})
+	c.Assert(err, ErrorMatches, "cannot print .*")
+}
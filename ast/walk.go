@@ -0,0 +1,71 @@
+package ast
+
+import (
+	"fmt"
+)
+
+// A Visitor's Visit method is invoked for each node encountered by Walk.
+// If the result visitor w is not nil, Walk visits each of the children
+// of node with the visitor w, followed by a call of w.Visit(nil).
+type Visitor interface {
+	Visit(node Node) (w Visitor)
+}
+
+// Walk traverses an AST in depth-first order. It starts by calling
+// v.Visit(node), and if the visitor w returned by it is not nil, Walk is
+// invoked recursively with w for each of the children of node, followed
+// by a call of w.Visit(nil).
+//
+// The children of a List are the comment group in its Doc field, if any,
+// followed by its nodes. The comments in the Comments field of a Root
+// are not visited, as the ones leading lists are visited through them.
+func Walk(v Visitor, node Node) {
+	if v = v.Visit(node); v == nil {
+		return
+	}
+	switch n := node.(type) {
+	case *Root:
+		walkList(v, n.Nodes)
+	case *List:
+		if n.Doc != nil {
+			Walk(v, n.Doc)
+		}
+		walkList(v, n.Nodes)
+	case *Map:
+		walkList(v, n.Nodes)
+	case *Quote:
+		Walk(v, n.Node)
+	case *CommentGroup:
+		for _, c := range n.List {
+			Walk(v, c)
+		}
+	case *Int, *Float, *Ratio, *Decimal, *String, *Symbol, *Comment, *Bad:
+		// Nothing to do.
+	default:
+		panic(fmt.Sprintf("ast.Walk: unexpected node type %T", n))
+	}
+	v.Visit(nil)
+}
+
+func walkList(v Visitor, nodes []Node) {
+	for _, node := range nodes {
+		Walk(v, node)
+	}
+}
+
+type inspector func(Node) bool
+
+func (f inspector) Visit(node Node) Visitor {
+	if f(node) {
+		return f
+	}
+	return nil
+}
+
+// Inspect traverses an AST in depth-first order, as done by Walk. It
+// starts by calling f(node), and if it returns true, Inspect is invoked
+// recursively with f for each of the children of node, followed by a
+// call of f(nil).
+func Inspect(node Node, f func(Node) bool) {
+	Walk(inspector(f), node)
+}
@@ -0,0 +1,103 @@
+package ast_test
+
+import (
+	"fmt"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/twik.v1/ast"
+)
+
+// describe returns a short description of node for traversal tests.
+func describe(node ast.Node) string {
+	switch n := node.(type) {
+	case nil:
+		return "nil"
+	case *ast.Root:
+		return "root"
+	case *ast.List:
+		return "list"
+	case *ast.Map:
+		return "map"
+	case *ast.Quote:
+		return "quote"
+	case *ast.CommentGroup:
+		return "group"
+	case *ast.Comment:
+		return n.Text
+	case *ast.Symbol:
+		return n.Name
+	case *ast.Int:
+		return n.Input
+	case *ast.String:
+		return n.Input
+	}
+	return fmt.Sprintf("%T", node)
+}
+
+type recorder struct {
+	visited *[]string
+	skip    string
+}
+
+func (r recorder) Visit(node ast.Node) ast.Visitor {
+	*r.visited = append(*r.visited, describe(node))
+	if node != nil && describe(node) == r.skip {
+		return nil
+	}
+	return r
+}
+
+func (S) TestWalk(c *C) {
+	fset := ast.NewFileSet()
+	root, err := ast.ParseMode(fset, "", "; about f\n(f 1 '(a) {\"k\" b})", ast.ParseComments)
+	c.Assert(err, IsNil)
+
+	var visited []string
+	ast.Walk(recorder{visited: &visited}, root)
+	c.Assert(visited, DeepEquals, []string{
+		"root",
+		"list",
+		"group", "; about f", "nil", "nil",
+		"f", "nil",
+		"1", "nil",
+		"quote", "list", "a", "nil", "nil", "nil",
+		"map", `"k"`, "nil", "b", "nil", "nil",
+		"nil",
+		"nil",
+	})
+
+	visited = nil
+	ast.Walk(recorder{visited: &visited, skip: "quote"}, root)
+	c.Assert(visited, DeepEquals, []string{
+		"root",
+		"list",
+		"group", "; about f", "nil", "nil",
+		"f", "nil",
+		"1", "nil",
+		"quote",
+		"map", `"k"`, "nil", "b", "nil", "nil",
+		"nil",
+		"nil",
+	})
+}
+
+func (S) TestInspect(c *C) {
+	fset := ast.NewFileSet()
+	root, err := ast.ParseString(fset, "", "(a (b c) d) (e)")
+	c.Assert(err, IsNil)
+
+	var symbols []string
+	ast.Inspect(root, func(node ast.Node) bool {
+		if sym, ok := node.(*ast.Symbol); ok {
+			symbols = append(symbols, sym.Name)
+		}
+		// Do not descend into lists starting with b.
+		if list, ok := node.(*ast.List); ok {
+			if sym, ok := list.Nodes[0].(*ast.Symbol); ok && sym.Name == "b" {
+				return false
+			}
+		}
+		return true
+	})
+	c.Assert(symbols, DeepEquals, []string{"a", "d", "e"})
+}
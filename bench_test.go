@@ -54,3 +54,35 @@ func (S) BenchmarkEvalFib10(c *C) {
 	c.Assert(err, IsNil)
 	c.Assert(value, NotNil)
 }
+
+func (S) BenchmarkRunFib10(c *C) {
+	fset := twik.NewFileSet()
+	node, err := twik.ParseString(fset, "", "(func fib (n) (if (== n 0) 0 (if (== n 1) 1 (+ (fib (- n 1)) (fib (- n 2)))))) (fib 10)")
+	c.Assert(err, IsNil)
+	prog, err := twik.Compile(fset, node)
+	c.Assert(err, IsNil)
+	var value interface{}
+	c.ResetTimer()
+	for i := 0; i < c.N; i++ {
+		value, err = prog.Run(twik.NewScope(fset))
+	}
+	c.StopTimer()
+	c.Assert(err, IsNil)
+	c.Assert(value, NotNil)
+}
+
+func (S) BenchmarkBytecodeFib10(c *C) {
+	fset := twik.NewFileSet()
+	node, err := twik.ParseString(fset, "", "(func fib (n) (if (== n 0) 0 (if (== n 1) 1 (+ (fib (- n 1)) (fib (- n 2)))))) (fib 10)")
+	c.Assert(err, IsNil)
+	bc, err := twik.CompileBytecode(fset, node)
+	c.Assert(err, IsNil)
+	var value interface{}
+	c.ResetTimer()
+	for i := 0; i < c.N; i++ {
+		value, err = bc.Run(twik.NewScope(fset))
+	}
+	c.StopTimer()
+	c.Assert(err, IsNil)
+	c.Assert(value, NotNil)
+}
@@ -0,0 +1,691 @@
+package twik
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"gopkg.in/twik.v1/ast"
+)
+
+// Bytecode holds twik logic compiled into instructions for a stack-based
+// virtual machine, so that it may be run several times without walking
+// the parsed tree again. It is an alternative to Program, and resolves
+// symbols and evaluates special forms in the same way.
+//
+// The instructions may be inspected with Disassemble.
+//
+// A Bytecode is safe for concurrent use by multiple goroutines.
+type Bytecode struct {
+	fset    *ast.FileSet
+	main    *chunk
+	funcs   []*chunk
+	consts  []interface{}
+	refs    []*symref
+	forms   []form
+	nodes   [][]ast.Node
+	blocks  []*block
+	globals []string
+}
+
+// chunk holds the instructions of the top level logic or of a function.
+type chunk struct {
+	name   string
+	code   []instr
+	nodes  []ast.Node
+	block  *block
+	sig    *signature
+	params []int
+}
+
+// instr is a single instruction. Its operands are documented with the
+// respective opcode. Instructions that jump hold the target in a.
+type instr struct {
+	op      opcode
+	a, b, c int32
+}
+
+// form holds a standard special form compiled directly into instructions.
+type form struct {
+	ref   *symref
+	fn    func(*Scope, []ast.Node) (interface{}, error)
+	nodes []ast.Node
+}
+
+type opcode uint8
+
+// The operands of each opcode are a, b, and c, as described below.
+const (
+	// opConst pushes consts[a].
+	opConst opcode = iota
+	// opGet pushes the value of refs[a].
+	opGet
+	// opSet pops a value, sets refs[a] to it, and pushes nil.
+	opSet
+	// opVar pops a value, defines slot a of the frame with it, and pushes nil.
+	opVar
+	// opFunc pushes a function running funcs[a], and defines slot b
+	// of the frame with it unless b is -1.
+	opFunc
+	// opMacro replaces the function on top of the stack with a macro
+	// expanding with it, defined with nodes[b], and defines slot a of the
+	// frame with the macro.
+	opMacro
+	// opPop pops a value.
+	opPop
+	// opReplace pops a value and replaces the top of the stack with it.
+	opReplace
+	// opDefault jumps to a unless slot b of the frame is undefined.
+	opDefault
+	// opJump jumps to a.
+	opJump
+	// opJumpFalse pops a value and jumps to a if it is false.
+	opJumpFalse
+	// opAndJump jumps to a if the top value is false, or else pops it.
+	opAndJump
+	// opOrJump jumps to a if the top value is not false, or else pops it.
+	opOrJump
+	// opCase jumps to a if the top value equals consts[b], as compared
+	// by ==.
+	opCase
+	// opStep accounts for the evaluation of a list.
+	opStep
+	// opForm continues if the symbol of forms[b] holds the respective
+	// special form. Otherwise it calls the value held with the nodes
+	// of forms[b], pushes the result, and jumps to a.
+	opForm
+	// opSpecial calls the special form on top of the stack with nodes[b],
+	// replaces it with the result, and jumps to a. It fails if the top
+	// value is neither a special form nor a function.
+	opSpecial
+	// opCall pops a arguments and a function, and pushes the result of
+	// calling the function with the arguments.
+	opCall
+	// opTailCall is like opCall, but if the function was defined with
+	// func it returns from the current function with the call instead.
+	opTailCall
+	// opUnpack pops a list of a elements and pushes its elements.
+	opUnpack
+	// opKey fails unless the top value is a string.
+	opKey
+	// opMap pops a pairs of keys and values, and pushes a map holding them.
+	opMap
+	// opEnter enters a new frame for blocks[a].
+	opEnter
+	// opLeave leaves the current frame.
+	opLeave
+	// opCheck fails if the context being observed is done.
+	opCheck
+	// opRange pops a value, sets slots b and c to their initial values,
+	// and pushes an iterator over the value followed by the value itself.
+	opRange
+	// opNext sets slots b and c to the next entry of the iterator below
+	// the top value, or jumps to a if there are no more entries.
+	opNext
+	// opLoop starts handling break and continue for a loop whose value
+	// is on top of the stack. Break replaces the value and jumps to a,
+	// while continue sets the value to nil and jumps to b. In both cases
+	// the stack and frame are first restored to what they are now.
+	opLoop
+	// opEndLoop stops handling break and continue for the current loop.
+	opEndLoop
+	// opError fails with the error in consts[a].
+	opError
+)
+
+var opNames = []string{
+	opConst:     "const",
+	opGet:       "get",
+	opSet:       "set",
+	opVar:       "var",
+	opFunc:      "func",
+	opMacro:     "macro",
+	opPop:       "pop",
+	opReplace:   "replace",
+	opDefault:   "default",
+	opJump:      "jump",
+	opJumpFalse: "jumpfalse",
+	opAndJump:   "andjump",
+	opOrJump:    "orjump",
+	opCase:      "case",
+	opStep:      "step",
+	opForm:      "form",
+	opSpecial:   "special",
+	opCall:      "call",
+	opTailCall:  "tailcall",
+	opUnpack:    "unpack",
+	opKey:       "key",
+	opMap:       "map",
+	opEnter:     "enter",
+	opLeave:     "leave",
+	opCheck:     "check",
+	opRange:     "range",
+	opNext:      "next",
+	opLoop:      "loop",
+	opEndLoop:   "endloop",
+	opError:     "error",
+}
+
+// CompileBytecode compiles node, which was parsed into fset, into Bytecode.
+func CompileBytecode(fset *ast.FileSet, node ast.Node) (*Bytecode, error) {
+	a := &assembler{symbols: newSymbols(), prog: &Bytecode{fset: fset}}
+	a.chunk = &chunk{name: "top level", block: a.block}
+	a.prog.main = a.chunk
+	a.prog.blocks = append(a.prog.blocks, a.block)
+	if r, ok := node.(*ast.Root); ok {
+		a.seq(r.Nodes, false)
+	} else {
+		a.compile(node)
+	}
+	if a.err != nil {
+		return nil, a.err
+	}
+	a.resolve()
+	a.prog.globals = a.names
+	return a.prog, nil
+}
+
+// Run runs the compiled logic in the s scope and returns the resulting
+// value, in the same way Program.Run does.
+func (b *Bytecode) Run(s *Scope) (value interface{}, err error) {
+	return b.RunContext(context.Background(), s)
+}
+
+// RunContext runs the compiled logic in the s scope like Run, but
+// observes ctx the same way Scope.EvalContext does.
+func (b *Bytecode) RunContext(ctx context.Context, s *Scope) (value interface{}, err error) {
+	m := &machine{run: newRun(ctx, b.fset, s, len(b.globals)), prog: b}
+	value, _, err = m.exec(b.main, newFrame(nil, b.main.block))
+	return value, err
+}
+
+type assembler struct {
+	symbols
+	prog  *Bytecode
+	chunk *chunk
+	err   error
+}
+
+// emit appends an instruction to the current chunk and returns its address.
+// Errors found when running the instruction are positioned at node.
+func (a *assembler) emit(node ast.Node, op opcode, x, y, z int) int {
+	a.chunk.code = append(a.chunk.code, instr{op, int32(x), int32(y), int32(z)})
+	a.chunk.nodes = append(a.chunk.nodes, node)
+	return len(a.chunk.code) - 1
+}
+
+// here returns the address of the next instruction in the current chunk.
+func (a *assembler) here() int {
+	return len(a.chunk.code)
+}
+
+// patch makes the instruction at pc jump to the next instruction emitted.
+func (a *assembler) patch(pc int) {
+	a.chunk.code[pc].a = int32(a.here())
+}
+
+func (a *assembler) constant(node ast.Node, value interface{}) {
+	a.prog.consts = append(a.prog.consts, value)
+	a.emit(node, opConst, len(a.prog.consts)-1, 0, 0)
+}
+
+func (a *assembler) fail(node ast.Node, err error) {
+	a.prog.consts = append(a.prog.consts, err)
+	a.emit(node, opError, len(a.prog.consts)-1, 0, 0)
+}
+
+func (a *assembler) ref(node ast.Node, op opcode, name string) {
+	a.prog.refs = append(a.prog.refs, a.symbols.ref(name))
+	a.emit(node, op, len(a.prog.refs)-1, 0, 0)
+}
+
+func (a *assembler) enter(node ast.Node) *block {
+	b := a.symbols.enter()
+	a.prog.blocks = append(a.prog.blocks, b)
+	a.emit(node, opEnter, len(a.prog.blocks)-1, 0, 0)
+	return b
+}
+
+func (a *assembler) leave(node ast.Node) {
+	a.symbols.leave()
+	a.emit(node, opLeave, 0, 0, 0)
+}
+
+// seq compiles nodes so that only the value of the last one is kept,
+// or nil if there are no nodes. The last node is in tail position of
+// a function body if tail is true.
+func (a *assembler) seq(nodes []ast.Node, tail bool) {
+	if len(nodes) == 0 {
+		a.constant(nil, nil)
+	}
+	for i, node := range nodes {
+		if i > 0 {
+			a.emit(node, opPop, 0, 0, 0)
+		}
+		a.expr(node, tail && i == len(nodes)-1)
+	}
+}
+
+func (a *assembler) compile(node ast.Node) {
+	a.expr(node, false)
+}
+
+// expr compiles node, which is in tail position of a function body if
+// tail is true. Calls in tail position to functions defined with func
+// return from the body with the call, which is made by the function.
+// See Scope.tail for details.
+func (a *assembler) expr(node ast.Node, tail bool) {
+	switch node := node.(type) {
+	case *ast.Symbol:
+		if isKeyword(node.Name) {
+			a.constant(node, Keyword(node.Name[1:]))
+		} else {
+			a.ref(node, opGet, node.Name)
+		}
+	case *ast.Int, *ast.Ratio, *ast.Decimal:
+		a.constant(node, numberOf(node))
+	case *ast.Float:
+		a.constant(node, node.Value)
+	case *ast.String:
+		a.constant(node, node.Value)
+	case *ast.List:
+		if len(node.Nodes) == 0 {
+			a.constant(node, emptyList)
+		} else {
+			a.list(node, tail)
+		}
+	case *ast.Quote:
+		a.expr(node.List(), tail)
+	case *ast.Map:
+		for i, n := range node.Nodes {
+			a.compile(n)
+			if i%2 == 0 {
+				a.emit(n, opKey, 0, 0, 0)
+			}
+		}
+		a.emit(node, opMap, len(node.Nodes)/2, 0, 0)
+	default:
+		if a.err == nil {
+			a.err = fmt.Errorf("support for %#v not yet implemeted", node)
+		}
+	}
+}
+
+func (a *assembler) list(list *ast.List, tail bool) {
+	head, nodes := list.Nodes[0], list.Nodes[1:]
+	if symbol, ok := head.(*ast.Symbol); ok {
+		var fn func(*Scope, []ast.Node) (interface{}, error)
+		var compile func(head ast.Node, nodes []ast.Node, tail bool)
+		switch symbol.Name {
+		case "if":
+			fn, compile = ifFn, a.ifForm
+		case "cond", "switch", "when", "unless":
+			fn, compile = conditionals[symbol.Name], a.conditionalForm
+		case "and":
+			fn, compile = andFn, a.andForm
+		case "or":
+			fn, compile = orFn, a.orForm
+		case "var":
+			fn, compile = varFn, a.varForm
+		case "set":
+			fn, compile = setFn, a.setForm
+		case "do":
+			fn, compile = doFn, a.doForm
+		case "let":
+			fn, compile = letFn, a.letForm
+		case "let*":
+			fn, compile = letStarFn, a.letForm
+		case "func":
+			fn, compile = funcFn, a.funcForm
+		case "for":
+			fn, compile = forFn, a.forForm
+		case "range":
+			fn, compile = rangeFn, a.rangeForm
+		case "macro":
+			fn, compile = macroFn, a.macroForm
+		}
+		if compile != nil {
+			a.emit(head, opStep, 0, 0, 0)
+			a.prog.forms = append(a.prog.forms, form{a.symbols.ref(symbol.Name), fn, nodes})
+			pc := a.emit(head, opForm, 0, len(a.prog.forms)-1, 0)
+			compile(head, nodes, tail)
+			a.patch(pc)
+			return
+		}
+	}
+	a.emit(head, opStep, 0, 0, 0)
+	a.compile(head)
+	a.prog.nodes = append(a.prog.nodes, nodes)
+	pc := a.emit(head, opSpecial, 0, len(a.prog.nodes)-1, 0)
+	for _, node := range nodes {
+		a.compile(node)
+	}
+	if tail {
+		a.emit(head, opTailCall, len(nodes), 0, 0)
+	} else {
+		a.emit(head, opCall, len(nodes), 0, 0)
+	}
+	a.patch(pc)
+}
+
+func (a *assembler) ifForm(head ast.Node, nodes []ast.Node, tail bool) {
+	if len(nodes) < 2 || len(nodes) > 3 {
+		a.fail(head, errors.New(`function "if" takes two or three arguments`))
+		return
+	}
+	a.compile(nodes[0])
+	jfalse := a.emit(head, opJumpFalse, 0, 0, 0)
+	a.expr(nodes[1], tail)
+	jend := a.emit(head, opJump, 0, 0, 0)
+	a.patch(jfalse)
+	if len(nodes) == 3 {
+		a.expr(nodes[2], tail)
+	} else {
+		a.constant(head, false)
+	}
+	a.patch(jend)
+}
+
+// conditionalForm compiles the conditional special form named by head.
+// The value of switch is kept on the stack until a clause is selected.
+func (a *assembler) conditionalForm(head ast.Node, nodes []ast.Node, tail bool) {
+	cond, err := parseConditional(head.(*ast.Symbol).Name, nodes)
+	if err != nil {
+		a.fail(head, err)
+		return
+	}
+	if cond.value != nil {
+		a.compile(cond.value)
+	}
+	var jends []int
+	body := func(nodes []ast.Node) {
+		a.doForm(head, nodes, tail)
+		jends = append(jends, a.emit(head, opJump, 0, 0, 0))
+	}
+	for _, c := range cond.clauses {
+		switch {
+		case c.otherwise:
+			if cond.value != nil {
+				a.emit(head, opPop, 0, 0, 0)
+			}
+			a.doForm(head, c.body, tail)
+		case c.test == nil:
+			var jcases []int
+			for _, value := range c.cases {
+				a.prog.consts = append(a.prog.consts, value)
+				jcases = append(jcases, a.emit(head, opCase, 0, len(a.prog.consts)-1, 0))
+			}
+			jnext := a.emit(head, opJump, 0, 0, 0)
+			for _, pc := range jcases {
+				a.patch(pc)
+			}
+			a.emit(head, opPop, 0, 0, 0)
+			body(c.body)
+			a.patch(jnext)
+		case c.body == nil:
+			a.compile(c.test)
+			jends = append(jends, a.emit(head, opOrJump, 0, 0, 0))
+		case c.not:
+			a.compile(c.test)
+			jnext := a.emit(head, opOrJump, 0, 0, 0)
+			body(c.body)
+			a.patch(jnext)
+			a.emit(head, opPop, 0, 0, 0)
+		default:
+			a.compile(c.test)
+			jnext := a.emit(head, opJumpFalse, 0, 0, 0)
+			body(c.body)
+			a.patch(jnext)
+		}
+	}
+	if n := len(cond.clauses); n == 0 || !cond.clauses[n-1].otherwise {
+		if cond.value != nil {
+			a.emit(head, opPop, 0, 0, 0)
+		}
+		a.constant(head, false)
+	}
+	for _, pc := range jends {
+		a.patch(pc)
+	}
+}
+
+func (a *assembler) andForm(head ast.Node, nodes []ast.Node, tail bool) {
+	a.logic(head, nodes, opAndJump, true, tail)
+}
+
+func (a *assembler) orForm(head ast.Node, nodes []ast.Node, tail bool) {
+	a.logic(head, nodes, opOrJump, false, tail)
+}
+
+// logic compiles nodes so that the evaluation stops early at the first
+// value the jump instruction op jumps on, and empty is used if there
+// are no nodes. The last node is in tail position if tail is true.
+func (a *assembler) logic(head ast.Node, nodes []ast.Node, op opcode, empty, tail bool) {
+	if len(nodes) == 0 {
+		a.constant(head, empty)
+		return
+	}
+	var jumps []int
+	for i, node := range nodes {
+		a.expr(node, tail && i == len(nodes)-1)
+		if i < len(nodes)-1 {
+			jumps = append(jumps, a.emit(head, op, 0, 0, 0))
+		}
+	}
+	for _, pc := range jumps {
+		a.patch(pc)
+	}
+}
+
+func (a *assembler) varForm(head ast.Node, nodes []ast.Node, tail bool) {
+	if len(nodes) == 0 || len(nodes) > 2 {
+		a.fail(head, errors.New("var takes one or two arguments"))
+		return
+	}
+	symbol, ok := nodes[0].(*ast.Symbol)
+	if !ok {
+		a.fail(head, errors.New("var takes a symbol as first argument"))
+		return
+	}
+	if isKeyword(symbol.Name) {
+		a.fail(head, fmt.Errorf("cannot define keyword symbol: %s", symbol.Name))
+		return
+	}
+	if len(nodes) == 2 {
+		a.compile(nodes[1])
+	} else {
+		a.constant(head, nil)
+	}
+	a.emit(head, opVar, a.block.declare(symbol.Name), 0, 0)
+}
+
+func (a *assembler) setForm(head ast.Node, nodes []ast.Node, tail bool) {
+	if len(nodes) != 2 {
+		a.fail(head, errors.New(`function "set" takes two arguments`))
+		return
+	}
+	symbol, ok := nodes[0].(*ast.Symbol)
+	if !ok {
+		a.fail(head, errors.New(`function "set" takes a symbol as first argument`))
+		return
+	}
+	a.compile(nodes[1])
+	a.ref(head, opSet, symbol.Name)
+}
+
+func (a *assembler) doForm(head ast.Node, nodes []ast.Node, tail bool) {
+	a.enter(head)
+	a.seq(nodes, tail)
+	a.leave(head)
+}
+
+// letForm compiles the let or let* special form named by head. The
+// values of each group of bindings are pushed, and then popped into
+// the slots of the block entered for the group.
+func (a *assembler) letForm(head ast.Node, nodes []ast.Node, tail bool) {
+	groups, body, err := parseLet(head.(*ast.Symbol).Name, nodes)
+	if err != nil {
+		a.fail(head, err)
+		return
+	}
+	for _, group := range groups {
+		for _, b := range group {
+			a.compile(b.value)
+			if b.list {
+				a.emit(b.target, opUnpack, len(b.names), 0, 0)
+			}
+		}
+		blk := a.enter(head)
+		var slots []int
+		for _, b := range group {
+			for _, name := range b.names {
+				slots = append(slots, blk.declare(name))
+			}
+		}
+		for i := len(slots) - 1; i >= 0; i-- {
+			a.emit(head, opVar, slots[i], 0, 0)
+			a.emit(head, opPop, 0, 0, 0)
+		}
+	}
+	a.seq(body, tail)
+	for range groups {
+		a.leave(head)
+	}
+}
+
+func (a *assembler) funcForm(head ast.Node, nodes []ast.Node, tail bool) {
+	if len(nodes) < 2 {
+		a.fail(head, errors.New(`func takes three or more arguments`))
+		return
+	}
+	i := 0
+	var name string
+	if symbol, ok := nodes[0].(*ast.Symbol); ok {
+		name = symbol.Name
+		i++
+	}
+	list, ok := nodes[i].(*ast.List)
+	if !ok {
+		a.fail(head, errors.New(`func takes a list of parameters`))
+		return
+	}
+	sig, err := parseSignature("func", list)
+	if err != nil {
+		a.fail(head, err)
+		return
+	}
+	if len(nodes[i+1:]) == 0 {
+		a.fail(head, fmt.Errorf("func takes a body sequence"))
+		return
+	}
+	index := -1
+	if name != "" {
+		index = a.block.declare(name)
+	}
+	a.emit(head, opFunc, a.closure(name, sig, nodes[i+1:]), index, 0)
+}
+
+// closure compiles a function defined with func with the given name,
+// signature, and body into a new chunk, and returns its index in funcs.
+// The chunk starts by setting missing optional and keyword arguments to
+// their default values.
+func (a *assembler) closure(name string, sig *signature, body []ast.Node) int {
+	outer := a.chunk
+	b := a.symbols.enter()
+	a.chunk = &chunk{name: name, block: b, sig: sig, params: make([]int, len(sig.names))}
+	for i, name := range sig.names {
+		a.chunk.params[i] = b.declare(name)
+	}
+	npos := sig.required + sig.optional
+	for i, def := range sig.defaults {
+		if i < sig.required || sig.rest && i == npos {
+			continue
+		}
+		pc := a.emit(def, opDefault, 0, a.chunk.params[i], 0)
+		if def != nil {
+			a.compile(def)
+		} else {
+			a.constant(nil, nil)
+		}
+		a.emit(def, opVar, a.chunk.params[i], 0, 0)
+		a.emit(def, opPop, 0, 0, 0)
+		a.patch(pc)
+	}
+	a.seq(body, true)
+	a.prog.funcs = append(a.prog.funcs, a.chunk)
+	a.symbols.leave()
+	a.chunk = outer
+	return len(a.prog.funcs) - 1
+}
+
+func (a *assembler) macroForm(head ast.Node, nodes []ast.Node, tail bool) {
+	name, sig, body, err := macroArgs(nodes)
+	if err != nil {
+		a.fail(head, err)
+		return
+	}
+	index := a.block.declare(name.Name)
+	a.emit(head, opFunc, a.closure(name.Name, sig, body), -1, 0)
+	a.prog.nodes = append(a.prog.nodes, nodes)
+	a.emit(head, opMacro, index, len(a.prog.nodes)-1, 0)
+}
+
+func (a *assembler) forForm(head ast.Node, nodes []ast.Node, tail bool) {
+	if len(nodes) < 4 {
+		a.fail(head, errors.New(`for takes four or more arguments`))
+		return
+	}
+	a.enter(head)
+	a.compile(nodes[0])
+	a.emit(head, opPop, 0, 0, 0)
+	a.constant(head, nil)
+	loop := a.here()
+	a.emit(head, opCheck, 0, 0, 0)
+	a.compile(nodes[1])
+	jend := a.emit(head, opJumpFalse, 0, 0, 0)
+	// Only the body handles break and continue, as in the test and
+	// step they belong to an enclosing loop.
+	h := a.emit(head, opLoop, 0, 0, 0)
+	a.seq(nodes[3:], false)
+	a.emit(head, opReplace, 0, 0, 0)
+	a.chunk.code[h].b = int32(a.here())
+	a.emit(head, opEndLoop, 0, 0, 0)
+	a.compile(nodes[2])
+	a.emit(head, opPop, 0, 0, 0)
+	a.emit(head, opJump, loop, 0, 0)
+	a.patch(h)
+	a.emit(head, opEndLoop, 0, 0, 0)
+	a.patch(jend)
+	a.leave(head)
+}
+
+func (a *assembler) rangeForm(head ast.Node, nodes []ast.Node, tail bool) {
+	if len(nodes) < 3 {
+		a.fail(head, errors.New(`range takes three or more arguments`))
+		return
+	}
+	iname, ename, err := rangeNames(nodes[0])
+	if err != nil {
+		a.fail(head, err)
+		return
+	}
+	b := a.enter(head)
+	index := b.declare(iname)
+	eindex := -1
+	if ename != "" {
+		eindex = b.declare(ename)
+	}
+	a.compile(nodes[1])
+	a.emit(head, opRange, 0, index, eindex)
+	h := a.emit(head, opLoop, 0, 0, 0)
+	loop := a.emit(head, opNext, 0, index, eindex)
+	a.chunk.code[h].b = int32(loop)
+	a.seq(nodes[2:], false)
+	a.emit(head, opReplace, 0, 0, 0)
+	a.emit(head, opJump, loop, 0, 0)
+	a.patch(loop)
+	a.patch(h)
+	a.emit(head, opEndLoop, 0, 0, 0)
+	a.emit(head, opReplace, 0, 0, 0)
+	a.leave(head)
+}
@@ -0,0 +1,96 @@
+package twik_test
+
+import (
+	"context"
+	"errors"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/twik.v1"
+	"gopkg.in/twik.v1/ast"
+)
+
+func (S) TestBytecode(c *C) {
+	for _, test := range evalList {
+		fset := twik.NewFileSet()
+		node, err := twik.ParseString(fset, "", test.code)
+		c.Assert(err, IsNil)
+		bc, err := twik.CompileBytecode(fset, node)
+		c.Assert(err, IsNil, Commentf("Code: %s", test.code))
+		value, err := bc.Run(newScope(fset))
+		checkEval(c, test.code, test.value, value, err)
+	}
+}
+
+func (S) TestBytecodeBridge(c *C) {
+	fset := twik.NewFileSet()
+	node, err := twik.ParseString(fset, "", "(var x 1) (twice (set x (* x 3))) (var if +) (if x 1)")
+	c.Assert(err, IsNil)
+	bc, err := twik.CompileBytecode(fset, node)
+	c.Assert(err, IsNil)
+	scope := twik.NewScope(fset)
+	scope.Create("twice", func(scope *twik.Scope, args []ast.Node) (interface{}, error) {
+		scope.Eval(args[0])
+		return scope.Eval(args[0])
+	})
+	value, err := bc.Run(scope)
+	c.Assert(err, IsNil)
+	c.Assert(value, Equals, int64(10))
+}
+
+func (S) TestBytecodeRunContext(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, test := range contextList {
+		fset := twik.NewFileSet()
+		node, err := twik.ParseString(fset, "", test.code)
+		c.Assert(err, IsNil)
+		bc, err := twik.CompileBytecode(fset, node)
+		c.Assert(err, IsNil)
+		value, err := bc.RunContext(ctx, newScope(fset))
+		checkEval(c, test.code, test.value, value, err)
+		if err != nil {
+			c.Assert(errors.Is(err, context.Canceled), Equals, true)
+		}
+	}
+}
+
+const disassembly = `top level:
+0000 1:2    step
+0001 1:2    form      func 0003
+0002 1:2    func      0 double
+0003 1:27   pop
+0004 1:28   step
+0005 1:28   form      range 0021
+0006 1:28   enter     (i)
+0007 1:36   const     3
+0008 1:28   range     i
+0009 1:28   loop      0018 0010
+0010 1:28   next      i 0018
+0011 1:39   step
+0012 1:39   get       double
+0013 1:39   special   0016
+0014 1:46   get       i
+0015 1:39   call      1
+0016 1:28   replace
+0017 1:28   jump      0010
+0018 1:28   endloop
+0019 1:28   replace
+0020 1:28   leave
+
+func 0 double (n):
+0000 1:19   step
+0001 1:19   get       *
+0002 1:19   special   0006
+0003 1:21   const     2
+0004 1:23   get       n
+0005 1:19   tailcall  2
+`
+
+func (S) TestBytecodeDisassemble(c *C) {
+	fset := twik.NewFileSet()
+	node, err := twik.ParseString(fset, "", "(func double (n) (* 2 n)) (range i 3 (double i))")
+	c.Assert(err, IsNil)
+	bc, err := twik.CompileBytecode(fset, node)
+	c.Assert(err, IsNil)
+	c.Assert(bc.Disassemble(), Equals, disassembly)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"gopkg.in/twik.v1/ast"
+)
+
+// runFmt runs the fmt subcommand, which formats the given source files
+// in canonical form, or the standard input if there are none, and writes
+// the result to the standard output, or back to the files with -w.
+func runFmt(args []string) error {
+	flags := flag.NewFlagSet("fmt", flag.ContinueOnError)
+	write := flags.Bool("w", false, "write the result to the source files instead of the standard output")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: twik fmt [-w] [<source file>...]\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return nil
+		}
+		return fmt.Errorf("usage: twik fmt [-w] [<source file>...]")
+	}
+	if flags.NArg() == 0 {
+		if *write {
+			return fmt.Errorf("cannot use -w when formatting the standard input")
+		}
+		data, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		out, err := formatCode("<standard input>", data)
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(out)
+		return err
+	}
+	for _, name := range flags.Args() {
+		info, err := os.Stat(name)
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		out, err := formatCode(name, data)
+		if err != nil {
+			return err
+		}
+		if !*write {
+			_, err = os.Stdout.Write(out)
+		} else if !bytes.Equal(out, data) {
+			err = ioutil.WriteFile(name, out, info.Mode().Perm())
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// formatCode returns the code in data, read from the named file, in
+// canonical form.
+func formatCode(name string, data []byte) ([]byte, error) {
+	node, err := ast.ParseMode(fset, name, string(data), ast.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := ast.Fprint(&buf, fset, node); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/big"
 	"os"
 	"reflect"
 	"strings"
@@ -11,16 +12,32 @@ import (
 	"code.google.com/p/go.crypto/ssh/terminal"
 
 	"gopkg.in/twik.v1"
+	"gopkg.in/twik.v1/ast"
 )
 
+var fset = twik.NewFileSet()
+
 func main() {
 	err := run()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		fmt.Fprintf(os.Stderr, "error: %s", errorText(err, terminal.IsTerminal(2)))
 		os.Exit(1)
 	}
 }
 
+// errorText returns the text reporting err, including the offending source
+// line and the traceback when err holds such details.
+func errorText(err error, color bool) string {
+	switch e := err.(type) {
+	case *ast.Error:
+		return e.Error() + "\n" + fset.Snippet(e.Pos, e.End, color)
+	case *twik.Error:
+		traceback := strings.SplitN(e.Traceback(), "\n", 2)[1]
+		return e.Error() + "\n" + fset.Snippet(e.Pos, e.End, color) + traceback
+	}
+	return err.Error() + "\n"
+}
+
 func printfFn(args []interface{}) (interface{}, error) {
 	if len(args) > 0 {
 		if format, ok := args[0].(string); ok {
@@ -31,19 +48,19 @@ func printfFn(args []interface{}) (interface{}, error) {
 	return nil, fmt.Errorf("printf takes a format string")
 }
 
-func listFn(args []interface{}) (interface{}, error) {
-	return args, nil
-}
-
 func run() error {
-	fset := twik.NewFileSet()
 	scope := twik.NewScope(fset)
 	scope.Create("printf", printfFn)
-	scope.Create("list", listFn)
+	if err := scope.Use(twik.Lists, twik.Math); err != nil {
+		return err
+	}
 
+	if len(os.Args) > 1 && os.Args[1] == "fmt" {
+		return runFmt(os.Args[2:])
+	}
 	if len(os.Args) > 1 {
 		if strings.HasPrefix(os.Args[1], "-") {
-			return fmt.Errorf("usage: twik [<source file>]")
+			return fmt.Errorf("usage: twik [<source file>]\n       twik fmt [-w] [<source file>...]")
 		}
 		f, err := os.Open(os.Args[1])
 		if err != nil {
@@ -86,21 +103,21 @@ func run() error {
 		t.SetPrompt("> ")
 		node, err := twik.ParseString(fset, "", line)
 		if err != nil {
-			if strings.HasSuffix(err.Error(), "missing )") {
+			if strings.HasSuffix(err.Error(), "missing )") || strings.HasSuffix(err.Error(), "missing }") {
 				unclosed = line
 				t.SetPrompt(". ")
 				continue
 			}
-			fmt.Println(err)
+			fmt.Print(errorText(err, true))
 			continue
 		}
 		value, err := scope.Eval(node)
 		if err != nil {
-			fmt.Println(err)
+			fmt.Print(errorText(err, true))
 			continue
 		}
 		if value != nil {
-			if reflect.TypeOf(value).Kind() == reflect.Func {
+			if _, ok := value.(*twik.Function); ok || reflect.TypeOf(value).Kind() == reflect.Func {
 				fmt.Println("#func")
 			} else if v, ok := value.([]interface{}); ok {
 				if len(v) == 0 {
@@ -112,6 +129,12 @@ func run() error {
 					}
 					fmt.Println(")")
 				}
+			} else if v, ok := value.(*big.Int); ok {
+				fmt.Println(v)
+			} else if v, ok := value.(*big.Rat); ok {
+				fmt.Println(v)
+			} else if v, ok := value.(*twik.Decimal); ok {
+				fmt.Println(v.String() + "m")
 			} else {
 				fmt.Printf("%#v\n", value)
 			}
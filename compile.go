@@ -0,0 +1,1123 @@
+package twik
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"gopkg.in/twik.v1/ast"
+)
+
+// Program holds twik logic compiled into a tree of Go closures, so that
+// it may be run several times without walking the parsed tree again.
+//
+// Symbols defined by the program itself are resolved at compile time
+// into slots of lexical frames, while the remaining symbols are looked
+// up in the scope the program is run in. The standard special forms
+// (if, cond, switch, when, unless, and, or, var, set, do, let, let*,
+// func, macro, for, and range) are compiled directly, unless the scope
+// redefines them. Other special forms are
+// evaluated with a scope holding the currently visible local symbols,
+// and changes made to those symbols are copied back into the program.
+//
+// A Program is safe for concurrent use by multiple goroutines.
+type Program struct {
+	fset    *ast.FileSet
+	code    code
+	globals []string
+}
+
+// Compile compiles node, which was parsed into fset, into a Program.
+func Compile(fset *ast.FileSet, node ast.Node) (*Program, error) {
+	c := &compiler{fset: fset, symbols: newSymbols()}
+	root := c.block
+	var codes []code
+	var nodes []ast.Node
+	if r, ok := node.(*ast.Root); ok {
+		nodes = r.Nodes
+	} else {
+		nodes = []ast.Node{node}
+	}
+	for _, node := range nodes {
+		codes = append(codes, c.compile(node))
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+	c.resolve()
+	p := &Program{fset: fset, globals: c.names}
+	p.code = func(r *run, f *frame) (value interface{}, err error) {
+		f = newFrame(nil, root)
+		for i, code := range codes {
+			value, err = code(r, f)
+			if err != nil {
+				return nil, r.errorAt(nodes[i], err)
+			}
+		}
+		return value, nil
+	}
+	return p, nil
+}
+
+// Run runs the compiled program in the s scope and returns the resulting value.
+//
+// Symbols defined at the top level of the program are local to each run,
+// while symbols set by the program that were defined in s are changed in s.
+func (p *Program) Run(s *Scope) (value interface{}, err error) {
+	return p.RunContext(context.Background(), s)
+}
+
+// RunContext runs the compiled program in the s scope like Run, but
+// observes ctx the same way Scope.EvalContext does.
+//
+// The limits set in s are enforced as they are when evaluating in s.
+func (p *Program) RunContext(ctx context.Context, s *Scope) (value interface{}, err error) {
+	return p.code(newRun(ctx, p.fset, s, len(p.globals)), nil)
+}
+
+type code func(r *run, f *frame) (interface{}, error)
+
+// block holds the symbols defined in a lexical block at compile time.
+type block struct {
+	parent *block
+	names  []string
+}
+
+func (b *block) index(name string) int {
+	for i, n := range b.names {
+		if n == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (b *block) declare(name string) int {
+	if i := b.index(name); i >= 0 {
+		return i
+	}
+	b.names = append(b.names, name)
+	return len(b.names) - 1
+}
+
+type undefinedSlot struct{ _ byte }
+
+// undefined is held by frame slots of symbols not yet defined at run time.
+var undefined interface{} = &undefinedSlot{}
+
+// frame holds the values of symbols in a block at run time.
+type frame struct {
+	parent *frame
+	block  *block
+	slots  []interface{}
+}
+
+func newFrame(parent *frame, b *block) *frame {
+	slots := make([]interface{}, len(b.names))
+	for i := range slots {
+		slots[i] = undefined
+	}
+	return &frame{parent: parent, block: b, slots: slots}
+}
+
+// symref is a reference to a symbol from within a block. Since symbols
+// are defined at run time, the reference holds the slots of every
+// enclosing block that may define the symbol, from the innermost one
+// outwards, and falls back to the global symbol if all are undefined.
+// Symbols holding a selection such as "req.Name" also reference the
+// root symbol, which is used if the whole symbol is undefined.
+type symref struct {
+	name   string
+	block  *block
+	slots  []slotref
+	global int
+	root   *symref
+	path   []string
+}
+
+type slotref struct {
+	up    int
+	index int
+}
+
+func (ref *symref) resolve() {
+	up := 0
+	for b := ref.block; b != nil; b = b.parent {
+		if i := b.index(ref.name); i >= 0 {
+			ref.slots = append(ref.slots, slotref{up, i})
+		}
+		up++
+	}
+}
+
+func (ref *symref) slot(f *frame) (*frame, int) {
+	for _, s := range ref.slots {
+		sf := f
+		for i := 0; i < s.up; i++ {
+			sf = sf.parent
+		}
+		if sf.slots[s.index] != undefined {
+			return sf, s.index
+		}
+	}
+	return nil, 0
+}
+
+// run holds the state of a single run of a program.
+type run struct {
+	fset   *ast.FileSet
+	st     *state
+	scope  *Scope
+	values []interface{}
+	known  []bool
+}
+
+func newRun(ctx context.Context, fset *ast.FileSet, s *Scope, nglobals int) *run {
+	return &run{
+		fset:   fset,
+		st:     &state{ctx: ctx, limits: s.shared().limits, promote: s.shared().promote, running: true},
+		scope:  s,
+		values: make([]interface{}, nglobals),
+		known:  make([]bool, nglobals),
+	}
+}
+
+func (r *run) errorAt(node ast.Node, err error) error {
+	return errorAt(r.fset, node, err)
+}
+
+func (r *run) get(f *frame, ref *symref) (interface{}, error) {
+	if sf, i := ref.slot(f); sf != nil {
+		return sf.slots[i], nil
+	}
+	if !r.known[ref.global] {
+		value, err := r.scope.Get(ref.name)
+		if err != nil {
+			if ref.root != nil {
+				if rvalue, rerr := r.get(f, ref.root); rerr == nil {
+					return r.st.selectPath(rvalue, ref.path)
+				}
+			}
+			return nil, err
+		}
+		r.values[ref.global] = value
+		r.known[ref.global] = true
+	}
+	return r.values[ref.global], nil
+}
+
+func (r *run) set(f *frame, ref *symref, value interface{}) error {
+	if sf, i := ref.slot(f); sf != nil {
+		sf.slots[i] = value
+		return nil
+	}
+	if err := r.scope.Set(ref.name, value); err != nil {
+		if ref.root != nil {
+			if rvalue, rerr := r.get(f, ref.root); rerr == nil {
+				return setPath(rvalue, ref.path, value)
+			}
+		}
+		return err
+	}
+	r.values[ref.global] = value
+	r.known[ref.global] = true
+	return nil
+}
+
+func (r *run) call(f *frame, fn interface{}, nodes []ast.Node, args []code) (value interface{}, err error) {
+	if _, ok := fn.(func(*Scope, []ast.Node) (interface{}, error)); ok {
+		return r.bridge(f, fn, nodes)
+	}
+	if !callable(fn) {
+		return nil, fmt.Errorf("cannot use %#v as a function", fn)
+	}
+	vargs := make([]interface{}, len(args))
+	for i, arg := range args {
+		vargs[i], err = arg(r, f)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return r.st.apply(fn, vargs)
+}
+
+// bridge calls fn with the unevaluated nodes in a scope holding the
+// symbols currently defined in f and its parents, and copies any
+// changes made to them back into the respective frames.
+func (r *run) bridge(f *frame, fn interface{}, nodes []ast.Node) (value interface{}, err error) {
+	var frames []*frame
+	for sf := f; sf != nil; sf = sf.parent {
+		frames = append(frames, sf)
+	}
+	scopes := make([]*Scope, len(frames))
+	scope := &Scope{parent: r.scope, fset: r.fset, state: r.st}
+	for i := len(frames) - 1; i >= 0; i-- {
+		scope = scope.Branch()
+		scope.vars = make(map[string]interface{})
+		for j, name := range frames[i].block.names {
+			if v := frames[i].slots[j]; v != undefined {
+				scope.vars[name] = v
+			}
+		}
+		scopes[i] = scope
+	}
+	value, err = scope.call(fn, nodes)
+	for i, sf := range frames {
+		for j, name := range sf.block.names {
+			if v, ok := scopes[i].vars[name]; ok {
+				sf.slots[j] = v
+			}
+		}
+	}
+	for i := range r.known {
+		r.known[i] = false
+	}
+	return value, err
+}
+
+// sameFunc returns whether value is the special form fn.
+func sameFunc(value interface{}, fn func(*Scope, []ast.Node) (interface{}, error)) bool {
+	vfn, ok := value.(func(*Scope, []ast.Node) (interface{}, error))
+	return ok && reflect.ValueOf(vfn).Pointer() == reflect.ValueOf(fn).Pointer()
+}
+
+// symbols holds the blocks and the symbol references of logic being compiled.
+type symbols struct {
+	block   *block
+	refs    []*symref
+	globals map[string]int
+	names   []string
+}
+
+func newSymbols() symbols {
+	return symbols{block: &block{}, globals: make(map[string]int)}
+}
+
+func (c *symbols) ref(name string) *symref {
+	global, ok := c.globals[name]
+	if !ok {
+		global = len(c.names)
+		c.globals[name] = global
+		c.names = append(c.names, name)
+	}
+	ref := &symref{name: name, block: c.block, global: global}
+	c.refs = append(c.refs, ref)
+	if root, path := splitPath(name); path != nil {
+		ref.root, ref.path = c.ref(root), path
+	}
+	return ref
+}
+
+// resolve resolves all symbol references once every block is known.
+func (c *symbols) resolve() {
+	for _, ref := range c.refs {
+		ref.resolve()
+	}
+}
+
+func (c *symbols) enter() *block {
+	c.block = &block{parent: c.block}
+	return c.block
+}
+
+func (c *symbols) leave() {
+	c.block = c.block.parent
+}
+
+type compiler struct {
+	symbols
+	fset *ast.FileSet
+	err  error
+}
+
+func (c *compiler) compile(node ast.Node) code {
+	switch node := node.(type) {
+	case *ast.Symbol:
+		if isKeyword(node.Name) {
+			return constCode(Keyword(node.Name[1:]))
+		}
+		ref := c.ref(node.Name)
+		return func(r *run, f *frame) (interface{}, error) {
+			value, err := r.get(f, ref)
+			if err != nil {
+				return nil, r.errorAt(node, err)
+			}
+			return value, nil
+		}
+	case *ast.Int, *ast.Ratio, *ast.Decimal:
+		return constCode(numberOf(node))
+	case *ast.Float:
+		return constCode(node.Value)
+	case *ast.String:
+		return constCode(node.Value)
+	case *ast.List:
+		if len(node.Nodes) == 0 {
+			return constCode(emptyList)
+		}
+		return c.list(node)
+	case *ast.Quote:
+		return c.compile(node.List())
+	case *ast.Map:
+		codes := c.compileAll(node.Nodes)
+		return func(r *run, f *frame) (interface{}, error) {
+			m := make(map[string]interface{}, len(codes)/2)
+			for i := 0; i+1 < len(codes); i += 2 {
+				key, err := codes[i](r, f)
+				if err != nil {
+					return nil, err
+				}
+				skey, ok := key.(string)
+				if !ok {
+					return nil, r.errorAt(node.Nodes[i], fmt.Errorf("map key must be a string: %#v", key))
+				}
+				value, err := codes[i+1](r, f)
+				if err != nil {
+					return nil, err
+				}
+				m[skey] = value
+			}
+			return m, nil
+		}
+	}
+	if c.err == nil {
+		c.err = fmt.Errorf("support for %#v not yet implemeted", node)
+	}
+	return nil
+}
+
+func constCode(value interface{}) code {
+	return func(r *run, f *frame) (interface{}, error) { return value, nil }
+}
+
+func errorCode(err error) code {
+	return func(r *run, f *frame) (interface{}, error) { return nil, err }
+}
+
+func (c *compiler) compileAll(nodes []ast.Node) []code {
+	codes := make([]code, len(nodes))
+	for i, node := range nodes {
+		codes[i] = c.compile(node)
+	}
+	return codes
+}
+
+func (c *compiler) list(list *ast.List) code {
+	head, nodes := list.Nodes[0], list.Nodes[1:]
+	if symbol, ok := head.(*ast.Symbol); ok {
+		var fn func(*Scope, []ast.Node) (interface{}, error)
+		var form code
+		switch symbol.Name {
+		case "if":
+			fn, form = ifFn, c.ifForm(nodes)
+		case "cond", "switch", "when", "unless":
+			fn, form = conditionals[symbol.Name], c.conditionalForm(symbol.Name, nodes)
+		case "and":
+			fn, form = andFn, c.andForm(nodes)
+		case "or":
+			fn, form = orFn, c.orForm(nodes)
+		case "var":
+			fn, form = varFn, c.varForm(nodes)
+		case "set":
+			fn, form = setFn, c.setForm(nodes)
+		case "do":
+			fn, form = doFn, c.doForm(nodes)
+		case "let":
+			fn, form = letFn, c.letForm("let", nodes)
+		case "let*":
+			fn, form = letStarFn, c.letForm("let*", nodes)
+		case "func":
+			fn, form = funcFn, c.funcForm(nodes)
+		case "for":
+			fn, form = forFn, c.forForm(nodes)
+		case "range":
+			fn, form = rangeFn, c.rangeForm(nodes)
+		case "macro":
+			fn, form = macroFn, c.macroForm(nodes)
+		}
+		if form != nil {
+			ref := c.ref(symbol.Name)
+			return func(r *run, f *frame) (value interface{}, err error) {
+				if err := r.st.step(); err != nil {
+					return nil, r.errorAt(head, err)
+				}
+				v, err := r.get(f, ref)
+				if err != nil {
+					return nil, r.errorAt(head, err)
+				}
+				if sameFunc(v, fn) {
+					value, err = form(r, f)
+				} else {
+					value, err = r.bridge(f, v, nodes)
+				}
+				if err != nil {
+					return nil, r.errorAt(head, err)
+				}
+				return value, nil
+			}
+		}
+	}
+	hcode := c.compile(head)
+	args := c.compileAll(nodes)
+	return func(r *run, f *frame) (interface{}, error) {
+		if err := r.st.step(); err != nil {
+			return nil, r.errorAt(head, err)
+		}
+		fn, err := hcode(r, f)
+		if err != nil {
+			return nil, r.errorAt(head, err)
+		}
+		value, err := r.call(f, fn, nodes, args)
+		if err != nil {
+			return nil, r.errorAt(head, err)
+		}
+		return value, nil
+	}
+}
+
+func (c *compiler) ifForm(nodes []ast.Node) code {
+	if len(nodes) < 2 || len(nodes) > 3 {
+		return errorCode(errors.New(`function "if" takes two or three arguments`))
+	}
+	codes := c.compileAll(nodes)
+	return func(r *run, f *frame) (interface{}, error) {
+		value, err := codes[0](r, f)
+		if err != nil {
+			return nil, err
+		}
+		if value == false {
+			if len(codes) == 3 {
+				return codes[2](r, f)
+			}
+			return false, nil
+		}
+		return codes[1](r, f)
+	}
+}
+
+// conditionalForm compiles the conditional special form with the given name.
+func (c *compiler) conditionalForm(form string, nodes []ast.Node) code {
+	cond, err := parseConditional(form, nodes)
+	if err != nil {
+		return errorCode(err)
+	}
+	tc := c.conditional(cond, func(body []ast.Node) tailcode {
+		return notTail(c.doForm(body))
+	})
+	return func(r *run, f *frame) (interface{}, error) {
+		value, _, err := tc(r, f)
+		return value, err
+	}
+}
+
+// conditional compiles the parsed conditional special form cond, using
+// body to compile the body sequences of its clauses.
+func (c *compiler) conditional(cond *conditional, body func([]ast.Node) tailcode) tailcode {
+	var switchValue code
+	if cond.value != nil {
+		switchValue = c.compile(cond.value)
+	}
+	tests := make([]code, len(cond.clauses))
+	bodies := make([]tailcode, len(cond.clauses))
+	for i, clause := range cond.clauses {
+		if clause.test != nil {
+			tests[i] = c.compile(clause.test)
+		}
+		if clause.body != nil {
+			bodies[i] = body(clause.body)
+		}
+	}
+	return func(r *run, f *frame) (value interface{}, next *tailCall, err error) {
+		var sv interface{}
+		if switchValue != nil {
+			if sv, err = switchValue(r, f); err != nil {
+				return nil, nil, err
+			}
+		}
+		for i := range cond.clauses {
+			value = sv
+			if tests[i] != nil {
+				if value, err = tests[i](r, f); err != nil {
+					return nil, nil, err
+				}
+			}
+			if cond.clauses[i].selects(value) {
+				if bodies[i] == nil {
+					return value, nil, nil
+				}
+				return bodies[i](r, f)
+			}
+		}
+		return false, nil, nil
+	}
+}
+
+func (c *compiler) andForm(nodes []ast.Node) code {
+	codes := c.compileAll(nodes)
+	return func(r *run, f *frame) (value interface{}, err error) {
+		if len(codes) == 0 {
+			return true, nil
+		}
+		for _, code := range codes {
+			value, err = code(r, f)
+			if err != nil {
+				return nil, err
+			}
+			if value == false {
+				return false, nil
+			}
+		}
+		return value, nil
+	}
+}
+
+func (c *compiler) orForm(nodes []ast.Node) code {
+	codes := c.compileAll(nodes)
+	return func(r *run, f *frame) (value interface{}, err error) {
+		if len(codes) == 0 {
+			return false, nil
+		}
+		for _, code := range codes {
+			value, err = code(r, f)
+			if err != nil {
+				return nil, err
+			}
+			if value != false {
+				return value, nil
+			}
+		}
+		return value, nil
+	}
+}
+
+func (c *compiler) varForm(nodes []ast.Node) code {
+	if len(nodes) == 0 || len(nodes) > 2 {
+		return errorCode(errors.New("var takes one or two arguments"))
+	}
+	symbol, ok := nodes[0].(*ast.Symbol)
+	if !ok {
+		return errorCode(errors.New("var takes a symbol as first argument"))
+	}
+	if isKeyword(symbol.Name) {
+		return errorCode(fmt.Errorf("cannot define keyword symbol: %s", symbol.Name))
+	}
+	vcode := constCode(nil)
+	if len(nodes) == 2 {
+		vcode = c.compile(nodes[1])
+	}
+	index := c.block.declare(symbol.Name)
+	return func(r *run, f *frame) (interface{}, error) {
+		value, err := vcode(r, f)
+		if err != nil {
+			return nil, err
+		}
+		if f.slots[index] != undefined {
+			return nil, fmt.Errorf("symbol already defined in current scope: %s", symbol.Name)
+		}
+		f.slots[index] = value
+		return nil, nil
+	}
+}
+
+func (c *compiler) setForm(nodes []ast.Node) code {
+	if len(nodes) != 2 {
+		return errorCode(errors.New(`function "set" takes two arguments`))
+	}
+	symbol, ok := nodes[0].(*ast.Symbol)
+	if !ok {
+		return errorCode(errors.New(`function "set" takes a symbol as first argument`))
+	}
+	ref := c.ref(symbol.Name)
+	vcode := c.compile(nodes[1])
+	return func(r *run, f *frame) (interface{}, error) {
+		value, err := vcode(r, f)
+		if err != nil {
+			return nil, err
+		}
+		return nil, r.set(f, ref, value)
+	}
+}
+
+func (c *compiler) doForm(nodes []ast.Node) code {
+	b := c.enter()
+	codes := c.compileAll(nodes)
+	c.leave()
+	return func(r *run, f *frame) (value interface{}, err error) {
+		f = newFrame(f, b)
+		for _, code := range codes {
+			value, err = code(r, f)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return value, nil
+	}
+}
+
+// letForm compiles the let special form, or the let* special form if
+// form is "let*".
+func (c *compiler) letForm(form string, nodes []ast.Node) code {
+	groups, body, err := parseLet(form, nodes)
+	if err != nil {
+		return errorCode(err)
+	}
+	tc := c.let(groups, body, false)
+	return func(r *run, f *frame) (interface{}, error) {
+		value, _, err := tc(r, f)
+		return value, err
+	}
+}
+
+// let compiles the parsed groups of bindings of let or let*, entering a
+// block for each group, and the body with its last node in tail position
+// if tail is true.
+func (c *compiler) let(groups [][]binding, body []ast.Node, tail bool) tailcode {
+	blocks := make([]*block, len(groups))
+	values := make([][]code, len(groups))
+	slots := make([][][]int, len(groups))
+	for i, group := range groups {
+		values[i] = make([]code, len(group))
+		for j := range group {
+			values[i][j] = c.compile(group[j].value)
+		}
+		blocks[i] = c.enter()
+		slots[i] = make([][]int, len(group))
+		for j := range group {
+			for _, name := range group[j].names {
+				slots[i][j] = append(slots[i][j], blocks[i].declare(name))
+			}
+		}
+	}
+	codes := c.compileAll(body[:len(body)-1])
+	var last tailcode
+	if tail {
+		last = c.tail(body[len(body)-1])
+	} else {
+		last = notTail(c.compile(body[len(body)-1]))
+	}
+	for range groups {
+		c.leave()
+	}
+	return func(r *run, f *frame) (interface{}, *tailCall, error) {
+		for i, group := range groups {
+			bound := make([][]interface{}, len(group))
+			for j := range group {
+				value, err := values[i][j](r, f)
+				if err != nil {
+					return nil, nil, err
+				}
+				if bound[j], err = group[j].values(value); err != nil {
+					return nil, nil, r.errorAt(group[j].target, err)
+				}
+			}
+			f = newFrame(f, blocks[i])
+			for j := range group {
+				for k, index := range slots[i][j] {
+					f.slots[index] = bound[j][k]
+				}
+			}
+		}
+		for _, code := range codes {
+			if _, err := code(r, f); err != nil {
+				return nil, nil, err
+			}
+		}
+		return last(r, f)
+	}
+}
+
+func (c *compiler) funcForm(nodes []ast.Node) code {
+	if len(nodes) < 2 {
+		return errorCode(errors.New(`func takes three or more arguments`))
+	}
+	i := 0
+	var name string
+	if symbol, ok := nodes[0].(*ast.Symbol); ok {
+		name = symbol.Name
+		i++
+	}
+	list, ok := nodes[i].(*ast.List)
+	if !ok {
+		return errorCode(errors.New(`func takes a list of parameters`))
+	}
+	sig, err := parseSignature("func", list)
+	if err != nil {
+		return errorCode(err)
+	}
+	if len(nodes[i+1:]) == 0 {
+		return errorCode(fmt.Errorf("func takes a body sequence"))
+	}
+	index := -1
+	if name != "" {
+		index = c.block.declare(name)
+	}
+	closure := c.closure(name, sig, nodes[i+1:])
+	return func(r *run, f *frame) (interface{}, error) {
+		fn := closure(r, f)
+		if index >= 0 {
+			if f.slots[index] != undefined {
+				return nil, fmt.Errorf("symbol already defined in current scope: %s", name)
+			}
+			f.slots[index] = fn
+		}
+		return fn, nil
+	}
+}
+
+// closure compiles a function defined with func with the given name,
+// signature, and body, and returns code that makes the function with f
+// as the parent frame of its own.
+func (c *compiler) closure(name string, sig *signature, body []ast.Node) func(r *run, f *frame) *Function {
+	b := c.enter()
+	slots := make([]int, len(sig.names))
+	for i, name := range sig.names {
+		slots[i] = b.declare(name)
+	}
+	defaults := make([]code, len(sig.defaults))
+	for i, def := range sig.defaults {
+		if def != nil {
+			defaults[i] = c.compile(def)
+		}
+	}
+	last := len(body) - 1
+	codes := c.compileAll(body[:last])
+	tail := c.tail(body[last])
+	c.leave()
+	return func(r *run, f *frame) *Function {
+		return r.st.function(name, sig, func(args []interface{}) (value interface{}, next *tailCall, err error) {
+			f := newFrame(f, b)
+			for i, arg := range args {
+				if arg == undefined {
+					arg = nil
+					if defaults[i] != nil {
+						if arg, err = defaults[i](r, f); err != nil {
+							return nil, nil, err
+						}
+					}
+				}
+				f.slots[slots[i]] = arg
+			}
+			for _, code := range codes {
+				if _, err = code(r, f); err != nil {
+					return nil, nil, err
+				}
+			}
+			return tail(r, f)
+		})
+	}
+}
+
+func (c *compiler) macroForm(nodes []ast.Node) code {
+	name, sig, body, err := macroArgs(nodes)
+	if err != nil {
+		return errorCode(err)
+	}
+	index := c.block.declare(name.Name)
+	closure := c.closure(name.Name, sig, body)
+	return func(r *run, f *frame) (interface{}, error) {
+		if f.slots[index] != undefined {
+			return nil, fmt.Errorf("symbol already defined in current scope: %s", name.Name)
+		}
+		fn := macro(name, closure(r, f))
+		f.slots[index] = fn
+		return fn, nil
+	}
+}
+
+// tailcode is the code of a node in tail position of a function body.
+// See Scope.tail for details.
+type tailcode func(r *run, f *frame) (interface{}, *tailCall, error)
+
+// tail compiles node in tail position of a function body.
+func (c *compiler) tail(node ast.Node) tailcode {
+	list, ok := node.(*ast.List)
+	if !ok || len(list.Nodes) == 0 {
+		return notTail(c.compile(node))
+	}
+	head, nodes := list.Nodes[0], list.Nodes[1:]
+	if symbol, ok := head.(*ast.Symbol); ok {
+		var fn func(*Scope, []ast.Node) (interface{}, error)
+		var form tailcode
+		switch symbol.Name {
+		case "if":
+			if len(nodes) == 2 || len(nodes) == 3 {
+				fn, form = ifFn, c.tailIf(nodes)
+			}
+		case "cond", "switch", "when", "unless":
+			if cond, err := parseConditional(symbol.Name, nodes); err == nil {
+				fn, form = conditionals[symbol.Name], c.conditional(cond, c.tailDo)
+			}
+		case "do":
+			if len(nodes) > 0 {
+				fn, form = doFn, c.tailDo(nodes)
+			}
+		case "let":
+			if groups, body, err := parseLet("let", nodes); err == nil {
+				fn, form = letFn, c.let(groups, body, true)
+			}
+		case "let*":
+			if groups, body, err := parseLet("let*", nodes); err == nil {
+				fn, form = letStarFn, c.let(groups, body, true)
+			}
+		case "and":
+			if len(nodes) > 0 {
+				fn, form = andFn, c.tailLogic(nodes, false)
+			}
+		case "or":
+			if len(nodes) > 0 {
+				fn, form = orFn, c.tailLogic(nodes, true)
+			}
+		case "var", "set", "func", "for", "range", "macro":
+			return notTail(c.compile(node))
+		}
+		if form != nil {
+			ref := c.ref(symbol.Name)
+			return func(r *run, f *frame) (value interface{}, next *tailCall, err error) {
+				if err := r.st.step(); err != nil {
+					return nil, nil, r.errorAt(head, err)
+				}
+				v, err := r.get(f, ref)
+				if err != nil {
+					return nil, nil, r.errorAt(head, err)
+				}
+				if sameFunc(v, fn) {
+					value, next, err = form(r, f)
+				} else {
+					value, err = r.bridge(f, v, nodes)
+				}
+				if err != nil {
+					return nil, nil, r.errorAt(head, err)
+				}
+				return value, next, nil
+			}
+		}
+	}
+	hcode := c.compile(head)
+	args := c.compileAll(nodes)
+	return func(r *run, f *frame) (interface{}, *tailCall, error) {
+		if err := r.st.step(); err != nil {
+			return nil, nil, r.errorAt(head, err)
+		}
+		fn, err := hcode(r, f)
+		if err != nil {
+			return nil, nil, r.errorAt(head, err)
+		}
+		if fn, ok := fn.(*Function); ok {
+			vargs := make([]interface{}, len(args))
+			for i, arg := range args {
+				if vargs[i], err = arg(r, f); err != nil {
+					return nil, nil, r.errorAt(head, err)
+				}
+			}
+			return nil, &tailCall{fn, vargs, r.fset, head}, nil
+		}
+		value, err := r.call(f, fn, nodes, args)
+		if err != nil {
+			return nil, nil, r.errorAt(head, err)
+		}
+		return value, nil, nil
+	}
+}
+
+func notTail(code code) tailcode {
+	return func(r *run, f *frame) (interface{}, *tailCall, error) {
+		value, err := code(r, f)
+		return value, nil, err
+	}
+}
+
+func (c *compiler) tailIf(nodes []ast.Node) tailcode {
+	cond, then := c.compile(nodes[0]), c.tail(nodes[1])
+	var otherwise tailcode
+	if len(nodes) == 3 {
+		otherwise = c.tail(nodes[2])
+	}
+	return func(r *run, f *frame) (interface{}, *tailCall, error) {
+		value, err := cond(r, f)
+		if err != nil {
+			return nil, nil, err
+		}
+		if value == false {
+			if otherwise != nil {
+				return otherwise(r, f)
+			}
+			return false, nil, nil
+		}
+		return then(r, f)
+	}
+}
+
+func (c *compiler) tailDo(nodes []ast.Node) tailcode {
+	b := c.enter()
+	codes := c.compileAll(nodes[:len(nodes)-1])
+	last := c.tail(nodes[len(nodes)-1])
+	c.leave()
+	return func(r *run, f *frame) (interface{}, *tailCall, error) {
+		f = newFrame(f, b)
+		for _, code := range codes {
+			if _, err := code(r, f); err != nil {
+				return nil, nil, err
+			}
+		}
+		return last(r, f)
+	}
+}
+
+// tailLogic compiles the and special form, or the or special form if
+// or is true, in tail position.
+func (c *compiler) tailLogic(nodes []ast.Node, or bool) tailcode {
+	codes := c.compileAll(nodes[:len(nodes)-1])
+	last := c.tail(nodes[len(nodes)-1])
+	return func(r *run, f *frame) (interface{}, *tailCall, error) {
+		for _, code := range codes {
+			value, err := code(r, f)
+			if err != nil {
+				return nil, nil, err
+			}
+			if (value != false) == or {
+				return value, nil, nil
+			}
+		}
+		return last(r, f)
+	}
+}
+
+func (c *compiler) forForm(nodes []ast.Node) code {
+	if len(nodes) < 4 {
+		return errorCode(errors.New(`for takes four or more arguments`))
+	}
+	b := c.enter()
+	init, test, step := c.compile(nodes[0]), c.compile(nodes[1]), c.compile(nodes[2])
+	body := c.compileAll(nodes[3:])
+	c.leave()
+	return func(r *run, f *frame) (value interface{}, err error) {
+		f = newFrame(f, b)
+		if _, err = init(r, f); err != nil {
+			return nil, err
+		}
+		for {
+			if err := r.st.checkContext(); err != nil {
+				return nil, err
+			}
+			more, err := test(r, f)
+			if err != nil {
+				return nil, err
+			}
+			if more == false {
+				return value, nil
+			}
+			for _, code := range body {
+				value, err = code(r, f)
+				if err != nil {
+					var exit bool
+					if exit, value, err = loopExit(err); exit {
+						return value, err
+					}
+					break
+				}
+			}
+			if _, err = step(r, f); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+func (c *compiler) rangeForm(nodes []ast.Node) code {
+	if len(nodes) < 3 {
+		return errorCode(errors.New(`range takes three or more arguments`))
+	}
+	iname, ename, err := rangeNames(nodes[0])
+	if err != nil {
+		return errorCode(err)
+	}
+	b := c.enter()
+	icode := c.compile(nodes[1])
+	body := c.compileAll(nodes[2:])
+	index := b.declare(iname)
+	eindex := -1
+	if ename != "" {
+		eindex = b.declare(ename)
+	}
+	c.leave()
+	return func(r *run, f *frame) (value interface{}, err error) {
+		f = newFrame(f, b)
+		value, err = icode(r, f)
+		if err != nil {
+			return nil, err
+		}
+		if n, ok := value.(int64); ok {
+			f.slots[index] = int64(0)
+			for i := int64(0); i < n; i++ {
+				if err := r.st.checkContext(); err != nil {
+					return nil, err
+				}
+				f.slots[index] = i
+				for _, code := range body {
+					value, err = code(r, f)
+					if err != nil {
+						var exit bool
+						if exit, value, err = loopExit(err); exit {
+							return value, err
+						}
+						break
+					}
+				}
+			}
+			return value, nil
+		}
+		if m, ok := value.(map[string]interface{}); ok {
+			f.slots[index] = ""
+			if eindex >= 0 {
+				f.slots[eindex] = nil
+			}
+			for _, k := range sortedKeys(m) {
+				if err := r.st.checkContext(); err != nil {
+					return nil, err
+				}
+				f.slots[index] = k
+				if eindex >= 0 {
+					f.slots[eindex] = m[k]
+				}
+				for _, code := range body {
+					value, err = code(r, f)
+					if err != nil {
+						var exit bool
+						if exit, value, err = loopExit(err); exit {
+							return value, err
+						}
+						break
+					}
+				}
+			}
+			return value, nil
+		}
+		if list, ok := value.([]interface{}); ok {
+			f.slots[index] = int64(0)
+			if eindex >= 0 {
+				f.slots[eindex] = nil
+			}
+			for i, e := range list {
+				if err := r.st.checkContext(); err != nil {
+					return nil, err
+				}
+				f.slots[index] = int64(i)
+				if eindex >= 0 {
+					f.slots[eindex] = e
+				}
+				for _, code := range body {
+					value, err = code(r, f)
+					if err != nil {
+						var exit bool
+						if exit, value, err = loopExit(err); exit {
+							return value, err
+						}
+						break
+					}
+				}
+			}
+			return value, nil
+		}
+		return nil, errors.New(`range takes an integer, a list, or a map as second argument`)
+	}
+}
@@ -0,0 +1,92 @@
+package twik_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/twik.v1"
+	"gopkg.in/twik.v1/ast"
+)
+
+func (S) TestCompile(c *C) {
+	for _, test := range evalList {
+		fset := twik.NewFileSet()
+		node, err := twik.ParseString(fset, "", test.code)
+		c.Assert(err, IsNil)
+		prog, err := twik.Compile(fset, node)
+		c.Assert(err, IsNil, Commentf("Code: %s", test.code))
+		value, err := prog.Run(newScope(fset))
+		checkEval(c, test.code, test.value, value, err)
+	}
+}
+
+func (S) TestCompileRunTwice(c *C) {
+	fset := twik.NewFileSet()
+	node, err := twik.ParseString(fset, "", "(var x 1) (set y (+ y x)) y")
+	c.Assert(err, IsNil)
+	prog, err := twik.Compile(fset, node)
+	c.Assert(err, IsNil)
+	scope := twik.NewScope(fset)
+	scope.Create("y", int64(10))
+	for i := int64(1); i <= 2; i++ {
+		value, err := prog.Run(scope)
+		c.Assert(err, IsNil)
+		c.Assert(value, Equals, 10+i)
+	}
+}
+
+func (S) TestCompileRunConcurrently(c *C) {
+	fset := twik.NewFileSet()
+	node, err := twik.ParseString(fset, "", "(func fib (n) (if (== n 0) 0 (if (== n 1) 1 (+ (fib (- n 1)) (fib (- n 2)))))) (fib n)")
+	c.Assert(err, IsNil)
+	prog, err := twik.Compile(fset, node)
+	c.Assert(err, IsNil)
+	var wg sync.WaitGroup
+	values := make([]interface{}, 10)
+	for i := range values {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			scope := twik.NewScope(fset)
+			scope.Create("n", int64(i))
+			values[i], _ = prog.Run(scope)
+		}(i)
+	}
+	wg.Wait()
+	c.Assert(values, DeepEquals, []interface{}{int64(0), int64(1), int64(1), int64(2), int64(3), int64(5), int64(8), int64(13), int64(21), int64(34)})
+}
+
+func (S) TestCompileBridge(c *C) {
+	fset := twik.NewFileSet()
+	node, err := twik.ParseString(fset, "", "(var x 1) (twice (set x (* x 3))) x")
+	c.Assert(err, IsNil)
+	prog, err := twik.Compile(fset, node)
+	c.Assert(err, IsNil)
+	scope := twik.NewScope(fset)
+	scope.Create("twice", func(scope *twik.Scope, args []ast.Node) (interface{}, error) {
+		scope.Eval(args[0])
+		return scope.Eval(args[0])
+	})
+	value, err := prog.Run(scope)
+	c.Assert(err, IsNil)
+	c.Assert(value, Equals, int64(9))
+}
+
+func (S) TestCompileRunContext(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, test := range contextList {
+		fset := twik.NewFileSet()
+		node, err := twik.ParseString(fset, "", test.code)
+		c.Assert(err, IsNil)
+		prog, err := twik.Compile(fset, node)
+		c.Assert(err, IsNil)
+		value, err := prog.RunContext(ctx, newScope(fset))
+		checkEval(c, test.code, test.value, value, err)
+		if err != nil {
+			c.Assert(errors.Is(err, context.Canceled), Equals, true)
+		}
+	}
+}
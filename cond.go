@@ -0,0 +1,236 @@
+package twik
+
+import (
+	"errors"
+	"fmt"
+
+	"gopkg.in/twik.v1/ast"
+)
+
+// conditional is the parsed form of the cond, switch, when, and unless
+// special forms. They select the body sequence of a clause, which is
+// evaluated as with do, and result in false when no clause is selected,
+// like if without an else argument.
+type conditional struct {
+	// value holds the expression compared by switch with the constants
+	// of its case clauses, or nil for the other forms.
+	value   ast.Node
+	clauses []clause
+}
+
+// clause is a branch of a conditional special form.
+type clause struct {
+	// test holds the condition of the clause, which is selected if the
+	// condition isn't false, or if it is false when not is true. Case
+	// clauses of switch have no condition, and are selected if any of
+	// the cases equals the switch value instead.
+	test  ast.Node
+	not   bool
+	cases []interface{}
+	// otherwise is true for else clauses, which are always selected.
+	otherwise bool
+	// body holds the body sequence of the clause, or nil if the clause
+	// results in the value of its condition.
+	body []ast.Node
+}
+
+// parseConditional parses the arguments of the conditional special form
+// with the given name:
+//
+//	(cond (condition body...)... (else body...))
+//	(switch value (case constants body...)... (else body...))
+//	(when condition body...)
+//	(unless condition body...)
+//
+// The else clauses are optional, the body of cond clauses may be left
+// out to result in the value of the condition, and the constants of a
+// case clause are either a single constant or a list of them.
+func parseConditional(form string, args []ast.Node) (*conditional, error) {
+	switch form {
+	case "when", "unless":
+		if len(args) < 2 {
+			return nil, fmt.Errorf("%s takes a condition and a body sequence", form)
+		}
+		return &conditional{clauses: []clause{{test: args[0], not: form == "unless", body: args[1:]}}}, nil
+	case "switch":
+		if len(args) == 0 {
+			return nil, errSwitch
+		}
+		cond := &conditional{value: args[0]}
+		for i, arg := range args[1:] {
+			list, ok := arg.(*ast.List)
+			switch {
+			case !ok || len(list.Nodes) < 2:
+				return nil, errSwitch
+			case isSymbol(list.Nodes[0], "else"):
+				if i+2 < len(args) {
+					return nil, errSwitch
+				}
+				cond.clauses = append(cond.clauses, clause{otherwise: true, body: list.Nodes[1:]})
+			case isSymbol(list.Nodes[0], "case") && len(list.Nodes) > 2:
+				cases, err := constants(list.Nodes[1])
+				if err != nil {
+					return nil, err
+				}
+				cond.clauses = append(cond.clauses, clause{cases: cases, body: list.Nodes[2:]})
+			default:
+				return nil, errSwitch
+			}
+		}
+		return cond, nil
+	}
+	cond := &conditional{}
+	for i, arg := range args {
+		list, ok := arg.(*ast.List)
+		if !ok || len(list.Nodes) == 0 {
+			return nil, errors.New("cond takes clause lists")
+		}
+		if !isSymbol(list.Nodes[0], "else") {
+			c := clause{test: list.Nodes[0]}
+			if len(list.Nodes) > 1 {
+				c.body = list.Nodes[1:]
+			}
+			cond.clauses = append(cond.clauses, c)
+			continue
+		}
+		if i+1 < len(args) {
+			return nil, errors.New("cond takes else as the last clause")
+		}
+		if len(list.Nodes) == 1 {
+			return nil, errors.New("cond takes a body sequence in the else clause")
+		}
+		cond.clauses = append(cond.clauses, clause{otherwise: true, body: list.Nodes[1:]})
+	}
+	return cond, nil
+}
+
+var errSwitch = errors.New("switch takes a value, (case constants body...) clauses, and an optional (else body...) clause")
+
+// constants returns the values of the constants of a case clause, which
+// are either in node or in the list held by node.
+func constants(node ast.Node) ([]interface{}, error) {
+	nodes := []ast.Node{node}
+	if list, ok := node.(*ast.List); ok {
+		nodes = list.Nodes
+	}
+	values := make([]interface{}, len(nodes))
+	for i, n := range nodes {
+		value, ok := constant(n)
+		if !ok {
+			return nil, errors.New("switch cases must be constants")
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+// constant returns the value of node if it is a literal number,
+// string, keyword, or one of the symbols true, false, and nil.
+func constant(node ast.Node) (value interface{}, ok bool) {
+	switch node := node.(type) {
+	case *ast.Int, *ast.Ratio, *ast.Decimal:
+		return numberOf(node), true
+	case *ast.Float:
+		return node.Value, true
+	case *ast.String:
+		return node.Value, true
+	case *ast.Symbol:
+		switch {
+		case node.Name == "true":
+			return true, true
+		case node.Name == "false":
+			return false, true
+		case node.Name == "nil":
+			return nil, true
+		case isKeyword(node.Name):
+			return Keyword(node.Name[1:]), true
+		}
+	}
+	return nil, false
+}
+
+// isSymbol returns whether node is the symbol with the given name.
+func isSymbol(node ast.Node, name string) bool {
+	symbol, ok := node.(*ast.Symbol)
+	return ok && symbol.Name == name
+}
+
+// selects returns whether the clause is selected given the switch value,
+// or the value of its condition when it has one.
+func (c *clause) selects(value interface{}) bool {
+	switch {
+	case c.otherwise:
+		return true
+	case c.test != nil:
+		return (value == false) == c.not
+	}
+	for _, v := range c.cases {
+		if equal(value, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func condFn(scope *Scope, args []ast.Node) (value interface{}, err error) {
+	return scope.conditional("cond", args)
+}
+
+func switchFn(scope *Scope, args []ast.Node) (value interface{}, err error) {
+	return scope.conditional("switch", args)
+}
+
+func whenFn(scope *Scope, args []ast.Node) (value interface{}, err error) {
+	return scope.conditional("when", args)
+}
+
+func unlessFn(scope *Scope, args []ast.Node) (value interface{}, err error) {
+	return scope.conditional("unless", args)
+}
+
+// conditionals holds the conditional special forms by name.
+var conditionals = map[string]func(*Scope, []ast.Node) (interface{}, error){
+	"cond":   condFn,
+	"switch": switchFn,
+	"when":   whenFn,
+	"unless": unlessFn,
+}
+
+// conditional evaluates the conditional special form with the given name.
+func (s *Scope) conditional(form string, args []ast.Node) (interface{}, error) {
+	body, value, err := s.branch(form, args)
+	if err != nil || body == nil {
+		return value, err
+	}
+	return doFn(s, body)
+}
+
+// branch returns the body selected by the conditional special form with
+// the given name, or the value of the form if no body is selected.
+func (s *Scope) branch(form string, args []ast.Node) (body []ast.Node, value interface{}, err error) {
+	cond, err := parseConditional(form, args)
+	if err != nil {
+		return nil, nil, err
+	}
+	var switchValue interface{}
+	if cond.value != nil {
+		if switchValue, err = s.Eval(cond.value); err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, c := range cond.clauses {
+		value = switchValue
+		if c.test != nil {
+			if value, err = s.Eval(c.test); err != nil {
+				return nil, nil, err
+			}
+		}
+		if c.selects(value) {
+			if c.body == nil {
+				return nil, value, nil
+			}
+			return c.body, nil, nil
+		}
+	}
+	return nil, false, nil
+}
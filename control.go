@@ -0,0 +1,90 @@
+package twik
+
+import (
+	"errors"
+
+	"gopkg.in/twik.v1/ast"
+)
+
+// control is returned as an error by the break, continue, and return
+// special forms, so that evaluation unwinds up to the enclosing loop or
+// function, which handles it. Its message is the error reported when
+// there is no such loop or function.
+type control struct {
+	name  string
+	value interface{}
+}
+
+func (c *control) Error() string {
+	if c.name == "return" {
+		return "return used outside of a function"
+	}
+	return c.name + " used outside of a loop"
+}
+
+// controlOf returns the control held by err, or nil if there is none.
+func controlOf(err error) *control {
+	var c *control
+	if errors.As(err, &c) {
+		return c
+	}
+	return nil
+}
+
+// loopExit handles err, returned by the body of a loop. It returns
+// whether the loop ends, with the returned value and error, rather than
+// just the current iteration, which happens on continue.
+func loopExit(err error) (exit bool, value interface{}, rerr error) {
+	switch c := controlOf(err); {
+	case c == nil || c.name == "return":
+		return true, nil, err
+	case c.name == "break":
+		return true, c.value, nil
+	}
+	return false, nil, nil
+}
+
+// funcExit handles the result of evaluating the body of a function
+// defined with func. A return provides the value of the function, while
+// a break or continue outside of a loop in the function is an error.
+func funcExit(value interface{}, next *tailCall, err error) (interface{}, *tailCall, error) {
+	c := controlOf(err)
+	if c == nil {
+		return value, next, err
+	}
+	if c.name == "return" {
+		return c.value, nil, nil
+	}
+	if e, ok := err.(*Error); ok {
+		e.Err = errors.New(c.Error())
+		return nil, nil, e
+	}
+	return nil, nil, errors.New(c.Error())
+}
+
+// controlFn returns the special form that unwinds evaluation with the
+// control of the given name, taking an optional value if withValue is
+// true.
+func controlFn(name string, withValue bool) func(scope *Scope, args []ast.Node) (interface{}, error) {
+	usage := errors.New(name + " takes no arguments")
+	if withValue {
+		usage = errors.New(name + " takes an optional value")
+	}
+	return func(scope *Scope, args []ast.Node) (value interface{}, err error) {
+		if len(args) > 1 || len(args) == 1 && !withValue {
+			return nil, usage
+		}
+		if len(args) == 1 {
+			if value, err = scope.Eval(args[0]); err != nil {
+				return nil, err
+			}
+		}
+		return nil, &control{name, value}
+	}
+}
+
+var (
+	breakFn    = controlFn("break", true)
+	continueFn = controlFn("continue", false)
+	returnFn   = controlFn("return", true)
+)
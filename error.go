@@ -0,0 +1,112 @@
+package twik
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"gopkg.in/twik.v1/ast"
+)
+
+// Error holds an error and the source position where the error was found.
+type Error struct {
+	Err     error
+	PosInfo *ast.PosInfo
+
+	// Pos and End delimit the node where the error was found. They may
+	// be provided to FileSet.Snippet to show the respective source code.
+	Pos ast.Pos
+	End ast.Pos
+
+	// Stack holds the calls to functions defined with func that were
+	// in progress when the error was found, from the innermost one
+	// outwards.
+	Stack []Frame
+}
+
+// Frame holds details about a call to a function defined with func.
+type Frame struct {
+	// Func holds the function name, or "anonymous function".
+	Func string
+
+	// PosInfo holds the position of the call, or nil if the
+	// function was called from Go code.
+	PosInfo *ast.PosInfo
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s %v", e.PosInfo, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// maxTraceback is the number of entries shown by Traceback before
+// eliding the ones in the middle.
+const maxTraceback = 100
+
+// Traceback returns the error message followed by a traceback of the
+// function calls in progress when the error was found, in a format
+// similar to the one used by Go. Each entry holds the function name
+// followed by the position it was executing, from the innermost
+// function outwards, and ends with the top level of the evaluated code.
+func (e *Error) Traceback() string {
+	var buf bytes.Buffer
+	buf.WriteString(e.Error())
+	buf.WriteString("\n")
+	total := len(e.Stack) + 1
+	pos := e.PosInfo
+	for i := 0; i < total; i++ {
+		if total > maxTraceback && i == maxTraceback/2 {
+			skip := total - maxTraceback
+			fmt.Fprintf(&buf, "\n...%d frames elided...", skip)
+			i += skip
+			pos = e.Stack[i-1].PosInfo
+			if pos == nil {
+				buf.WriteString("\ncalled from Go")
+				break
+			}
+		}
+		name := "top level"
+		if i < len(e.Stack) {
+			name = e.Stack[i].Func
+		}
+		fmt.Fprintf(&buf, "\n%s\n\t%s", name, strings.TrimSuffix(pos.String(), ":"))
+		if i < len(e.Stack) {
+			pos = e.Stack[i].PosInfo
+			if pos == nil {
+				buf.WriteString("\ncalled from Go")
+				break
+			}
+		}
+	}
+	buf.WriteString("\n")
+	return buf.String()
+}
+
+// errorAt returns err as an *Error positioned at node, unless it already
+// is one. When err was returned by a function call, the call position is
+// recorded into its innermost stack frame.
+func errorAt(fset *ast.FileSet, node ast.Node, err error) error {
+	if e, ok := err.(*Error); ok {
+		if n := len(e.Stack); n > 0 && e.Stack[n-1].PosInfo == nil {
+			e.Stack[n-1].PosInfo = fset.PosInfo(node.Pos())
+		}
+		return err
+	}
+	return &Error{Err: err, PosInfo: fset.PosInfo(node.Pos()), Pos: node.Pos(), End: node.End()}
+}
+
+// pushFrame records into err a stack frame for a call to the function
+// with the given name, or an anonymous one if name is empty.
+func pushFrame(name string, err error) error {
+	if e, ok := err.(*Error); ok {
+		if name == "" {
+			name = "anonymous function"
+		}
+		e.Stack = append(e.Stack, Frame{Func: name})
+	}
+	return err
+}
@@ -0,0 +1,84 @@
+package twik_test
+
+import (
+	"strings"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/twik.v1"
+)
+
+func (S) TestErrorStack(c *C) {
+	code := `
+(func inner (x)
+  (error x))
+(var outer (func (x)
+  (inner x)))
+(outer "boom")
+`
+	fset := twik.NewFileSet()
+	node, err := twik.ParseString(fset, "file.twik", code)
+	c.Assert(err, IsNil)
+	prog, err := twik.Compile(fset, node)
+	c.Assert(err, IsNil)
+	for _, run := range []func(*twik.Scope) (interface{}, error){
+		func(scope *twik.Scope) (interface{}, error) { return scope.Eval(node) },
+		prog.Run,
+	} {
+		_, err = run(twik.NewScope(fset))
+		c.Assert(err, ErrorMatches, "file.twik:3:4: boom")
+		e := err.(*twik.Error)
+		c.Assert(e.Stack, HasLen, 2)
+		c.Assert(e.Stack[0].Func, Equals, "inner")
+		c.Assert(e.Stack[0].PosInfo.String(), Equals, "file.twik:5:4:")
+		c.Assert(e.Stack[1].Func, Equals, "anonymous function")
+		c.Assert(e.Stack[1].PosInfo.String(), Equals, "file.twik:6:2:")
+		c.Assert(e.Traceback(), Equals, `file.twik:3:4: boom
+
+inner
+	file.twik:3:4
+anonymous function
+	file.twik:5:4
+top level
+	file.twik:6:2
+`)
+	}
+}
+
+func (S) TestErrorStackCalledFromGo(c *C) {
+	fset := twik.NewFileSet()
+	node, err := twik.ParseString(fset, "", `(func f () (error "boom"))`)
+	c.Assert(err, IsNil)
+	fn, err := twik.NewScope(fset).Eval(node)
+	c.Assert(err, IsNil)
+	_, err = fn.(*twik.Function).Call(nil)
+	c.Assert(err, ErrorMatches, "twik source:1:13: boom")
+	c.Assert(err.(*twik.Error).Traceback(), Equals, `twik source:1:13: boom
+
+f
+	twik source:1:13
+called from Go
+`)
+}
+
+func (S) TestErrorStackElided(c *C) {
+	fset := twik.NewFileSet()
+	node, err := twik.ParseString(fset, "", "(func f (n) (if (== n 0) (error \"boom\") (+ 0 (f (- n 1)))))\n(f 200)")
+	c.Assert(err, IsNil)
+	_, err = twik.NewScope(fset).Eval(node)
+	c.Assert(err, ErrorMatches, "twik source:1:27: boom")
+	c.Assert(err.(*twik.Error).Stack, HasLen, 201)
+	lines := strings.Split(err.(*twik.Error).Traceback(), "\n")
+	c.Assert(lines, HasLen, 1+1+100*2+1+1)
+	c.Assert(lines[102], Equals, "...102 frames elided...")
+	c.Assert(lines[len(lines)-3:], DeepEquals, []string{"top level", "\ttwik source:2:2", ""})
+}
+
+func (S) TestErrorSnippet(c *C) {
+	fset := twik.NewFileSet()
+	node, err := twik.ParseString(fset, "", "(+ 1\n  (undefined 2))")
+	c.Assert(err, IsNil)
+	_, err = twik.NewScope(fset).Eval(node)
+	c.Assert(err, ErrorMatches, "twik source:2:4: undefined symbol: undefined")
+	e := err.(*twik.Error)
+	c.Assert(fset.Snippet(e.Pos, e.End, false), Equals, "  (undefined 2))\n   ^~~~~~~~~\n")
+}
@@ -1,11 +1,17 @@
 package twik_test
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"math"
+	"strings"
 	"testing"
+	"time"
 
 	. "gopkg.in/check.v1"
 	"gopkg.in/twik.v1"
+	"gopkg.in/twik.v1/ast"
 )
 
 func Test(t *testing.T) { TestingT(t) }
@@ -19,22 +25,154 @@ func (S) TestEval(c *C) {
 		fset := twik.NewFileSet()
 		node, err := twik.ParseString(fset, "", test.code)
 		c.Assert(err, IsNil)
-		scope := twik.NewScope(fset)
-		scope.Create("sprintf", sprintfFn)
-		scope.Create("list", listFn)
-		scope.Create("append", appendFn)
-		value, err := scope.Eval(node)
-		if e, ok := test.value.(error); ok {
-			c.Assert(err, ErrorMatches, e.Error(), Commentf("Code: %s", test.code))
-			c.Assert(value, IsNil)
-		} else {
-			tvalue := test.value
-			if i, ok := tvalue.(int); ok {
-				tvalue = int64(i)
-			}
-			c.Assert(err, IsNil, Commentf("Code: %s", test.code))
-			c.Assert(value, DeepEquals, tvalue, Commentf("Code: %s", test.code))
+		value, err := newScope(fset).Eval(node)
+		checkEval(c, test.code, test.value, value, err)
+	}
+}
+
+var contextList = []struct {
+	code  string
+	value interface{}
+}{
+	{
+		`(for () true () ())`,
+		errorf("twik source:1:2: context canceled"),
+	}, {
+		`(range i 10 ())`,
+		errorf("twik source:1:2: context canceled"),
+	}, {
+		`(range i (list 1 2) ())`,
+		errorf("twik source:1:11: context canceled"),
+	}, {
+		"(func f () 1)\n(f)",
+		errorf("twik source:2:2: context canceled"),
+	}, {
+		`(upper "a")`,
+		errorf("twik source:1:2: context canceled"),
+	}, {
+		`(try (for () true () ()) (catch e 1))`,
+		errorf("twik source:1:7: context canceled"),
+	}, {
+		`(if true 1 2)`,
+		1,
+	},
+}
+
+func (S) TestEvalContext(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, test := range contextList {
+		fset := twik.NewFileSet()
+		node, err := twik.ParseString(fset, "", test.code)
+		c.Assert(err, IsNil)
+		value, err := newScope(fset).EvalContext(ctx, node)
+		checkEval(c, test.code, test.value, value, err)
+		if err != nil {
+			c.Assert(errors.Is(err, context.Canceled), Equals, true)
+		}
+	}
+}
+
+func (S) TestEvalContextDeadline(c *C) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	fset := twik.NewFileSet()
+	node, err := twik.ParseString(fset, "", "(var x 0)\n(for () true () (set x (+ x 1)))")
+	c.Assert(err, IsNil)
+	scope := newScope(fset)
+	_, err = scope.EvalContext(ctx, node)
+	c.Assert(err, ErrorMatches, `twik source:2:\d+: context deadline exceeded`)
+	c.Assert(errors.Is(err, context.DeadlineExceeded), Equals, true)
+
+	// The context is not observed after EvalContext returns.
+	node, err = twik.ParseString(fset, "", "(range i 3 (set x i)) x")
+	c.Assert(err, IsNil)
+	value, err := scope.Eval(node)
+	c.Assert(err, IsNil)
+	c.Assert(value, Equals, int64(2))
+}
+
+func (S) TestEvalContextGoFunction(c *C) {
+	type key struct{}
+	ctx := context.WithValue(context.Background(), key{}, "value")
+	fset := twik.NewFileSet()
+	node, err := twik.ParseString(fset, "", `(ctxvalue "ignored")`)
+	c.Assert(err, IsNil)
+	scope := twik.NewScope(fset)
+	scope.Create("ctxvalue", func(ctx context.Context, s string) interface{} {
+		return ctx.Value(key{})
+	})
+	value, err := scope.EvalContext(ctx, node)
+	c.Assert(err, IsNil)
+	c.Assert(value, Equals, "value")
+	value, err = scope.Eval(node)
+	c.Assert(err, IsNil)
+	c.Assert(value, IsNil)
+}
+
+func (S) TestCreateKeyword(c *C) {
+	scope := twik.NewScope(twik.NewFileSet())
+	c.Assert(scope.Create(":x", 1), ErrorMatches, "cannot define keyword symbol: :x")
+	c.Assert(scope.Create(":", 1), IsNil)
+}
+
+func (S) TestFunctionFromGo(c *C) {
+	fset := twik.NewFileSet()
+	node, err := twik.ParseString(fset, "", `(func double (x) (* x 2)) (twice double 3)`)
+	c.Assert(err, IsNil)
+	scope := twik.NewScope(fset)
+	scope.Create("twice", func(f func([]interface{}) (interface{}, error), x int64) (interface{}, error) {
+		value, err := f([]interface{}{x})
+		if err != nil {
+			return nil, err
 		}
+		return f([]interface{}{value})
+	})
+	value, err := scope.Eval(node)
+	c.Assert(err, IsNil)
+	c.Assert(value, Equals, int64(12))
+
+	fn, err := scope.Eval(&ast.Symbol{Name: "double"})
+	c.Assert(err, IsNil)
+	c.Assert(fn, FitsTypeOf, &twik.Function{})
+	value, err = fn.(*twik.Function).Call([]interface{}{int64(5)})
+	c.Assert(err, IsNil)
+	c.Assert(value, Equals, int64(10))
+	value, err = fn.(*twik.Function).Func()([]interface{}{int64(6)})
+	c.Assert(err, IsNil)
+	c.Assert(value, Equals, int64(12))
+}
+
+func newScope(fset *ast.FileSet) *twik.Scope {
+	scope := twik.NewScope(fset)
+	scope.Create("sprintf", sprintfFn)
+	scope.Use(twik.Lists)
+	scope.Create("upper", strings.ToUpper)
+	scope.Create("repeat", strings.Repeat)
+	scope.Create("join", strings.Join)
+	scope.Create("fields", strings.Fields)
+	scope.Create("sum", sumFn)
+	scope.Create("quo", quoFn)
+	scope.Create("half", halfFn)
+	scope.Create("divmod", divmodFn)
+	scope.Create("noop", func() {})
+	scope.Create("lengths", lengthsFn)
+	scope.Create("total", totalFn)
+	scope.Create("alice", &Person{Name: "Alice", Age: 30, Address: &Address{City: "Lisbon"}})
+	scope.Create("bob", Person{Name: "Bob", Age: 12})
+	return scope
+}
+
+func checkEval(c *C, code string, expected, value interface{}, err error) {
+	if e, ok := expected.(error); ok {
+		c.Assert(err, ErrorMatches, e.Error(), Commentf("Code: %s", code))
+		c.Assert(value, IsNil)
+	} else {
+		if i, ok := expected.(int); ok {
+			expected = int64(i)
+		}
+		c.Assert(err, IsNil, Commentf("Code: %s", code))
+		c.Assert(value, DeepEquals, expected, Commentf("Code: %s", code))
 	}
 }
 
@@ -49,16 +187,65 @@ func sprintfFn(args []interface{}) (interface{}, error) {
 	return fmt.Sprintf(format, args[1:]...), nil
 }
 
-func listFn(args []interface{}) (interface{}, error) {
-	return args, nil
+func sumFn(base uint8, values ...int) int {
+	sum := int(base)
+	for _, v := range values {
+		sum += v
+	}
+	return sum
 }
 
-func appendFn(args []interface{}) (interface{}, error) {
-	list, ok := args[0].([]interface{})
-	if !ok {
-		return nil, fmt.Errorf("append takes list as first argument")
+func quoFn(a, b int) (int, error) {
+	if b == 0 {
+		return 0, errors.New("division by zero")
+	}
+	return a / b, nil
+}
+
+func halfFn(f float32) float32 {
+	return f / 2
+}
+
+func divmodFn(a, b int32) (int32, int32) {
+	return a / b, a % b
+}
+
+func lengthsFn(words []string) map[string]int {
+	m := make(map[string]int)
+	for _, w := range words {
+		m[w] = len(w)
+	}
+	return m
+}
+
+func totalFn(m map[string]int) (total int) {
+	for _, n := range m {
+		total += n
 	}
-	return append(list, args[1:]...), nil
+	return total
+}
+
+type Address struct {
+	City string
+}
+
+type Person struct {
+	Name string
+	Age  int
+	*Address
+	secret string
+}
+
+func (p *Person) Greet(greeting string) string {
+	return greeting + ", " + p.Name
+}
+
+func (p *Person) Birthday() {
+	p.Age++
+}
+
+func (p Person) Adult() bool {
+	return p.Age >= 18
 }
 
 func errorf(format string, args ...interface{}) error {
@@ -120,6 +307,78 @@ var evalList = []struct {
 		errorf("twik source:1:2: error function takes a single string argument"),
 	},
 
+	// try, throw
+	{
+		`(try 1 2)`,
+		2,
+	}, {
+		`(try (error "boom") (catch e (error-message e)))`,
+		"boom",
+	}, {
+		`(try (error "boom") (catch e (error-position e)))`,
+		"twik source:1:7",
+	}, {
+		"(func f () (error \"boom\"))\n(try (f) (catch e (error-position e)))",
+		"twik source:1:13",
+	}, {
+		`(try (quo 1 0) (catch e (error-message (error-cause e))))`,
+		"division by zero",
+	}, {
+		`(try (quo 1 0) (catch e (error-cause (error-cause e))))`,
+		nil,
+	}, {
+		`(var x 0) (try (set x 1) (finally (set x (+ x 1)))) x`,
+		2,
+	}, {
+		`(var x 0) (try (error "boom") (finally (set x 1)))`,
+		errorf("twik source:1:17: boom"),
+	}, {
+		`(var x 0) (try (try (error "boom") (finally (set x 1))) (catch e x))`,
+		1,
+	}, {
+		`(try (error "boom") (catch e (throw e)))`,
+		errorf("twik source:1:7: boom"),
+	}, {
+		`(try (error "boom") (catch e (throw "other")))`,
+		errorf("twik source:1:31: other"),
+	}, {
+		`(try (error "boom") (catch e 1) (finally (error "final")))`,
+		errorf("twik source:1:43: final"),
+	}, {
+		`(try (error "boom") (catch e))`,
+		nil,
+	}, {
+		`(try (var x 1) (catch e)) x`,
+		errorf("twik source:1:27: undefined symbol: x"),
+	}, {
+		`(try (error "boom") (catch e)) e`,
+		errorf("twik source:1:32: undefined symbol: e"),
+	}, {
+		`(try)`,
+		errorf("twik source:1:2: try takes a body sequence"),
+	}, {
+		`(try (catch e))`,
+		errorf("twik source:1:2: try takes a body sequence"),
+	}, {
+		`(try 1 (finally) (catch e))`,
+		errorf("twik source:1:2: try takes catch and finally clauses at the end, in that order"),
+	}, {
+		`(try 1 (catch 1))`,
+		errorf("twik source:1:2: catch takes a symbol as first argument"),
+	}, {
+		`(try (throw "x") (catch :e :e))`,
+		errorf("twik source:1:2: catch cannot bind keyword symbol :e"),
+	}, {
+		`(throw)`,
+		errorf("twik source:1:2: throw takes a single error or string argument"),
+	}, {
+		`(throw "boom")`,
+		errorf("twik source:1:2: boom"),
+	}, {
+		`(error-message "boom")`,
+		errorf("twik source:1:2: error-message takes a single error argument"),
+	},
+
 	// +
 	{
 		`(+)`,
@@ -241,9 +500,32 @@ var evalList = []struct {
 	}, {
 		`(/ 10 2.0)`,
 		5.0,
+	}, {
+		`(/ 1 0)`,
+		errorf(`twik source:1:2: integer division by zero`),
+	}, {
+		`(/ 1.0 0)`,
+		math.Inf(1),
+	}, {
+		`(/ -9223372036854775808 -1)`,
+		errorf(`twik source:1:2: integer overflow`),
+	}, {
+		`(+ 9223372036854775807 1)`,
+		errorf(`twik source:1:2: integer overflow`),
+	}, {
+		`(- -9223372036854775807 2)`,
+		errorf(`twik source:1:2: integer overflow`),
+	}, {
+		`(- -9223372036854775808)`,
+		errorf(`twik source:1:2: integer overflow`),
+	}, {
+		`(* 3 (* 4611686018427387904 2))`,
+		errorf(`twik source:1:7: integer overflow`),
+	}, {
+		`(+ 9223372036854775807 1.0)`,
+		9223372036854775808.0,
 	},
 
-
 	// ==
 	{
 		`(== "a" "a")`,
@@ -269,6 +551,18 @@ var evalList = []struct {
 	}, {
 		`(==)`,
 		errorf("twik source:1:2: == takes two values"),
+	}, {
+		`(== (list 1 "a") (list 1 "a"))`,
+		true,
+	}, {
+		`(== (list 1 "a") (list 1 "b"))`,
+		false,
+	}, {
+		`(== {"a" 1} {"a" 1})`,
+		true,
+	}, {
+		`(== {"a" 1} {"a" 2})`,
+		false,
 	},
 
 	// !=
@@ -298,6 +592,65 @@ var evalList = []struct {
 		errorf("twik source:1:2: != takes two values"),
 	},
 
+	// <, <=, >, >=
+	{
+		`(< 1 2)`,
+		true,
+	}, {
+		`(< 2 1)`,
+		false,
+	}, {
+		`(< 1 1)`,
+		false,
+	}, {
+		`(< 1 2 3)`,
+		true,
+	}, {
+		`(< 1 3 2)`,
+		false,
+	}, {
+		`(< 1 1.5 2)`,
+		true,
+	}, {
+		`(< 1.5 1)`,
+		false,
+	}, {
+		`(< "a" "ab" "b")`,
+		true,
+	}, {
+		`(<= 1 1 2)`,
+		true,
+	}, {
+		`(<= 2 1)`,
+		false,
+	}, {
+		`(> 3 2 1)`,
+		true,
+	}, {
+		`(> 1 1)`,
+		false,
+	}, {
+		`(>= 2 2.0 1)`,
+		true,
+	}, {
+		`(>= "a" "b")`,
+		false,
+	}, {
+		`(< 1)`,
+		errorf("twik source:1:2: < takes two or more values"),
+	}, {
+		`(>=)`,
+		errorf("twik source:1:2: >= takes two or more values"),
+	}, {
+		`(< 1 "a")`,
+		errorf(`twik source:1:2: cannot compare 1 with "a"`),
+	}, {
+		`(> 2 1 nil)`,
+		errorf(`twik source:1:2: cannot compare 1 with <nil>`),
+	}, {
+		`(< (list 1) (list 2))`,
+		errorf(`twik source:1:2: cannot compare \[\]interface \{\}\{1\} with \[\]interface \{\}\{2\}`),
+	},
 
 	// or
 	{
@@ -342,6 +695,9 @@ var evalList = []struct {
 	}, {
 		"(var x)\n(var x)",
 		errorf("twik source:2:2: symbol already defined in current scope: x"),
+	}, {
+		`(var :x 1)`,
+		errorf("twik source:1:2: cannot define keyword symbol: :x"),
 	},
 
 	// set
@@ -383,6 +739,78 @@ var evalList = []struct {
 		1,
 	},
 
+	// let, let*
+	{
+		`(let ((a 1) (b 2)) (+ a b))`,
+		3,
+	}, {
+		`(var a 1) (let ((a 2) (b a)) (list a b))`,
+		[]interface{}{int64(2), int64(1)},
+	}, {
+		`(var a 1) (let* ((a 2) (b a)) (list a b))`,
+		[]interface{}{int64(2), int64(2)},
+	}, {
+		`(let* ((x 1) (x (+ x 1)) (x (* x 10))) x)`,
+		20,
+	}, {
+		`(var x 1) (let ((x 2)) (set x 3)) x`,
+		1,
+	}, {
+		`(var x 1) (let ((y 2)) (set x y)) x`,
+		2,
+	}, {
+		`(let ((y 2)) (var z 3)) z`,
+		errorf("twik source:1:25: undefined symbol: z"),
+	}, {
+		`(let () (var y 1) y)`,
+		1,
+	}, {
+		`(let* () (var y 1)) y`,
+		errorf("twik source:1:21: undefined symbol: y"),
+	}, {
+		`(let (((a b) (list 1 2)) (c 3)) (list c b a))`,
+		[]interface{}{int64(3), int64(2), int64(1)},
+	}, {
+		`(let* (((k v) (list "a" 1)) ((x) (list {k v}))) x)`,
+		map[string]interface{}{"a": int64(1)},
+	}, {
+		`(let (((a b) (list 1))) a)`,
+		errorf(`twik source:1:8: cannot destructure \[\]interface \{\}\{1\} as a list of length 2`),
+	}, {
+		`(let (((a b) 1)) a)`,
+		errorf("twik source:1:8: cannot destructure 1 as a list of length 2"),
+	}, {
+		`(var fs ()) (range i 3 (let ((j i)) (set fs (append fs (func () j))))) (var l ()) (range (i f) fs (set l (append l (f)))) l`,
+		[]interface{}{int64(0), int64(1), int64(2)},
+	}, {
+		`(func f (n acc) (let* ((m (- n 1)) (a (+ acc 1))) (if (== n 0) acc (f m a)))) (f 5 0)`,
+		5,
+	}, {
+		`(let ((a 1)))`,
+		errorf("twik source:1:2: let takes a list of bindings and a body sequence"),
+	}, {
+		`(let* a 1)`,
+		errorf(`twik source:1:2: let\* takes a list of bindings and a body sequence`),
+	}, {
+		`(let (a) a)`,
+		errorf(`twik source:1:2: let's bindings must be \(name value\) or \(\(name...\) value\) pairs`),
+	}, {
+		`(let (((a 1) 2)) a)`,
+		errorf(`twik source:1:2: let's bindings must be .*`),
+	}, {
+		`(let ((a 1) (a 2)) a)`,
+		errorf("twik source:1:2: let has duplicated name a"),
+	}, {
+		`(let* (((a a) (list 1 2))) a)`,
+		errorf(`twik source:1:2: let\* has duplicated name a`),
+	}, {
+		`(let ((:k 1)) :k)`,
+		errorf("twik source:1:2: let cannot bind keyword symbol :k"),
+	}, {
+		`(let* (((a :k) (list 1 2))) a)`,
+		errorf(`twik source:1:2: let\* cannot bind keyword symbol :k`),
+	},
+
 	// func
 	{
 		`((func (a b) (+ a b)) 1 2)`,
@@ -420,6 +848,93 @@ var evalList = []struct {
 	}, {
 		"(func f (a b) 1)\n(f 1)",
 		errorf(`twik source:2:2: function "f" takes 2 arguments`),
+	}, {
+		`(func f (a) (var x a) x) (f 1) (f 2)`,
+		2,
+	}, {
+		`(func f (a) (if a (var x 1)) x) (f true) (f false)`,
+		errorf("twik source:1:30: undefined symbol: x"),
+	}, {
+		`(var fs ()) (range i 3 (do (var j i) (set fs (append fs (func () j))))) (var l ()) (range (i f) fs (set l (append l (f)))) l`,
+		[]interface{}{int64(0), int64(1), int64(2)},
+	}, {
+		`(func f (a (b 10)) (+ a b)) (list (f 1) (f 1 2))`,
+		[]interface{}{int64(11), int64(3)},
+	}, {
+		`(func f (a (b (+ a 1)) c) b)`,
+		errorf("twik source:1:2: func's required parameters must come before optional ones"),
+	}, {
+		`(func f (a (b (+ a 1))) b) (f 1)`,
+		2,
+	}, {
+		`(func f (a & rest) rest) (list (f 1) (f 1 2 3))`,
+		[]interface{}{[]interface{}{}, []interface{}{int64(2), int64(3)}},
+	}, {
+		`(func f (a (b 2) & rest) (list a b rest)) (f 1 2 3)`,
+		[]interface{}{int64(1), int64(2), []interface{}{int64(3)}},
+	}, {
+		`(func f (a :b (:c 3)) (list a b c)) (list (f 1) (f 1 :c 4 :b 2))`,
+		[]interface{}{[]interface{}{int64(1), nil, int64(3)}, []interface{}{int64(1), int64(2), int64(4)}},
+	}, {
+		`(func f (& rest :b) (list rest b)) (f 1 :b 2 3)`,
+		[]interface{}{[]interface{}{int64(1), int64(3)}, int64(2)},
+	}, {
+		`(func f (a) a) (f :b)`,
+		twik.Keyword("b"),
+	}, {
+		`(func f (a :b) b) (f 1 :z 2)`,
+		errorf(`twik source:1:20: function "f" has no keyword parameter :z`),
+	}, {
+		`(func f (a :b) b) (f 1 :b)`,
+		errorf(`twik source:1:20: keyword argument :b takes a value`),
+	}, {
+		`(func f (a (b 1) (c 2)) a) (f)`,
+		errorf(`twik source:1:29: function "f" takes 1 to 3 arguments`),
+	}, {
+		`(func f (a b & r) a) (f 1)`,
+		errorf(`twik source:1:23: function "f" takes 2 or more arguments`),
+	}, {
+		`((func (a & r) a))`,
+		errorf(`twik source:1:2: anonymous function takes one or more arguments`),
+	}, {
+		`(func f (a &) a)`,
+		errorf("twik source:1:2: func takes a single symbol after &"),
+	}, {
+		`(func f (a & b c) a)`,
+		errorf("twik source:1:2: func takes a single symbol after &"),
+	}, {
+		`(func f (:a b) a)`,
+		errorf("twik source:1:2: func's keyword parameters must come last"),
+	}, {
+		`(func f (a :a) a)`,
+		errorf("twik source:1:2: func has duplicated parameter a"),
+	}, {
+		`(func f (1) 1)`,
+		errorf(`twik source:1:2: func's parameters must be symbols or \(symbol default\) pairs`),
+	}, {
+		`(func loop (n (acc 0)) (if (== n 0) acc (loop (- n 1) (+ acc n)))) (loop 100000)`,
+		5000050000,
+	}, {
+		`(func f (& args) (apply sum 1 args)) (f 2 3)`,
+		6,
+	}, {
+		`(apply + 1 2 (list 3 4))`,
+		10,
+	}, {
+		`(apply + 1)`,
+		errorf("twik source:1:2: apply takes a function, optional arguments, and a list of further arguments"),
+	}, {
+		`:a`,
+		twik.Keyword("a"),
+	}, {
+		`(func tri (n acc) (if (== n 0) acc (tri (- n 1) (+ acc n)))) (tri 100000 0)`,
+		5000050000,
+	}, {
+		`(func even (n) (or (== n 0) (odd (- n 1)))) (func odd (n) (and (!= n 0) (do (even (- n 1))))) (list (even 100001) (odd 100001))`,
+		[]interface{}{false, true},
+	}, {
+		`(func f (a) (g)) (func g (a) a) (f 1)`,
+		errorf(`twik source:1:14: function "g" takes one argument`),
 	},
 
 	// if
@@ -443,6 +958,93 @@ var evalList = []struct {
 		errorf(`twik source:1:2: function "if" takes two or three arguments`),
 	},
 
+	// cond, switch, when, unless
+	{
+		`(func sign (n) (cond ((< n 0) -1) ((== n 0) 0) (else 1))) (list (sign -5) (sign 0) (sign 5))`,
+		[]interface{}{int64(-1), int64(0), int64(1)},
+	}, {
+		`(cond (false 1) (nil 2))`,
+		2,
+	}, {
+		`(cond (false 1))`,
+		false,
+	}, {
+		`(cond)`,
+		false,
+	}, {
+		`(cond (false) ("a"))`,
+		"a",
+	}, {
+		`(var x 1) (cond (true (var x 2) (set x (+ x 1)) x))`,
+		int64(3),
+	}, {
+		`(var x 1) (cond (true (var y 2) (set x y))) x`,
+		int64(2),
+	}, {
+		`(cond (else 1) (true 2))`,
+		errorf("twik source:1:2: cond takes else as the last clause"),
+	}, {
+		`(cond 1)`,
+		errorf("twik source:1:2: cond takes clause lists"),
+	}, {
+		`(cond (else))`,
+		errorf("twik source:1:2: cond takes a body sequence in the else clause"),
+	}, {
+		`(cond (false 1) ((+ 1 "a") 2))`,
+		errorf("twik source:1:19: cannot sum .*"),
+	}, {
+		`(func name (n) (switch n (case 1 "one") (case (2 3) "few") (case (:many "many") "many") (else "other"))) (list (name 1) (name 3) (name :many) (name "many") (name 7))`,
+		[]interface{}{"one", "few", "many", "many", "other"},
+	}, {
+		`(switch nil (case (1.5 false) 1) (case nil 2))`,
+		int64(2),
+	}, {
+		`(switch "b" (case "a" 1))`,
+		false,
+	}, {
+		`(switch (+ 1 1) (case 2 (var x 3) (* x x)))`,
+		int64(9),
+	}, {
+		`(switch)`,
+		errorf(`twik source:1:2: switch takes a value, \(case constants body...\) clauses, and an optional \(else body...\) clause`),
+	}, {
+		`(switch 1 (case 1))`,
+		errorf(`twik source:1:2: switch takes a value, .*`),
+	}, {
+		`(switch 1 (else 1) (case 1 2))`,
+		errorf(`twik source:1:2: switch takes a value, .*`),
+	}, {
+		`(switch 1 (when 1 2))`,
+		errorf(`twik source:1:2: switch takes a value, .*`),
+	}, {
+		`(var y 1) (switch 1 (case y 2))`,
+		errorf("twik source:1:12: switch cases must be constants"),
+	}, {
+		`(when true 1 2)`,
+		int64(2),
+	}, {
+		`(when false 1)`,
+		false,
+	}, {
+		`(unless false 1 2)`,
+		int64(2),
+	}, {
+		`(unless 0 1)`,
+		false,
+	}, {
+		`(when true)`,
+		errorf("twik source:1:2: when takes a condition and a body sequence"),
+	}, {
+		`(unless)`,
+		errorf("twik source:1:2: unless takes a condition and a body sequence"),
+	}, {
+		`(func count (n acc) (unless (> n 0) (return acc)) (when true (set acc (+ acc 1)) (count (- n 1) acc))) (count 3 0)`,
+		int64(3),
+	}, {
+		`(func count (n) (cond ((> n 0) (count (- n 1))) (else "done"))) (count 3)`,
+		"done",
+	},
+
 	// for
 	{
 		`(for 1 2 3)`,
@@ -465,6 +1067,9 @@ var evalList = []struct {
 	}, {
 		`(var x 0) (for (var i 0) (!= i 4) (set i (+ i 1)) (set x (+ x i)) (* 2 x))`,
 		12,
+	}, {
+		`(var x 0) (for (var i 0) (< i 10) (set i (+ i 1)) (set x (+ x i))) x`,
+		45,
 	},
 
 	// range
@@ -482,13 +1087,396 @@ var evalList = []struct {
 		12,
 	}, {
 		`(var l ()) (range (i e) (list "A" "B" "C") (set l (append l i e))) l`,
-		[]interface {}{0, "A", 1, "B", 2, "C"},
+		[]interface{}{int64(0), "A", int64(1), "B", int64(2), "C"},
+	}, {
+		`(var l ()) (range (i e) (list "A" "B" "C") (switch i (case 1 (set l (append l e))))) l`,
+		[]interface{}{"B"},
+	}, {
+		`(var l ()) (range (k v) {"b" 2 "a" 1 "c" 3} (set l (append l k v))) l`,
+		[]interface{}{"a", int64(1), "b", int64(2), "c", int64(3)},
+	}, {
+		`(var l ()) (range k {"b" 2 "a" 1} (set l (append l k))) l`,
+		[]interface{}{"a", "b"},
+	}, {
+		`(range i "a" ())`,
+		errorf("twik source:1:2: range takes an integer, a list, or a map as second argument"),
+	},
+
+	// break, continue, return
+	{
+		`(range (i x) (list 5 6 7) (if (== x 6) (break (* x 2))))`,
+		int64(12),
+	}, {
+		`(range i 10 (if (== i 2) (break)) i)`,
+		nil,
+	}, {
+		`(var x 0) (for (var i 0) (< i 5) (set i (+ i 1)) (if (== i 2) (continue)) (set x (+ x i))) x`,
+		int64(8),
+	}, {
+		`(var l ()) (range i 5 (if (== i 1) (continue)) (set l (append l i)) (do (if (== i 3) (break)))) l`,
+		[]interface{}{int64(0), int64(2), int64(3)},
+	}, {
+		`(var n 0) (range i 3 (range j 3 (if (== j 1) (break)) (set n (+ n 1)))) n`,
+		int64(3),
+	}, {
+		`(var n 0) (range i 3 (set n (+ n 1)) (for (var j 0) (break) (set j 1) 0)) n`,
+		int64(1),
+	}, {
+		`(var n 0) (range i 3 (for (var j 0) (< j 1) (continue) (set n (+ n 1))) (set n (+ n 10))) n`,
+		int64(3),
+	}, {
+		`(for (var i 0) (break 7) (set i (+ i 1)) 1)`,
+		errorf("twik source:1:17: break used outside of a loop"),
+	}, {
+		`(for (var i 0) (< i 3) (continue) 1)`,
+		errorf("twik source:1:25: continue used outside of a loop"),
+	}, {
+		`(func f () (range i 10 (if (== i 3) (return i))) 99) (f)`,
+		int64(3),
+	}, {
+		`(func f (x) (do (if x (do (return "yes")))) "no") (list (f true) (f false))`,
+		[]interface{}{"yes", "no"},
+	}, {
+		`(func f () (return)) (f)`,
+		nil,
+	}, {
+		`(var n 0) (func f () (break)) (range i 3 (set n i) (f)) n`,
+		errorf("twik source:1:23: break used outside of a loop"),
+	}, {
+		`(range i 3 (try (break 1) (catch e 2)))`,
+		int64(1),
+	}, {
+		`(break)`,
+		errorf("twik source:1:2: break used outside of a loop"),
+	}, {
+		`(do (continue))`,
+		errorf("twik source:1:6: continue used outside of a loop"),
+	}, {
+		`(range i 3 (return 1))`,
+		errorf("twik source:1:13: return used outside of a function"),
+	}, {
+		`(range i 3 (continue 1))`,
+		errorf("twik source:1:13: continue takes no arguments"),
+	}, {
+		`(func f () (return 1 2)) (f)`,
+		errorf("twik source:1:13: return takes an optional value"),
+	},
+
+	// maps
+	{
+		`{}`,
+		map[string]interface{}{},
+	}, {
+		`{"a" 1 "b" (+ 1 1)}`,
+		map[string]interface{}{"a": int64(1), "b": int64(2)},
+	}, {
+		`(var k "a") {k {k k}}`,
+		map[string]interface{}{"a": map[string]interface{}{"a": "a"}},
+	}, {
+		`{1 2}`,
+		errorf("twik source:1:2: map key must be a string: 1"),
+	}, {
+		`(get {"a" 1} "a")`,
+		1,
+	}, {
+		`(get {"a" 1} "b")`,
+		nil,
+	}, {
+		`(get {"a" 1} "b" 2)`,
+		2,
+	}, {
+		`(get {"a" 1})`,
+		errorf("twik source:1:2: get takes a map, a key, and an optional default value"),
+	}, {
+		`(get {"a" 1} 1)`,
+		errorf("twik source:1:2: map key must be a string: 1"),
+	}, {
+		`(var m {}) (put m "a" 1 "b" 2) m`,
+		map[string]interface{}{"a": int64(1), "b": int64(2)},
+	}, {
+		`(put nil "a" 1)`,
+		errorf("twik source:1:2: put takes a map followed by key and value pairs"),
+	}, {
+		`(put {} "a")`,
+		errorf("twik source:1:2: put takes a map followed by key and value pairs"),
+	}, {
+		`(var m {"a" 1 "b" 2 "c" 3}) (del m "a" "c") m`,
+		map[string]interface{}{"b": int64(2)},
+	}, {
+		`(keys {"b" 2 "a" 1})`,
+		[]interface{}{"a", "b"},
+	}, {
+		`(values {"b" 2 "a" 1})`,
+		[]interface{}{int64(1), int64(2)},
+	}, {
+		`(keys (list))`,
+		errorf("twik source:1:2: keys takes a single map argument"),
+	}, {
+		`(has {"a" nil} "a")`,
+		true,
+	}, {
+		`(has {"a" nil} "b")`,
+		false,
+	}, {
+		`(lengths (list "a" "bcd"))`,
+		map[string]interface{}{"a": int64(1), "bcd": int64(3)},
+	}, {
+		`(total {"a" 1 "b" 2})`,
+		3,
+	}, {
+		`(total {"a" "b"})`,
+		errorf(`twik source:1:2: cannot use "b" as int in argument 1 to .*totalFn`),
 	},
 
+	// selection of fields and methods
+	{
+		`alice.Name`,
+		"Alice",
+	}, {
+		`alice.Address.City`,
+		"Lisbon",
+	}, {
+		`alice.City`,
+		"Lisbon",
+	}, {
+		`(. alice Age)`,
+		30,
+	}, {
+		`(. alice Greet "Hi")`,
+		"Hi, Alice",
+	}, {
+		`(alice.Greet "Hello")`,
+		"Hello, Alice",
+	}, {
+		`(. bob Adult)`,
+		false,
+	}, {
+		`(alice.Adult)`,
+		true,
+	}, {
+		`(var p alice) p.Name`,
+		"Alice",
+	}, {
+		`(func name (p) p.Name) (name bob)`,
+		"Bob",
+	}, {
+		`(alice.Birthday) alice.Age`,
+		31,
+	}, {
+		`(set alice.Age 40) (. alice Age)`,
+		40,
+	}, {
+		`(set alice.City "Porto") alice.Address.City`,
+		"Porto",
+	}, {
+		`(set bob.Age 13)`,
+		errorf("twik source:1:2: cannot set field Age of a value that is not a pointer"),
+	}, {
+		`(set alice.Age "old")`,
+		errorf(`twik source:1:2: cannot use "old" as int in assignment to field Age`),
+	}, {
+		`alice.secret`,
+		errorf(`twik source:1:1: \*twik_test.Person has no field or method secret`),
+	}, {
+		`bob.City`,
+		errorf("twik source:1:1: cannot select City from nil"),
+	}, {
+		`carol.Name`,
+		errorf("twik source:1:1: undefined symbol: carol.Name"),
+	}, {
+		`(. alice Name 1)`,
+		errorf(`twik source:1:2: cannot call field Name of \*twik_test.Person`),
+	}, {
+		`(. alice Greet)`,
+		errorf(`twik source:1:2: function ".*Greet" takes one argument`),
+	}, {
+		`(. alice)`,
+		errorf("twik source:1:2: . takes a value, a field or method name, and the method arguments"),
+	},
+
+	// quote, quasiquote
+	{
+		`'a`,
+		twik.Symbol("a"),
+	}, {
+		`'(a 1 "s" 1.5 ())`,
+		[]interface{}{twik.Symbol("a"), int64(1), "s", 1.5, []interface{}{}},
+	}, {
+		`(quote (a b))`,
+		[]interface{}{twik.Symbol("a"), twik.Symbol("b")},
+	}, {
+		`''a`,
+		[]interface{}{twik.Symbol("quote"), twik.Symbol("a")},
+	}, {
+		`'{"a" b}`,
+		map[string]interface{}{"a": twik.Symbol("b")},
+	}, {
+		`'{a b}`,
+		errorf("twik source:1:1: quoted map keys must be string literals"),
+	}, {
+		`(quote)`,
+		errorf("twik source:1:2: quote takes one argument"),
+	}, {
+		`(list (== 'a 'a) (== 'a 'b) (== 'a "a"))`,
+		[]interface{}{true, false, false},
+	}, {
+		"(var x 2) `(a ,x ,@(list 1 2) ,(+ x 1) (b ,x) ,@())",
+		[]interface{}{twik.Symbol("a"), int64(2), int64(1), int64(2), int64(3), []interface{}{twik.Symbol("b"), int64(2)}},
+	}, {
+		"(var x 2) (quasiquote (a (unquote x) (unquote-splicing (list x))))",
+		[]interface{}{twik.Symbol("a"), int64(2), int64(2)},
+	}, {
+		"(var x 2) `(a '(b ,x))",
+		[]interface{}{twik.Symbol("a"), []interface{}{twik.Symbol("quote"), []interface{}{twik.Symbol("b"), int64(2)}}},
+	}, {
+		"(var x 2) `(1 `(2 ,(3 ,x)))",
+		[]interface{}{int64(1), []interface{}{twik.Symbol("quasiquote"), []interface{}{int64(2), []interface{}{twik.Symbol("unquote"), []interface{}{int64(3), int64(2)}}}}},
+	}, {
+		"(var x 1) `{\"k\" ,x}",
+		map[string]interface{}{"k": int64(1)},
+	}, {
+		",x",
+		errorf("twik source:1:1: unquote used outside of quasiquote"),
+	}, {
+		"`,@x",
+		errorf("twik source:1:2: unquote-splicing used outside of a list"),
+	}, {
+		"`(a ,@1)",
+		errorf("twik source:1:5: unquote-splicing takes a list, got 1"),
+	}, {
+		"`{,1 2}",
+		errorf("twik source:1:3: map key must be a string: 1"),
+	},
+
+	// eval
+	{
+		`(eval '(+ 1 2))`,
+		3,
+	}, {
+		`(eval (list '+ 1 (list 'quote 'a)))`,
+		errorf(`twik source:1:7: cannot sum 'a`),
+	}, {
+		`(var x 1) (eval '(set x 2)) x`,
+		2,
+	}, {
+		`(eval)`,
+		errorf("twik source:1:2: eval takes one argument"),
+	},
+
+	// macro
+	{
+		"(macro if-nil (c body) `(if ,c ,body nil)) (list (if-nil true 1) (if-nil false 1))",
+		[]interface{}{int64(1), nil},
+	}, {
+		"(macro inc (x) `(set ,x (+ ,x 1))) (var n 1) (inc n) (inc n) n",
+		3,
+	}, {
+		"(macro m (x) x) (m (+ 1 2))",
+		3,
+	}, {
+		"(func f () (macro m () 1) (m)) (f)",
+		1,
+	}, {
+		"(macro m (x) `(undefined ,x)) (m 1)",
+		errorf("twik source:1:34: undefined symbol: undefined"),
+	}, {
+		"(macro m (x) x) (m)",
+		errorf(`twik source:1:18: function "m" takes one argument`),
+	}, {
+		"(macro m () (error \"boom\")) (m)",
+		errorf(`twik source:1:14: boom`),
+	}, {
+		"(macro m () 1) (macro m () 2)",
+		errorf(`twik source:1:17: symbol already defined in current scope: m`),
+	}, {
+		`(macro)`,
+		errorf("twik source:1:2: macro takes a name, a list of parameters, and a body sequence"),
+	}, {
+		`(macro 1 () 1)`,
+		errorf("twik source:1:2: macro takes a symbol as first argument"),
+	}, {
+		`(macro m 1 1)`,
+		errorf("twik source:1:2: macro takes a list of parameters"),
+	}, {
+		`(macro m (1) 1)`,
+		errorf(`twik source:1:2: macro's parameters must be symbols or \(symbol default\) pairs`),
+	}, {
+		"(macro if-not (c & body) `(if ,c nil (do ,@body))) (list (if-not false 1 2) (if-not true 1))",
+		[]interface{}{int64(2), nil},
+	},
 
 	// calling of custom functions
 	{
 		`(sprintf "Value: %.02f" 1.0)`,
 		"Value: 1.00",
 	},
+
+	// calling of arbitrary Go functions
+	{
+		`(upper "foo")`,
+		"FOO",
+	}, {
+		`(repeat "ab" 3)`,
+		"ababab",
+	}, {
+		`(join (list "a" "b" "c") ",")`,
+		"a,b,c",
+	}, {
+		`(fields " a b  c ")`,
+		[]interface{}{"a", "b", "c"},
+	}, {
+		`(sum 1)`,
+		1,
+	}, {
+		`(sum 1 2 3)`,
+		6,
+	}, {
+		`(quo 7 2)`,
+		3,
+	}, {
+		`(half 3)`,
+		1.5,
+	}, {
+		`(divmod 7 2)`,
+		[]interface{}{int64(3), int64(1)},
+	}, {
+		`(noop)`,
+		nil,
+	}, {
+		`(quo 1 0)`,
+		errorf("twik source:1:2: division by zero"),
+	}, {
+		`(upper)`,
+		errorf(`twik source:1:2: function "strings.ToUpper" takes one argument`),
+	}, {
+		`(repeat "a")`,
+		errorf(`twik source:1:2: function "strings.Repeat" takes 2 arguments`),
+	}, {
+		`(noop 1)`,
+		errorf(`twik source:1:2: function ".*" takes no arguments`),
+	}, {
+		`(sum)`,
+		errorf(`twik source:1:2: function ".*sumFn" takes 1 or more arguments`),
+	}, {
+		`(upper 1)`,
+		errorf(`twik source:1:2: cannot use 1 as string in argument 1 to strings.ToUpper`),
+	}, {
+		`(sum 256)`,
+		errorf(`twik source:1:2: 256 overflows uint8 in argument 1 to .*sumFn`),
+	}, {
+		`(sum -1)`,
+		errorf(`twik source:1:2: -1 overflows uint8 in argument 1 to .*sumFn`),
+	}, {
+		`(sum 1 2.5)`,
+		errorf(`twik source:1:2: cannot use 2.5 as int in argument 2 to .*sumFn`),
+	}, {
+		`(upper nil)`,
+		errorf(`twik source:1:2: cannot use nil as string in argument 1 to strings.ToUpper`),
+	}, {
+		`(join (list "a" 1) ",")`,
+		errorf(`twik source:1:2: cannot use 1 as string in argument 1 to strings.Join`),
+	}, {
+		`(1 (error "must not get here"))`,
+		errorf(`twik source:1:2: cannot use 1 as a function`),
+	},
 }
@@ -0,0 +1,23 @@
+// Package format implements the canonical formatting of twik code.
+package format
+
+import (
+	"bytes"
+
+	"gopkg.in/twik.v1/ast"
+)
+
+// Source formats the twik code in src in canonical form, as done by
+// ast.Fprint, preserving its comments. It fails if src cannot be parsed.
+func Source(src []byte) ([]byte, error) {
+	fset := ast.NewFileSet()
+	root, err := ast.ParseMode(fset, "", string(src), ast.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := ast.Fprint(&buf, fset, root); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
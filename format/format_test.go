@@ -0,0 +1,83 @@
+package format_test
+
+import (
+	"reflect"
+	"testing"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/twik.v1/ast"
+	"gopkg.in/twik.v1/format"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+var _ = Suite(S{})
+
+type S struct{}
+
+func (S) TestSource(c *C) {
+	out, err := format.Source([]byte("; f doubles x\n(func f (x)   (* x 2))\n\n\n(f   2)"))
+	c.Assert(err, IsNil)
+	c.Assert(string(out), Equals, "; f doubles x\n(func f (x) (* x 2))\n\n(f 2)\n")
+}
+
+func (S) TestSourceError(c *C) {
+	out, err := format.Source([]byte("(f 2"))
+	c.Assert(err, ErrorMatches, "twik source:1:5: missing \\)")
+	c.Assert(out, IsNil)
+}
+
+var roundTripTests = []string{
+	"('0 ' ('0))",
+	"(' \"'a\" ' \"\\\"'\")",
+	"'('a 'b)",
+	"'  'a' ''\\''",
+	"`(a ,'b ,@'(c) ,'{\"d\" 1})",
+	"(f '\n  \"'x\")",
+}
+
+func (S) TestSourceRoundTrip(c *C) {
+	for _, code := range roundTripTests {
+		out, err := format.Source([]byte(code))
+		c.Assert(err, IsNil, Commentf("Code: %q", code))
+
+		// The output parses to the same nodes, and formats to itself.
+		c.Assert(parseNodes(c, string(out)), DeepEquals, parseNodes(c, code), Commentf("Code: %q\nOutput: %q", code, out))
+		again, err := format.Source(out)
+		c.Assert(err, IsNil)
+		c.Assert(string(again), Equals, string(out), Commentf("Code: %q", code))
+	}
+}
+
+// parseNodes parses code and returns its nodes with all positions zeroed,
+// so that they may be compared across differently formatted code.
+func parseNodes(c *C, code string) []ast.Node {
+	root, err := ast.ParseString(ast.NewFileSet(), "", code)
+	c.Assert(err, IsNil, Commentf("Code: %q", code))
+	nodes := root.(*ast.Root).Nodes
+	clearPos(reflect.ValueOf(nodes))
+	return nodes
+}
+
+var posType = reflect.TypeOf(ast.Pos(0))
+
+func clearPos(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if !v.IsNil() {
+			clearPos(v.Elem())
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			clearPos(v.Index(i))
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			clearPos(v.Field(i))
+		}
+	default:
+		if v.Type() == posType && v.CanSet() {
+			v.SetInt(0)
+		}
+	}
+}
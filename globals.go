@@ -1,8 +1,13 @@
 package twik
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"math/big"
+	"reflect"
+	"sort"
+	"strings"
 
 	"gopkg.in/twik.v1/ast"
 )
@@ -15,21 +20,53 @@ var defaultGlobals = []struct {
 	{"false", false},
 	{"nil", nil},
 	{"error", errorFn},
+	{"try", tryFn},
+	{"throw", throwFn},
+	{"error-message", errorMessageFn},
+	{"error-position", errorPositionFn},
+	{"error-cause", errorCauseFn},
 	{"==", eqFn},
 	{"!=", neFn},
-	{"+", plusFn},
-	{"-", minusFn},
-	{"*", mulFn},
-	{"/", divFn},
+	{"<", ltFn},
+	{"<=", leFn},
+	{">", gtFn},
+	{">=", geFn},
+	{"get", getFn},
+	{"put", putFn},
+	{"del", delFn},
+	{"keys", keysFn},
+	{"values", valuesFn},
+	{"has", hasFn},
+	{".", dotFn},
+	{"+", builtin(plusFn)},
+	{"-", builtin(minusFn)},
+	{"*", builtin(mulFn)},
+	{"/", builtin(divFn)},
 	{"or", orFn},
 	{"and", andFn},
 	{"if", ifFn},
+	{"cond", condFn},
+	{"switch", switchFn},
+	{"when", whenFn},
+	{"unless", unlessFn},
 	{"var", varFn},
 	{"set", setFn},
 	{"do", doFn},
+	{"let", letFn},
+	{"let*", letStarFn},
 	{"func", funcFn},
+	{"apply", applyFn},
 	{"for", forFn},
 	{"range", rangeFn},
+	{"break", breakFn},
+	{"continue", continueFn},
+	{"return", returnFn},
+	{"quote", quoteFn},
+	{"quasiquote", quasiquoteFn},
+	{"unquote", unquoteFn},
+	{"unquote-splicing", unquoteSplicingFn},
+	{"eval", evalFn},
+	{"macro", macroFn},
 }
 
 func errorFn(args []interface{}) (value interface{}, err error) {
@@ -41,130 +78,365 @@ func errorFn(args []interface{}) (value interface{}, err error) {
 	return nil, errors.New("error function takes a single string argument")
 }
 
+// tryClause returns node as a list if it is a clause of try with
+// the given name, such as (catch err ...) or (finally ...).
+func tryClause(node ast.Node, name string) *ast.List {
+	if list, ok := node.(*ast.List); ok && len(list.Nodes) > 0 {
+		if symbol, ok := list.Nodes[0].(*ast.Symbol); ok && symbol.Name == name {
+			return list
+		}
+	}
+	return nil
+}
+
+// catchable returns whether err may be caught by try. Errors caused by
+// the context being done or by exceeding limits are never caught, so
+// that evaluation is reliably interrupted, and neither are break,
+// continue, and return.
+func catchable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if controlOf(err) != nil {
+		return false
+	}
+	var limit limitError
+	return !errors.As(err, &limit)
+}
+
+func tryFn(scope *Scope, args []ast.Node) (value interface{}, err error) {
+	body := args
+	var catch, finally *ast.List
+	if len(body) > 0 {
+		if finally = tryClause(body[len(body)-1], "finally"); finally != nil {
+			body = body[:len(body)-1]
+		}
+	}
+	if len(body) > 0 {
+		if catch = tryClause(body[len(body)-1], "catch"); catch != nil {
+			body = body[:len(body)-1]
+		}
+	}
+	for _, arg := range body {
+		if tryClause(arg, "catch") != nil || tryClause(arg, "finally") != nil {
+			return nil, errors.New("try takes catch and finally clauses at the end, in that order")
+		}
+	}
+	if len(body) == 0 {
+		return nil, errors.New("try takes a body sequence")
+	}
+	var symbol *ast.Symbol
+	if catch != nil {
+		if len(catch.Nodes) > 1 {
+			symbol, _ = catch.Nodes[1].(*ast.Symbol)
+		}
+		if symbol == nil {
+			return nil, errors.New("catch takes a symbol as first argument")
+		}
+		if isKeyword(symbol.Name) {
+			return nil, fmt.Errorf("catch cannot bind keyword symbol %s", symbol.Name)
+		}
+	}
+	value, err = doFn(scope, body)
+	if err != nil && catch != nil && catchable(err) {
+		cscope := scope.Branch()
+		if err = cscope.Create(symbol.Name, scope.errorAt(body[0], err)); err == nil {
+			value, err = doFn(cscope, catch.Nodes[2:])
+		}
+	}
+	if finally != nil {
+		if _, ferr := doFn(scope, finally.Nodes[1:]); ferr != nil {
+			return nil, ferr
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+func throwFn(args []interface{}) (value interface{}, err error) {
+	if len(args) == 1 {
+		switch arg := args[0].(type) {
+		case error:
+			return nil, arg
+		case string:
+			return nil, errors.New(arg)
+		}
+	}
+	return nil, errors.New("throw takes a single error or string argument")
+}
+
+func errorArg(name string, args []interface{}) (error, error) {
+	if len(args) == 1 {
+		if err, ok := args[0].(error); ok {
+			return err, nil
+		}
+	}
+	return nil, fmt.Errorf("%s takes a single error argument", name)
+}
+
+func errorMessageFn(args []interface{}) (value interface{}, err error) {
+	arg, err := errorArg("error-message", args)
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := arg.(*Error); ok {
+		return e.Err.Error(), nil
+	}
+	return arg.Error(), nil
+}
+
+func errorPositionFn(args []interface{}) (value interface{}, err error) {
+	arg, err := errorArg("error-position", args)
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := arg.(*Error); ok && e.PosInfo != nil {
+		return strings.TrimSuffix(e.PosInfo.String(), ":"), nil
+	}
+	return nil, nil
+}
+
+func errorCauseFn(args []interface{}) (value interface{}, err error) {
+	arg, err := errorArg("error-cause", args)
+	if err != nil {
+		return nil, err
+	}
+	if cause := errors.Unwrap(arg); cause != nil {
+		return cause, nil
+	}
+	return nil, nil
+}
+
+// equal returns whether a and b are equal. Values that cannot be
+// compared with the == operator in Go, such as lists and maps, are
+// equal if their content is deeply equal. Big integers, rationals, and
+// decimals are equal to numbers of the same kind with the same value.
+func equal(a, b interface{}) bool {
+	switch a.(type) {
+	case *big.Int, *big.Rat, *Decimal:
+		return kindOf(a) == kindOf(b) && compareNumbers(a, b) == 0
+	}
+	if a != nil && !reflect.TypeOf(a).Comparable() || b != nil && !reflect.TypeOf(b).Comparable() {
+		return reflect.DeepEqual(a, b)
+	}
+	return a == b
+}
+
 func eqFn(args []interface{}) (value interface{}, err error) {
 	if len(args) != 2 {
 		return nil, errors.New("== takes two values")
 	}
-	return args[0] == args[1], nil
+	return equal(args[0], args[1]), nil
 }
 
 func neFn(args []interface{}) (value interface{}, err error) {
 	if len(args) != 2 {
 		return nil, errors.New("!= takes two values")
 	}
-	return args[0] != args[1], nil
+	return !equal(args[0], args[1]), nil
 }
 
-func plusFn(args []interface{}) (value interface{}, err error) {
-	var resi int64
-	var resf float64
-	var f bool
-	for _, arg := range args {
-		switch arg := arg.(type) {
-		case int64:
-			resi += arg
-			resf += float64(arg)
-		case float64:
-			resf += arg
-			f = true
-		default:
-			return nil, fmt.Errorf("cannot sum %#v", arg)
+// unordered is the result of compare when either value is NaN.
+const unordered = 2
+
+// compare returns -1, 0, or +1 depending on whether a is less than,
+// equal to, or greater than b. Numbers are compared as done by
+// compareNumbers, and strings are compared lexicographically.
+func compare(a, b interface{}) (int, error) {
+	if kindOf(a) != notNumber && kindOf(b) != notNumber {
+		return compareNumbers(a, b), nil
+	}
+	if a, ok := a.(string); ok {
+		if b, ok := b.(string); ok {
+			return strings.Compare(a, b), nil
 		}
 	}
-	if f {
-		return resf, nil
+	return 0, fmt.Errorf("cannot compare %#v with %#v", a, b)
+}
+
+func compareInt(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareFloat(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	case a == b:
+		return 0
+	}
+	return unordered
+}
+
+// orderFn returns a function that reports whether every pair of
+// consecutive arguments compares in a way accepted by ok.
+func orderFn(name string, ok func(c int) bool) func(args []interface{}) (interface{}, error) {
+	return func(args []interface{}) (value interface{}, err error) {
+		if len(args) < 2 {
+			return nil, fmt.Errorf("%s takes two or more values", name)
+		}
+		result := true
+		for i := 1; i < len(args); i++ {
+			c, err := compare(args[i-1], args[i])
+			if err != nil {
+				return nil, err
+			}
+			result = result && ok(c)
+		}
+		return result, nil
 	}
-	return resi, nil
 }
 
-func minusFn(args []interface{}) (value interface{}, err error) {
-	if len(args) == 0 {
-		return nil, fmt.Errorf(`function "-" takes one or more arguments`)
+var (
+	ltFn = orderFn("<", func(c int) bool { return c == -1 })
+	leFn = orderFn("<=", func(c int) bool { return c == -1 || c == 0 })
+	gtFn = orderFn(">", func(c int) bool { return c == 1 })
+	geFn = orderFn(">=", func(c int) bool { return c == 0 || c == 1 })
+)
+
+// sortedKeys returns the keys of m in increasing order.
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func mapKey(arg interface{}) (string, error) {
+	if key, ok := arg.(string); ok {
+		return key, nil
 	}
-	var resi int64
-	var resf float64
-	var f bool
-	for i, arg := range args {
-		switch arg := arg.(type) {
-		case int64:
-			if i == 0 && len(args) > 1 {
-				resi = arg
-				resf = float64(arg)
-			} else {
-				resi -= arg
-				resf -= float64(arg)
+	return "", fmt.Errorf("map key must be a string: %#v", arg)
+}
+
+func getFn(args []interface{}) (value interface{}, err error) {
+	if len(args) == 2 || len(args) == 3 {
+		if m, ok := args[0].(map[string]interface{}); ok {
+			key, err := mapKey(args[1])
+			if err != nil {
+				return nil, err
 			}
-		case float64:
-			if i == 0 && len(args) > 1 {
-				resf = arg
-			} else {
-				resf -= arg
+			if value, ok := m[key]; ok {
+				return value, nil
 			}
-			f = true
-		default:
-			return nil, fmt.Errorf("cannot subtract %#v", arg)
+			if len(args) == 3 {
+				return args[2], nil
+			}
+			return nil, nil
 		}
 	}
-	if f {
-		return resf, nil
-	}
-	return resi, nil
+	return nil, errors.New("get takes a map, a key, and an optional default value")
 }
 
-func mulFn(args []interface{}) (value interface{}, err error) {
-	var resi = int64(1)
-	var resf = float64(1)
-	var f bool
-	for _, arg := range args {
-		switch arg := arg.(type) {
-		case int64:
-			resi *= arg
-			resf *= float64(arg)
-		case float64:
-			resf *= arg
-			f = true
-		default:
-			return nil, fmt.Errorf("cannot multiply %#v", arg)
+func putFn(args []interface{}) (value interface{}, err error) {
+	if len(args) >= 3 && len(args)%2 == 1 {
+		if m, ok := args[0].(map[string]interface{}); ok && m != nil {
+			for i := 1; i < len(args); i += 2 {
+				key, err := mapKey(args[i])
+				if err != nil {
+					return nil, err
+				}
+				m[key] = args[i+1]
+			}
+			return m, nil
 		}
 	}
-	if f {
-		return resf, nil
+	return nil, errors.New("put takes a map followed by key and value pairs")
+}
+
+func delFn(args []interface{}) (value interface{}, err error) {
+	if len(args) > 0 {
+		if m, ok := args[0].(map[string]interface{}); ok {
+			for _, arg := range args[1:] {
+				key, err := mapKey(arg)
+				if err != nil {
+					return nil, err
+				}
+				delete(m, key)
+			}
+			return m, nil
+		}
 	}
-	return resi, nil
+	return nil, errors.New("del takes a map followed by keys")
 }
 
-func divFn(args []interface{}) (value interface{}, err error) {
-	if len(args) < 2 {
-		return nil, fmt.Errorf(`function "/" takes two or more arguments`)
+func keysFn(args []interface{}) (value interface{}, err error) {
+	if len(args) == 1 {
+		if m, ok := args[0].(map[string]interface{}); ok {
+			keys := sortedKeys(m)
+			list := make([]interface{}, len(keys))
+			for i, key := range keys {
+				list[i] = key
+			}
+			return list, nil
+		}
 	}
-	var resi int64
-	var resf float64
-	var f bool
-	for i, arg := range args {
-		switch arg := arg.(type) {
-		case int64:
-			if i == 0 && len(args) > 1 {
-				resi = arg
-				resf = float64(arg)
-			} else {
-				resi /= arg
-				resf /= float64(arg)
+	return nil, errors.New("keys takes a single map argument")
+}
+
+func valuesFn(args []interface{}) (value interface{}, err error) {
+	if len(args) == 1 {
+		if m, ok := args[0].(map[string]interface{}); ok {
+			keys := sortedKeys(m)
+			list := make([]interface{}, len(keys))
+			for i, key := range keys {
+				list[i] = m[key]
 			}
-		case float64:
-			if i == 0 && len(args) > 1 {
-				resf = float64(arg)
-			} else {
-				resf /= arg
+			return list, nil
+		}
+	}
+	return nil, errors.New("values takes a single map argument")
+}
+
+func hasFn(args []interface{}) (value interface{}, err error) {
+	if len(args) == 2 {
+		if m, ok := args[0].(map[string]interface{}); ok {
+			key, err := mapKey(args[1])
+			if err != nil {
+				return nil, err
 			}
-			f = true
-		default:
-			return nil, fmt.Errorf("cannot divide with %#v", arg)
+			_, ok := m[key]
+			return ok, nil
 		}
 	}
-	if f {
-		return resf, nil
+	return nil, errors.New("has takes a map and a key")
+}
+
+func plusFn(st *state, args []interface{}) (value interface{}, err error) {
+	return st.arith(addOp, append([]interface{}{int64(0)}, args...))
+}
+
+func minusFn(st *state, args []interface{}) (value interface{}, err error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf(`function "-" takes one or more arguments`)
+	}
+	if len(args) == 1 {
+		args = []interface{}{int64(0), args[0]}
+	}
+	return st.arith(subOp, args)
+}
+
+func mulFn(st *state, args []interface{}) (value interface{}, err error) {
+	return st.arith(mulOp, append([]interface{}{int64(1)}, args...))
+}
+
+func divFn(st *state, args []interface{}) (value interface{}, err error) {
+	if len(args) < 2 {
+		return nil, fmt.Errorf(`function "/" takes two or more arguments`)
 	}
-	return resi, nil
+	return st.arith(divOp, args)
 }
 
 func andFn(scope *Scope, args []ast.Node) (value interface{}, err error) {
@@ -247,7 +519,7 @@ func setFn(scope *Scope, args []ast.Node) (value interface{}, err error) {
 	if err != nil {
 		return nil, err
 	}
-	return nil, scope.Set(symbol.Name, value)
+	return nil, scope.assign(symbol.Name, value)
 }
 
 func doFn(scope *Scope, args []ast.Node) (value interface{}, err error) {
@@ -275,52 +547,74 @@ func funcFn(scope *Scope, args []ast.Node) (value interface{}, err error) {
 	if !ok {
 		return nil, errors.New(`func takes a list of parameters`)
 	}
-	params := list.Nodes
-	for _, param := range params {
-		if _, ok := param.(*ast.Symbol); !ok {
-			return nil, errors.New("func's list of parameters must be a list of symbols")
-		}
+	sig, err := parseSignature("func", list)
+	if err != nil {
+		return nil, err
 	}
 	body := args[i+1:]
 	if len(body) == 0 {
 		return nil, fmt.Errorf("func takes a body sequence")
 	}
-	fn := func(args []interface{}) (value interface{}, err error) {
-		if len(args) != len(params) {
-			nameInfo := "anonymous function"
-			if name != "" {
-				nameInfo = fmt.Sprintf("function %q", name)
-			}
-			switch len(params) {
-			case 0:
-				return nil, fmt.Errorf("%s takes no arguments", nameInfo)
-			case 1:
-				return nil, fmt.Errorf("%s takes one argument", nameInfo)
-			default:
-				return nil, fmt.Errorf("%s takes %d arguments", nameInfo, len(params))
-			}
+	fn := scope.closure(name, sig, body)
+	if name != "" {
+		if err = scope.Create(name, fn); err != nil {
+			return nil, err
 		}
-		scope = scope.Branch()
+	}
+	return fn, nil
+}
+
+// closure returns a function defined with func with the given name,
+// signature, and body, which is evaluated in a branch of s.
+func (s *Scope) closure(name string, sig *signature, body []ast.Node) *Function {
+	return s.shared().function(name, sig, func(args []interface{}) (value interface{}, next *tailCall, err error) {
+		scope := s.Branch()
 		for i, arg := range args {
-			err := scope.Create(params[i].(*ast.Symbol).Name, arg)
+			if arg == undefined {
+				arg = nil
+				if def := sig.defaults[i]; def != nil {
+					if arg, err = scope.Eval(def); err != nil {
+						return nil, nil, err
+					}
+				}
+			}
+			err := scope.Create(sig.names[i], arg)
 			if err != nil {
 				panic("must not happen: " + err.Error())
 			}
 		}
-		for _, node := range body {
-			value, err = scope.Eval(node)
-			if err != nil {
-				return nil, err
+		last := len(body) - 1
+		for _, node := range body[:last] {
+			if _, err = scope.Eval(node); err != nil {
+				return nil, nil, err
 			}
 		}
-		return value, nil
+		return scope.tail(body[last])
+	})
+}
+
+var errApply = errors.New("apply takes a function, optional arguments, and a list of further arguments")
+
+// applyFn calls a function with the given arguments followed by the
+// elements of the list in the last argument, as in (apply f 1 rest).
+func applyFn(scope *Scope, args []ast.Node) (value interface{}, err error) {
+	if len(args) < 2 {
+		return nil, errApply
 	}
-	if name != "" {
-		if err = scope.Create(name, fn); err != nil {
+	values := make([]interface{}, len(args))
+	for i, arg := range args {
+		if values[i], err = scope.Eval(arg); err != nil {
 			return nil, err
 		}
 	}
-	return fn, nil
+	list, ok := values[len(values)-1].([]interface{})
+	if !ok {
+		return nil, errApply
+	}
+	vargs := make([]interface{}, 0, len(values)-2+len(list))
+	vargs = append(vargs, values[1:len(values)-1]...)
+	vargs = append(vargs, list...)
+	return scope.shared().apply(values[0], vargs)
 }
 
 func forFn(scope *Scope, args []ast.Node) (value interface{}, err error) {
@@ -334,6 +628,9 @@ func forFn(scope *Scope, args []ast.Node) (value interface{}, err error) {
 		return nil, err
 	}
 	for {
+		if err := scope.shared().checkContext(); err != nil {
+			return nil, err
+		}
 		more, err := scope.Eval(test)
 		if err != nil {
 			return nil, err
@@ -345,7 +642,11 @@ func forFn(scope *Scope, args []ast.Node) (value interface{}, err error) {
 		for _, c := range code {
 			value, err = scope.Eval(c)
 			if err != nil {
-				return nil, err
+				var exit bool
+				if exit, value, err = loopExit(err); exit {
+					return value, err
+				}
+				break
 			}
 		}
 
@@ -354,26 +655,18 @@ func forFn(scope *Scope, args []ast.Node) (value interface{}, err error) {
 			return nil, err
 		}
 	}
-	panic("unreachable")
 }
 
+// rangeFn iterates over an integer, a list, or a map. The index bound
+// when iterating over a list is an int64, as are all other integers, so
+// Go functions handed the index receive an int64 rather than an int.
 func rangeFn(scope *Scope, args []ast.Node) (value interface{}, err error) {
 	if len(args) < 3 {
 		return nil, errors.New(`range takes three or more arguments`)
 	}
-	var iname, ename string
-	if symbol, ok := args[0].(*ast.Symbol); ok {
-		iname = symbol.Name
-	} else if list, ok := args[0].(*ast.List); ok && len(list.Nodes) == 2 {
-		symbol1, ok1 := list.Nodes[0].(*ast.Symbol)
-		symbol2, ok2 := list.Nodes[1].(*ast.Symbol)
-		if ok1 && ok2 {
-			iname = symbol1.Name
-			ename = symbol2.Name
-		}
-	}
-	if iname == "" {
-		return nil, errors.New(`range takes var name or (i elem) var name pair as first argument`)
+	iname, ename, err := rangeNames(args[0])
+	if err != nil {
+		return nil, err
 	}
 	scope = scope.Branch()
 	value, err = scope.Eval(args[1])
@@ -382,32 +675,68 @@ func rangeFn(scope *Scope, args []ast.Node) (value interface{}, err error) {
 	}
 	code := args[2:]
 	if n, ok := value.(int64); ok {
-		scope.Create(iname, 0)
+		scope.Create(iname, int64(0))
 		for i := int64(0); i < n; i++ {
+			if err := scope.shared().checkContext(); err != nil {
+				return nil, err
+			}
 			scope.Set(iname, i)
 			for _, c := range code {
 				value, err = scope.Eval(c)
 				if err != nil {
-					return nil, err
+					var exit bool
+					if exit, value, err = loopExit(err); exit {
+						return value, err
+					}
+					break
+				}
+			}
+		}
+		return value, nil
+	}
+	if m, ok := value.(map[string]interface{}); ok {
+		scope.Create(iname, "")
+		scope.Create(ename, nil)
+		for _, k := range sortedKeys(m) {
+			if err := scope.shared().checkContext(); err != nil {
+				return nil, err
+			}
+			scope.Set(iname, k)
+			scope.Set(ename, m[k])
+			for _, c := range code {
+				value, err = scope.Eval(c)
+				if err != nil {
+					var exit bool
+					if exit, value, err = loopExit(err); exit {
+						return value, err
+					}
+					break
 				}
 			}
 		}
 		return value, nil
 	}
 	if list, ok := value.([]interface{}); ok {
-		scope.Create(iname, 0)
+		scope.Create(iname, int64(0))
 		scope.Create(ename, nil)
 		for i, e := range list {
-			scope.Set(iname, i)
+			if err := scope.shared().checkContext(); err != nil {
+				return nil, err
+			}
+			scope.Set(iname, int64(i))
 			scope.Set(ename, e)
 			for _, c := range code {
 				value, err = scope.Eval(c)
 				if err != nil {
-					return nil, err
+					var exit bool
+					if exit, value, err = loopExit(err); exit {
+						return value, err
+					}
+					break
 				}
 			}
 		}
 		return value, nil
 	}
-	return nil, errors.New(`range takes an integer or a list as second argument`)
+	return nil, errors.New(`range takes an integer, a list, or a map as second argument`)
 }
@@ -0,0 +1,174 @@
+package twik
+
+import (
+	"errors"
+	"fmt"
+
+	"gopkg.in/twik.v1/ast"
+)
+
+// binding holds a (name value) pair of the let and let* special forms.
+// The name may also be a list of names, as in ((a b) value), in which
+// case the value must be a list holding as many elements, which are
+// bound to the respective names.
+type binding struct {
+	target ast.Node
+	names  []string
+	list   bool
+	value  ast.Node
+}
+
+// parseLet parses the arguments of the let special form, or of the let*
+// special form if form is "let*", as in (let ((a 1) ((b c) pair)) body...).
+// The bindings are returned in groups. The values of a group are all
+// evaluated before a new block holding the names they bind is entered,
+// so let has a single group, while let* has a group per binding.
+func parseLet(form string, args []ast.Node) (groups [][]binding, body []ast.Node, err error) {
+	if len(args) < 2 {
+		return nil, nil, fmt.Errorf("%s takes a list of bindings and a body sequence", form)
+	}
+	list, ok := args[0].(*ast.List)
+	if !ok {
+		return nil, nil, fmt.Errorf("%s takes a list of bindings and a body sequence", form)
+	}
+	bindings := make([]binding, len(list.Nodes))
+	seen := make(map[string]bool)
+	for i, node := range list.Nodes {
+		pair, ok := node.(*ast.List)
+		if !ok || len(pair.Nodes) != 2 {
+			return nil, nil, fmt.Errorf("%s's bindings must be (name value) or ((name...) value) pairs", form)
+		}
+		names, ok := bindingNames(pair.Nodes[0])
+		if !ok {
+			return nil, nil, fmt.Errorf("%s's bindings must be (name value) or ((name...) value) pairs", form)
+		}
+		if form == "let*" {
+			seen = make(map[string]bool)
+		}
+		for _, name := range names {
+			if isKeyword(name) {
+				return nil, nil, fmt.Errorf("%s cannot bind keyword symbol %s", form, name)
+			}
+			if seen[name] {
+				return nil, nil, fmt.Errorf("%s has duplicated name %s", form, name)
+			}
+			seen[name] = true
+		}
+		_, isList := pair.Nodes[0].(*ast.List)
+		bindings[i] = binding{pair.Nodes[0], names, isList, pair.Nodes[1]}
+	}
+	if form == "let" || len(bindings) == 0 {
+		return [][]binding{bindings}, args[1:], nil
+	}
+	groups = make([][]binding, len(bindings))
+	for i := range bindings {
+		groups[i] = bindings[i : i+1]
+	}
+	return groups, args[1:], nil
+}
+
+// bindingNames returns the names in node, which is either a symbol or a
+// non-empty list of symbols, as in the (i elem) pair taken by range.
+func bindingNames(node ast.Node) (names []string, ok bool) {
+	switch node := node.(type) {
+	case *ast.Symbol:
+		return []string{node.Name}, true
+	case *ast.List:
+		for _, n := range node.Nodes {
+			symbol, ok := n.(*ast.Symbol)
+			if !ok {
+				return nil, false
+			}
+			names = append(names, symbol.Name)
+		}
+		return names, len(names) > 0
+	}
+	return nil, false
+}
+
+// rangeNames returns the names bound by range, which takes either a var
+// name or an (i elem) var name pair.
+func rangeNames(node ast.Node) (iname, ename string, err error) {
+	names, ok := bindingNames(node)
+	_, pair := node.(*ast.List)
+	if !ok || pair && len(names) != 2 {
+		return "", "", errors.New(`range takes var name or (i elem) var name pair as first argument`)
+	}
+	if pair {
+		return names[0], names[1], nil
+	}
+	return names[0], "", nil
+}
+
+// values returns the values bound to the names of b given the value of
+// the binding.
+func (b *binding) values(value interface{}) ([]interface{}, error) {
+	if !b.list {
+		return []interface{}{value}, nil
+	}
+	return destructure(value, len(b.names))
+}
+
+// destructure returns the elements of value, which must be a list of
+// n elements.
+func destructure(value interface{}, n int) ([]interface{}, error) {
+	list, ok := value.([]interface{})
+	if !ok || len(list) != n {
+		return nil, fmt.Errorf("cannot destructure %#v as a list of length %d", value, n)
+	}
+	return list, nil
+}
+
+func letFn(scope *Scope, args []ast.Node) (value interface{}, err error) {
+	return scope.let("let", args)
+}
+
+func letStarFn(scope *Scope, args []ast.Node) (value interface{}, err error) {
+	return scope.let("let*", args)
+}
+
+// let evaluates the let special form, or the let* special form if form
+// is "let*".
+func (s *Scope) let(form string, args []ast.Node) (value interface{}, err error) {
+	s, body, err := s.letScope(form, args)
+	if err != nil {
+		return nil, err
+	}
+	for _, node := range body {
+		if value, err = s.Eval(node); err != nil {
+			return nil, err
+		}
+	}
+	return value, nil
+}
+
+// letScope binds the names of the let special form, or of the let*
+// special form if form is "let*", and returns the scope holding them
+// together with the body sequence to be evaluated in it.
+func (s *Scope) letScope(form string, args []ast.Node) (scope *Scope, body []ast.Node, err error) {
+	groups, body, err := parseLet(form, args)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, group := range groups {
+		values := make([][]interface{}, len(group))
+		for i := range group {
+			value, err := s.Eval(group[i].value)
+			if err != nil {
+				return nil, nil, err
+			}
+			if values[i], err = group[i].values(value); err != nil {
+				return nil, nil, s.errorAt(group[i].target, err)
+			}
+		}
+		s = s.Branch()
+		for i := range group {
+			for j, name := range group[i].names {
+				if err := s.Create(name, values[i][j]); err != nil {
+					return nil, nil, s.errorAt(group[i].target, err)
+				}
+			}
+		}
+	}
+	return s, body, nil
+}
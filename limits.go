@@ -0,0 +1,179 @@
+package twik
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+)
+
+// Limits holds resource limits enforced while evaluating logic, so that
+// untrusted code may be evaluated safely. A zero value in any of the
+// fields means the respective resource is not limited.
+type Limits struct {
+	// MaxSteps limits the number of lists evaluated, including both
+	// function calls and special forms, in a single evaluation.
+	MaxSteps int64
+
+	// MaxDepth limits the depth of nested calls to functions defined
+	// with func, macro expansions, and evaluations with eval. Calls in
+	// tail position of functions defined with func do not nest.
+	MaxDepth int
+
+	// MaxListLen limits the length of lists and maps returned by functions
+	// and special forms.
+	MaxListLen int
+
+	// MaxStringLen limits the size in bytes of strings returned by
+	// functions and special forms.
+	MaxStringLen int
+
+	// MaxNumberBits limits the size in bits of big integers, of the
+	// numerator and denominator of rationals together, and of the
+	// unscaled value of decimals returned by functions and special forms.
+	// Functions such as pow that may produce very large numbers check
+	// the estimated size of their result before computing it.
+	MaxNumberBits int
+}
+
+// SetLimits sets the limits enforced when evaluating logic in the s scope,
+// in scopes branched from it, and in functions defined within them.
+func (s *Scope) SetLimits(limits Limits) {
+	s.shared().limits = limits
+}
+
+// limitError is implemented by the errors reported when exceeding
+// limits, which try never catches.
+type limitError interface {
+	error
+	limitError()
+}
+
+// StepLimitError is reported when an evaluation exceeds Limits.MaxSteps.
+type StepLimitError struct {
+	Limit int64
+}
+
+func (e *StepLimitError) Error() string {
+	return fmt.Sprintf("evaluation exceeded the limit of %d steps", e.Limit)
+}
+
+func (e *StepLimitError) limitError() {}
+
+// DepthLimitError is reported when an evaluation exceeds Limits.MaxDepth.
+type DepthLimitError struct {
+	Limit int
+}
+
+func (e *DepthLimitError) Error() string {
+	return fmt.Sprintf("function calls exceeded the depth limit of %d", e.Limit)
+}
+
+func (e *DepthLimitError) limitError() {}
+
+// ListLimitError is reported when a function returns a list or map
+// longer than Limits.MaxListLen.
+type ListLimitError struct {
+	Limit int
+	Len   int
+}
+
+func (e *ListLimitError) Error() string {
+	return fmt.Sprintf("list of length %d exceeds the limit of %d", e.Len, e.Limit)
+}
+
+func (e *ListLimitError) limitError() {}
+
+// StringLimitError is reported when a function returns a string longer
+// than Limits.MaxStringLen.
+type StringLimitError struct {
+	Limit int
+	Len   int
+}
+
+func (e *StringLimitError) Error() string {
+	return fmt.Sprintf("string of size %d exceeds the limit of %d", e.Len, e.Limit)
+}
+
+func (e *StringLimitError) limitError() {}
+
+// NumberLimitError is reported when a function returns or would return a
+// number larger than Limits.MaxNumberBits.
+type NumberLimitError struct {
+	Limit int
+	Bits  int64
+}
+
+func (e *NumberLimitError) Error() string {
+	return fmt.Sprintf("number of %d bits exceeds the limit of %d bits", e.Bits, e.Limit)
+}
+
+func (e *NumberLimitError) limitError() {}
+
+// step accounts for the evaluation of a list.
+func (st *state) step() error {
+	if st.limits.MaxSteps > 0 {
+		st.steps++
+		if st.steps > st.limits.MaxSteps {
+			return &StepLimitError{st.limits.MaxSteps}
+		}
+	}
+	return nil
+}
+
+// enter accounts for entering a function call. It must be paired with
+// leave when it succeeds.
+func (st *state) enter() error {
+	if st.limits.MaxDepth > 0 && st.depth >= st.limits.MaxDepth {
+		return &DepthLimitError{st.limits.MaxDepth}
+	}
+	st.depth++
+	return nil
+}
+
+// leave accounts for leaving a function call.
+func (st *state) leave() {
+	st.depth--
+}
+
+// checkValue checks that value respects the size limits.
+func (st *state) checkValue(value interface{}) error {
+	switch value := value.(type) {
+	case []interface{}:
+		if st.limits.MaxListLen > 0 && len(value) > st.limits.MaxListLen {
+			return &ListLimitError{st.limits.MaxListLen, len(value)}
+		}
+	case map[string]interface{}:
+		if st.limits.MaxListLen > 0 && len(value) > st.limits.MaxListLen {
+			return &ListLimitError{st.limits.MaxListLen, len(value)}
+		}
+	case string:
+		if st.limits.MaxStringLen > 0 && len(value) > st.limits.MaxStringLen {
+			return &StringLimitError{st.limits.MaxStringLen, len(value)}
+		}
+	case *big.Int:
+		return st.checkBits(int64(value.BitLen()))
+	case *big.Rat:
+		return st.checkBits(int64(value.Num().BitLen()) + int64(value.Denom().BitLen()))
+	case *Decimal:
+		return st.checkBits(int64(value.Unscaled.BitLen()))
+	}
+	return nil
+}
+
+// checkBits checks that a number of the given size in bits respects the
+// size limits, usually before it is computed.
+func (st *state) checkBits(bits int64) error {
+	if st.limits.MaxNumberBits > 0 && bits > int64(st.limits.MaxNumberBits) {
+		return &NumberLimitError{st.limits.MaxNumberBits, bits}
+	}
+	return nil
+}
+
+// powBits returns the estimated size in bits of a number with the given
+// size raised to the power of n, saturating instead of overflowing.
+func powBits(bits int, n int64) int64 {
+	if bits > 0 && n > math.MaxInt64/int64(bits) {
+		return math.MaxInt64
+	}
+	return int64(bits) * n
+}
@@ -0,0 +1,201 @@
+package twik_test
+
+import (
+	"errors"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/twik.v1"
+)
+
+var limitsList = []struct {
+	limits twik.Limits
+	code   string
+	value  interface{}
+	err    error
+}{{
+	twik.Limits{MaxDepth: 10},
+	`(func f (n) (+ 1 (f (+ n 1)))) (f 0)`,
+	errorf("twik source:1:19: function calls exceeded the depth limit of 10"),
+	&twik.DepthLimitError{},
+}, {
+	twik.Limits{MaxDepth: 10},
+	`(func f (n) (+ 1 (f (+ n 1)))) (try (f 0) (catch e 1))`,
+	errorf("twik source:1:19: function calls exceeded the depth limit of 10"),
+	&twik.DepthLimitError{},
+}, {
+	twik.Limits{MaxDepth: 10},
+	`(func f (n) (if (== n 0) 0 (+ 0 (f (- n 1))))) (f 9)`,
+	0,
+	nil,
+}, {
+	twik.Limits{MaxDepth: 10},
+	`(func f (n) (if (== n 0) 0 (f (- n 1)))) (f 1000)`,
+	0,
+	nil,
+}, {
+	twik.Limits{MaxDepth: 10},
+	`(func f (n) (cond ((== n 0) 0) (else (f (- n 1))))) (f 1000)`,
+	0,
+	nil,
+}, {
+	twik.Limits{MaxDepth: 10},
+	`(func f (n) (switch n (case 0 0) (else (var m (- n 1)) (f m)))) (f 1000)`,
+	0,
+	nil,
+}, {
+	twik.Limits{MaxDepth: 10},
+	`(func f (n) (unless (== n 0) (f (- n 1)))) (f 1000)`,
+	false,
+	nil,
+}, {
+	twik.Limits{MaxDepth: 10},
+	`(func f (n) (let* ((m (- n 1))) (if (== n 0) 0 (f m)))) (f 1000)`,
+	0,
+	nil,
+}, {
+	twik.Limits{MaxDepth: 10},
+	`(macro m () (quote (m))) (m)`,
+	errorf("twik source:1:\\d+: function calls exceeded the depth limit of 10"),
+	&twik.DepthLimitError{},
+}, {
+	twik.Limits{MaxDepth: 10},
+	`(var c (quote (eval c))) (eval c)`,
+	errorf("twik source:1:\\d+: function calls exceeded the depth limit of 10"),
+	&twik.DepthLimitError{},
+}, {
+	twik.Limits{MaxSteps: 1000},
+	`(func f (n) (f (+ n 1))) (f 0)`,
+	errorf("twik source:1:\\d+: evaluation exceeded the limit of 1000 steps"),
+	&twik.StepLimitError{},
+}, {
+	twik.Limits{MaxSteps: 100},
+	"(var x 0)\n(for () true () (set x (+ x 1)))",
+	errorf("twik source:2:\\d+: evaluation exceeded the limit of 100 steps"),
+	&twik.StepLimitError{},
+}, {
+	twik.Limits{MaxSteps: 4},
+	`(+ 1 (+ 2 (+ 3 (+ 4))))`,
+	10,
+	nil,
+}, {
+	twik.Limits{MaxSteps: 4},
+	`(+ 1 (+ 2 (+ 3 (+ 4 (+ 5)))))`,
+	errorf("twik source:1:22: evaluation exceeded the limit of 4 steps"),
+	&twik.StepLimitError{},
+}, {
+	twik.Limits{MaxListLen: 3},
+	`(list 1 2 3)`,
+	[]interface{}{int64(1), int64(2), int64(3)},
+	nil,
+}, {
+	twik.Limits{MaxListLen: 3},
+	`(append (list 1 2 3) 4)`,
+	errorf("twik source:1:2: list of length 4 exceeds the limit of 3"),
+	&twik.ListLimitError{},
+}, {
+	twik.Limits{MaxListLen: 1},
+	`(put {} "a" 1 "b" 2)`,
+	errorf("twik source:1:2: list of length 2 exceeds the limit of 1"),
+	&twik.ListLimitError{},
+}, {
+	twik.Limits{MaxListLen: 10},
+	`(var x (list 1)) (range i 5 (set x (quasiquote ((unquote-splicing x) (unquote-splicing x))))) x`,
+	errorf("twik source:1:\\d+: list of length 16 exceeds the limit of 10"),
+	&twik.ListLimitError{},
+}, {
+	twik.Limits{MaxNumberBits: 64},
+	`(list (== (pow 1.5m 2) 2.25m) (== (pow 2/3 3) 8/27))`,
+	[]interface{}{true, true},
+	nil,
+}, {
+	twik.Limits{MaxNumberBits: 64},
+	`(pow 7m 30000000)`,
+	errorf("twik source:1:2: number of 90000000 bits exceeds the limit of 64 bits"),
+	&twik.NumberLimitError{},
+}, {
+	twik.Limits{MaxNumberBits: 64},
+	`(pow 2/3 100)`,
+	errorf("twik source:1:2: number of 400 bits exceeds the limit of 64 bits"),
+	&twik.NumberLimitError{},
+}, {
+	twik.Limits{MaxNumberBits: 64},
+	`(* 99999999999999999999 10)`,
+	errorf("twik source:1:2: number of 70 bits exceeds the limit of 64 bits"),
+	&twik.NumberLimitError{},
+}, {
+	twik.Limits{MaxNumberBits: 64},
+	`(shift-left 99999999999999999999 2000000000)`,
+	errorf("twik source:1:2: number of 2000000067 bits exceeds the limit of 64 bits"),
+	&twik.NumberLimitError{},
+}, {
+	twik.Limits{MaxNumberBits: 64},
+	`(pow 99999999999999999999 30000000)`,
+	errorf("twik source:1:2: number of 2010000000 bits exceeds the limit of 64 bits"),
+	&twik.NumberLimitError{},
+}, {
+	twik.Limits{MaxNumberBits: 64},
+	`(try (pow 99999999999999999999 1000) (catch e 0))`,
+	errorf("twik source:1:7: number of 67000 bits exceeds the limit of 64 bits"),
+	&twik.NumberLimitError{},
+}, {
+	twik.Limits{MaxStringLen: 4},
+	`(repeat "ab" 2)`,
+	"abab",
+	nil,
+}, {
+	twik.Limits{MaxStringLen: 4},
+	`(upper (repeat "ab" 3))`,
+	errorf("twik source:1:9: string of size 6 exceeds the limit of 4"),
+	&twik.StringLimitError{},
+}}
+
+func (S) TestLimits(c *C) {
+	for _, test := range limitsList {
+		fset := twik.NewFileSet()
+		node, err := twik.ParseString(fset, "", test.code)
+		c.Assert(err, IsNil)
+		prog, err := twik.Compile(fset, node)
+		c.Assert(err, IsNil)
+		bc, err := twik.CompileBytecode(fset, node)
+		c.Assert(err, IsNil)
+		for _, run := range []func(*twik.Scope) (interface{}, error){
+			func(scope *twik.Scope) (interface{}, error) { return scope.Eval(node) },
+			prog.Run,
+			bc.Run,
+		} {
+			scope := newScope(fset)
+			c.Assert(scope.Use(twik.Math), IsNil)
+			scope.SetLimits(test.limits)
+			value, err := run(scope)
+			checkEval(c, test.code, test.value, value, err)
+			switch target := test.err.(type) {
+			case *twik.DepthLimitError:
+				c.Assert(errors.As(err, &target), Equals, true)
+			case *twik.StepLimitError:
+				c.Assert(errors.As(err, &target), Equals, true)
+			case *twik.ListLimitError:
+				c.Assert(errors.As(err, &target), Equals, true)
+			case *twik.StringLimitError:
+				c.Assert(errors.As(err, &target), Equals, true)
+			case *twik.NumberLimitError:
+				c.Assert(errors.As(err, &target), Equals, true)
+			}
+		}
+	}
+}
+
+func (S) TestLimitsPerEvaluation(c *C) {
+	fset := twik.NewFileSet()
+	node, err := twik.ParseString(fset, "", `(+ 1 (+ 2 (+ 3)))`)
+	c.Assert(err, IsNil)
+	scope := twik.NewScope(fset)
+	scope.SetLimits(twik.Limits{MaxSteps: 3})
+	for i := 0; i < 3; i++ {
+		value, err := scope.Eval(node)
+		c.Assert(err, IsNil)
+		c.Assert(value, Equals, int64(6))
+	}
+	scope.SetLimits(twik.Limits{MaxSteps: 2})
+	_, err = scope.Branch().Eval(node)
+	c.Assert(err, ErrorMatches, "twik source:1:12: evaluation exceeded the limit of 2 steps")
+}
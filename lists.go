@@ -0,0 +1,274 @@
+package twik
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Lists is a module of functions for handling lists:
+//
+//	(list x...)               a list holding the values
+//	(append list x...)        a list holding the elements of list
+//	                          followed by the values
+//	(len x)                   the number of elements in a list or map
+//	(nth list i)              the element of list at index i
+//	(first list)              the first element of list, or nil if empty
+//	(rest list)               the elements of list after the first one
+//	(slice list start [end])  the elements of list from start up to end
+//	(concat list...)          the elements of the lists in order
+//	(reverse list)            the elements of list in reverse order
+//	(sort list [less])        the elements of list in ascending order,
+//	                          or in the order defined by (less a b)
+//	(map f list)              the results of (f elem) for each element
+//	(filter f list)           the elements for which (f elem) isn't false
+//	(reduce f init list)      the result of (f acc elem) for each element,
+//	                          with acc holding the previous result or init
+//	(any f list)              whether (f elem) isn't false for any element
+//	(all f list)              whether (f elem) isn't false for every element
+//
+// The functions taken may be defined with func or be Go functions, and
+// the standard apply calls them with the arguments in a list. Lists
+// are never modified. The resulting lists are new ones instead.
+var Lists = &Module{[]moduleSymbol{
+	{"list", listFn},
+	{"append", appendFn},
+	{"len", lenFn},
+	{"nth", nthFn},
+	{"first", firstFn},
+	{"rest", restFn},
+	{"slice", sliceFn},
+	{"concat", concatFn},
+	{"reverse", reverseFn},
+	{"sort", builtin(sortFn)},
+	{"map", builtin(mapFn)},
+	{"filter", builtin(filterFn)},
+	{"reduce", builtin(reduceFn)},
+	{"any", builtin(anyFn)},
+	{"all", builtin(allFn)},
+}}
+
+func listFn(args []interface{}) (value interface{}, err error) {
+	return append([]interface{}{}, args...), nil
+}
+
+func appendFn(args []interface{}) (value interface{}, err error) {
+	if len(args) > 0 {
+		if list, ok := args[0].([]interface{}); ok {
+			result := make([]interface{}, 0, len(list)+len(args)-1)
+			return append(append(result, list...), args[1:]...), nil
+		}
+	}
+	return nil, errors.New("append takes a list and the values to append")
+}
+
+func lenFn(args []interface{}) (value interface{}, err error) {
+	if len(args) == 1 {
+		switch x := args[0].(type) {
+		case []interface{}:
+			return int64(len(x)), nil
+		case map[string]interface{}:
+			return int64(len(x)), nil
+		}
+	}
+	return nil, errors.New("len takes a single list or map argument")
+}
+
+func nthFn(args []interface{}) (value interface{}, err error) {
+	if len(args) == 2 {
+		list, ok1 := args[0].([]interface{})
+		i, ok2 := args[1].(int64)
+		if ok1 && ok2 {
+			if i < 0 || i >= int64(len(list)) {
+				return nil, fmt.Errorf("nth index %d is out of bounds for list of length %d", i, len(list))
+			}
+			return list[i], nil
+		}
+	}
+	return nil, errors.New("nth takes a list and an index")
+}
+
+func firstFn(args []interface{}) (value interface{}, err error) {
+	if len(args) == 1 {
+		if list, ok := args[0].([]interface{}); ok {
+			if len(list) == 0 {
+				return nil, nil
+			}
+			return list[0], nil
+		}
+	}
+	return nil, errors.New("first takes a single list argument")
+}
+
+func restFn(args []interface{}) (value interface{}, err error) {
+	if len(args) == 1 {
+		if list, ok := args[0].([]interface{}); ok {
+			if len(list) == 0 {
+				return []interface{}{}, nil
+			}
+			return append([]interface{}{}, list[1:]...), nil
+		}
+	}
+	return nil, errors.New("rest takes a single list argument")
+}
+
+func sliceFn(args []interface{}) (value interface{}, err error) {
+	if len(args) == 2 || len(args) == 3 {
+		list, ok1 := args[0].([]interface{})
+		start, ok2 := args[1].(int64)
+		end, ok3 := int64(len(list)), true
+		if len(args) == 3 {
+			end, ok3 = args[2].(int64)
+		}
+		if ok1 && ok2 && ok3 {
+			if start < 0 || start > end || end > int64(len(list)) {
+				return nil, fmt.Errorf("slice range %d to %d is out of bounds for list of length %d", start, end, len(list))
+			}
+			return append([]interface{}{}, list[start:end]...), nil
+		}
+	}
+	return nil, errors.New("slice takes a list, a start index, and an optional end index")
+}
+
+func concatFn(args []interface{}) (value interface{}, err error) {
+	result := []interface{}{}
+	for _, arg := range args {
+		list, ok := arg.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("concat takes lists, got %#v", arg)
+		}
+		result = append(result, list...)
+	}
+	return result, nil
+}
+
+func reverseFn(args []interface{}) (value interface{}, err error) {
+	if len(args) == 1 {
+		if list, ok := args[0].([]interface{}); ok {
+			result := make([]interface{}, len(list))
+			for i, elem := range list {
+				result[len(list)-1-i] = elem
+			}
+			return result, nil
+		}
+	}
+	return nil, errors.New("reverse takes a single list argument")
+}
+
+func sortFn(st *state, args []interface{}) (value interface{}, err error) {
+	if len(args) != 1 && len(args) != 2 {
+		return nil, errors.New("sort takes a list and an optional less function")
+	}
+	list, ok := args[0].([]interface{})
+	if !ok {
+		return nil, errors.New("sort takes a list and an optional less function")
+	}
+	less := func(a, b interface{}) (bool, error) {
+		c, err := compare(a, b)
+		return c < 0, err
+	}
+	if len(args) == 2 {
+		less = func(a, b interface{}) (bool, error) {
+			value, err := st.apply(args[1], []interface{}{a, b})
+			return value != false, err
+		}
+	}
+	result := append([]interface{}{}, list...)
+	sort.SliceStable(result, func(i, j int) bool {
+		if err != nil {
+			return false
+		}
+		var ok bool
+		ok, err = less(result[i], result[j])
+		return ok
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// listArgs checks that args hold a function followed by a list, as taken
+// by map, filter, any, and all, and returns them.
+func listArgs(name string, args []interface{}) (fn interface{}, list []interface{}, err error) {
+	if len(args) == 2 {
+		if list, ok := args[1].([]interface{}); ok && callable(args[0]) {
+			return args[0], list, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("%s takes a function and a list", name)
+}
+
+func mapFn(st *state, args []interface{}) (value interface{}, err error) {
+	fn, list, err := listArgs("map", args)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]interface{}, len(list))
+	for i, elem := range list {
+		if result[i], err = st.apply(fn, []interface{}{elem}); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func filterFn(st *state, args []interface{}) (value interface{}, err error) {
+	fn, list, err := listArgs("filter", args)
+	if err != nil {
+		return nil, err
+	}
+	result := []interface{}{}
+	for _, elem := range list {
+		if value, err = st.apply(fn, []interface{}{elem}); err != nil {
+			return nil, err
+		}
+		if value != false {
+			result = append(result, elem)
+		}
+	}
+	return result, nil
+}
+
+func reduceFn(st *state, args []interface{}) (value interface{}, err error) {
+	if len(args) == 3 {
+		if list, ok := args[2].([]interface{}); ok && callable(args[0]) {
+			value = args[1]
+			for _, elem := range list {
+				if value, err = st.apply(args[0], []interface{}{value, elem}); err != nil {
+					return nil, err
+				}
+			}
+			return value, nil
+		}
+	}
+	return nil, errors.New("reduce takes a function, an initial value, and a list")
+}
+
+func anyFn(st *state, args []interface{}) (value interface{}, err error) {
+	return st.quantify("any", args, true)
+}
+
+func allFn(st *state, args []interface{}) (value interface{}, err error) {
+	return st.quantify("all", args, false)
+}
+
+// quantify returns whether the function in args results in a value other
+// than false for any element of the list in args, if any is true, or for
+// all of them otherwise.
+func (st *state) quantify(name string, args []interface{}, any bool) (interface{}, error) {
+	fn, list, err := listArgs(name, args)
+	if err != nil {
+		return nil, err
+	}
+	for _, elem := range list {
+		value, err := st.apply(fn, []interface{}{elem})
+		if err != nil {
+			return nil, err
+		}
+		if (value != false) == any {
+			return any, nil
+		}
+	}
+	return !any, nil
+}
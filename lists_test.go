@@ -0,0 +1,103 @@
+package twik_test
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+var listsList = []struct {
+	code  string
+	value interface{}
+}{
+	{
+		`(list 1 "a")`,
+		[]interface{}{int64(1), "a"},
+	}, {
+		`(var l (list 1)) (var m (append l 2 3)) (list l m)`,
+		[]interface{}{[]interface{}{int64(1)}, []interface{}{int64(1), int64(2), int64(3)}},
+	}, {
+		`(append 1 2)`,
+		errorf("twik source:1:2: append takes a list and the values to append"),
+	}, {
+		`(list (len (list 1 2)) (len {"a" 1}) (len ()))`,
+		[]interface{}{int64(2), int64(1), int64(0)},
+	}, {
+		`(len "abc")`,
+		errorf("twik source:1:2: len takes a single list or map argument"),
+	}, {
+		`(nth (list 1 2 3) 1)`,
+		2,
+	}, {
+		`(nth (list 1 2 3) 3)`,
+		errorf("twik source:1:2: nth index 3 is out of bounds for list of length 3"),
+	}, {
+		`(list (first (list 1 2 3)) (rest (list 1 2 3)) (first ()) (rest ()))`,
+		[]interface{}{int64(1), []interface{}{int64(2), int64(3)}, nil, []interface{}{}},
+	}, {
+		`(list (slice (list 1 2 3 4) 1 3) (slice (list 1 2 3 4) 2))`,
+		[]interface{}{[]interface{}{int64(2), int64(3)}, []interface{}{int64(3), int64(4)}},
+	}, {
+		`(slice (list 1 2) 1 3)`,
+		errorf("twik source:1:2: slice range 1 to 3 is out of bounds for list of length 2"),
+	}, {
+		`(concat (list 1) () (list 2 3))`,
+		[]interface{}{int64(1), int64(2), int64(3)},
+	}, {
+		`(concat (list 1) 2)`,
+		errorf("twik source:1:2: concat takes lists, got 2"),
+	}, {
+		`(reverse (list 1 2 3))`,
+		[]interface{}{int64(3), int64(2), int64(1)},
+	}, {
+		`(sort (list 3 1.5 2))`,
+		[]interface{}{1.5, int64(2), int64(3)},
+	}, {
+		`(sort (list "b" "c" "a") (func (a b) (> a b)))`,
+		[]interface{}{"c", "b", "a"},
+	}, {
+		`(sort (list 1 "a"))`,
+		errorf("twik source:1:2: cannot compare .*"),
+	}, {
+		`(sort (list 2 1) (func (a b) (error "boom")))`,
+		errorf("twik source:1:31: boom"),
+	}, {
+		`(map (func (x) (* x x)) (list 1 2 3))`,
+		[]interface{}{int64(1), int64(4), int64(9)},
+	}, {
+		`(map upper (list "a" "b"))`,
+		[]interface{}{"A", "B"},
+	}, {
+		`(map len (list (list 1) ()))`,
+		[]interface{}{int64(1), int64(0)},
+	}, {
+		`(map 1 (list 1))`,
+		errorf("twik source:1:2: map takes a function and a list"),
+	}, {
+		`(filter (func (x) (> x 1)) (list 1 2 3))`,
+		[]interface{}{int64(2), int64(3)},
+	}, {
+		`(reduce + 0 (list 1 2 3))`,
+		6,
+	}, {
+		`(reduce (func (acc x) (append acc (* 2 x))) () (list 1 2))`,
+		[]interface{}{int64(2), int64(4)},
+	}, {
+		`(reduce + 0 1)`,
+		errorf("twik source:1:2: reduce takes a function, an initial value, and a list"),
+	}, {
+		`(list (any (func (x) (> x 2)) (list 1 2 3)) (any (func (x) (> x 3)) (list 1 2 3)) (any (func (x) x) ()))`,
+		[]interface{}{true, false, false},
+	}, {
+		`(list (all (func (x) (> x 0)) (list 1 2 3)) (all (func (x) (> x 1)) (list 1 2 3)) (all (func (x) false) ()))`,
+		[]interface{}{true, false, true},
+	}, {
+		`(apply map (list (func (x) (+ x 1)) (list 1 2)))`,
+		[]interface{}{int64(2), int64(3)},
+	}, {
+		`(func loop (n) (if (== n 0) "done" (loop (- n 1)))) (map loop (list 10000))`,
+		[]interface{}{"done"},
+	},
+}
+
+func (S) TestLists(c *C) {
+	checkBackends(c, listsList, newScope)
+}
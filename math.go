@@ -0,0 +1,648 @@
+package twik
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+)
+
+// Math is a module of numeric functions:
+//
+//	(mod a b)             the remainder of a divided by b, with the sign of b
+//	(rem a b)             the remainder of a divided by b, with the sign of a
+//	(abs x)               the absolute value of x
+//	(min x...)            the smallest of the values
+//	(max x...)            the largest of the values
+//	(pow x y)             x raised to the power of y
+//	(sqrt x)              the square root of x
+//	(floor x)             the greatest integer value not above x
+//	(ceil x)              the least integer value not below x
+//	(round x)             the nearest integer value to x, rounding half
+//	                      away from zero
+//	(sin x), (cos x), (tan x), (asin x), (acos x), (atan x)
+//	                      the trigonometric functions, in radians
+//	(atan2 y x)           the arc tangent of y/x, using the signs of both
+//	                      to determine the quadrant
+//	(log x), (log2 x), (log10 x)
+//	                      the natural, binary, and decimal logarithms of x
+//	(exp x)               e raised to the power of x
+//	(bit-and x...), (bit-or x...), (bit-xor x...)
+//	                      the bitwise and, or, and xor of the integers
+//	(bit-not x)           the bitwise complement of the integer x
+//	(shift-left x n)      the integer x shifted left by n bits
+//	(shift-right x n)     the integer x shifted right by n bits, keeping
+//	                      its sign
+//	(int x)               the number x truncated towards zero to an integer
+//	(float x)             the number x as a float
+//
+// Numbers of different kinds are handled as done by the + - * / functions,
+// so mod and rem on a decimal and a rational result in a rational, and
+// pow, abs, shift-left, and int report int64 overflows unless promotion
+// to big integers is enabled with SetBigIntPromotion. Pow is exact when
+// raising an integer, decimal, or rational to a non-negative integer
+// power. Floor, ceil, and round result in a float when taking one, and
+// in an integer otherwise, while the other float functions always result
+// in a float.
+var Math = &Module{[]moduleSymbol{
+	{"mod", builtin(modFn)},
+	{"rem", builtin(remFn)},
+	{"abs", builtin(absFn)},
+	{"min", minFn},
+	{"max", maxFn},
+	{"pow", builtin(powFn)},
+	{"sqrt", floatFn("sqrt", math.Sqrt)},
+	{"floor", roundFn("floor", math.Floor, ratFloor)},
+	{"ceil", roundFn("ceil", math.Ceil, ratCeil)},
+	{"round", roundFn("round", math.Round, ratRound)},
+	{"sin", floatFn("sin", math.Sin)},
+	{"cos", floatFn("cos", math.Cos)},
+	{"tan", floatFn("tan", math.Tan)},
+	{"asin", floatFn("asin", math.Asin)},
+	{"acos", floatFn("acos", math.Acos)},
+	{"atan", floatFn("atan", math.Atan)},
+	{"atan2", atan2Fn},
+	{"log", floatFn("log", math.Log)},
+	{"log2", floatFn("log2", math.Log2)},
+	{"log10", floatFn("log10", math.Log10)},
+	{"exp", floatFn("exp", math.Exp)},
+	{"bit-and", bitFn("bit-and", (*big.Int).And)},
+	{"bit-or", bitFn("bit-or", (*big.Int).Or)},
+	{"bit-xor", bitFn("bit-xor", (*big.Int).Xor)},
+	{"bit-not", builtin(bitNotFn)},
+	{"shift-left", builtin(shiftLeftFn)},
+	{"shift-right", builtin(shiftRightFn)},
+	{"int", builtin(intFn)},
+	{"float", floatConvFn},
+}}
+
+var (
+	errOverflow = errors.New("integer overflow")
+	errDivZero  = errors.New("integer division by zero")
+
+	errRatDivZero = errors.New("division by zero")
+)
+
+// SetBigIntPromotion sets whether results of integer arithmetic on int64
+// values that do not fit in an int64 are promoted to *big.Int values,
+// rather than reported as overflow errors, when evaluating logic in the
+// s scope, in scopes branched from it, and in functions defined within
+// them. Arithmetic on *big.Int values, such as integer literals that do
+// not fit in an int64, results in big integers regardless. Results that
+// fit in an int64 are always int64 values.
+func (s *Scope) SetBigIntPromotion(enabled bool) {
+	s.shared().promote = enabled
+}
+
+// arithOp defines an arithmetic operation on pairs of numbers.
+type arithOp struct {
+	// errFmt formats the error reported for a value that isn't a number.
+	errFmt string
+	ints   func(a, b int64) (int64, error)
+	bigs   func(a, b *big.Int) (*big.Int, error)
+	rats   func(a, b *big.Rat) (*big.Rat, error)
+	floats func(a, b float64) float64
+	// scale returns the scale of the result of the operation on decimals
+	// with the given scales.
+	scale func(a, b int) int
+}
+
+var (
+	addOp = &arithOp{
+		errFmt: "cannot sum %#v",
+		ints:   addInt,
+		bigs:   func(a, b *big.Int) (*big.Int, error) { return new(big.Int).Add(a, b), nil },
+		rats:   func(a, b *big.Rat) (*big.Rat, error) { return new(big.Rat).Add(a, b), nil },
+		floats: func(a, b float64) float64 { return a + b },
+		scale:  maxScale,
+	}
+	subOp = &arithOp{
+		errFmt: "cannot subtract %#v",
+		ints:   subInt,
+		bigs:   func(a, b *big.Int) (*big.Int, error) { return new(big.Int).Sub(a, b), nil },
+		rats:   func(a, b *big.Rat) (*big.Rat, error) { return new(big.Rat).Sub(a, b), nil },
+		floats: func(a, b float64) float64 { return a - b },
+		scale:  maxScale,
+	}
+	mulOp = &arithOp{
+		errFmt: "cannot multiply %#v",
+		ints:   mulInt,
+		bigs:   func(a, b *big.Int) (*big.Int, error) { return new(big.Int).Mul(a, b), nil },
+		rats:   func(a, b *big.Rat) (*big.Rat, error) { return new(big.Rat).Mul(a, b), nil },
+		floats: func(a, b float64) float64 { return a * b },
+		scale:  func(a, b int) int { return a + b },
+	}
+	divOp = &arithOp{
+		errFmt: "cannot divide with %#v",
+		ints:   divInt,
+		bigs: func(a, b *big.Int) (*big.Int, error) {
+			if b.Sign() == 0 {
+				return nil, errDivZero
+			}
+			return new(big.Int).Quo(a, b), nil
+		},
+		rats: func(a, b *big.Rat) (*big.Rat, error) {
+			if b.Sign() == 0 {
+				return nil, errRatDivZero
+			}
+			return new(big.Rat).Quo(a, b), nil
+		},
+		floats: func(a, b float64) float64 { return a / b },
+		scale:  maxScale,
+	}
+	modOp = &arithOp{
+		errFmt: "mod takes two numbers, got %#v",
+		ints: func(a, b int64) (int64, error) {
+			if b == 0 {
+				return 0, errDivZero
+			}
+			r := a % b
+			if r != 0 && (r < 0) != (b < 0) {
+				r += b
+			}
+			return r, nil
+		},
+		bigs: func(a, b *big.Int) (*big.Int, error) {
+			if b.Sign() == 0 {
+				return nil, errDivZero
+			}
+			r := new(big.Int).Rem(a, b)
+			if r.Sign() != 0 && r.Sign() != b.Sign() {
+				r.Add(r, b)
+			}
+			return r, nil
+		},
+		rats: func(a, b *big.Rat) (*big.Rat, error) {
+			return ratRem(a, b, ratFloor)
+		},
+		floats: func(a, b float64) float64 {
+			r := math.Mod(a, b)
+			if r != 0 && (r < 0) != (b < 0) {
+				r += b
+			}
+			return r
+		},
+		scale: maxScale,
+	}
+	remOp = &arithOp{
+		errFmt: "rem takes two numbers, got %#v",
+		ints: func(a, b int64) (int64, error) {
+			if b == 0 {
+				return 0, errDivZero
+			}
+			return a % b, nil
+		},
+		bigs: func(a, b *big.Int) (*big.Int, error) {
+			if b.Sign() == 0 {
+				return nil, errDivZero
+			}
+			return new(big.Int).Rem(a, b), nil
+		},
+		rats: func(a, b *big.Rat) (*big.Rat, error) {
+			return ratRem(a, b, ratTrunc)
+		},
+		floats: math.Mod,
+		scale:  maxScale,
+	}
+)
+
+func maxScale(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func addInt(a, b int64) (int64, error) {
+	c := a + b
+	if (c > a) != (b > 0) {
+		return 0, errOverflow
+	}
+	return c, nil
+}
+
+func subInt(a, b int64) (int64, error) {
+	c := a - b
+	if (c < a) != (b > 0) {
+		return 0, errOverflow
+	}
+	return c, nil
+}
+
+func mulInt(a, b int64) (int64, error) {
+	if a == 0 || b == 0 {
+		return 0, nil
+	}
+	c := a * b
+	if c/b != a || a == -1 && b == math.MinInt64 || b == -1 && a == math.MinInt64 {
+		return 0, errOverflow
+	}
+	return c, nil
+}
+
+func divInt(a, b int64) (int64, error) {
+	if b == 0 {
+		return 0, errDivZero
+	}
+	if a == math.MinInt64 && b == -1 {
+		return 0, errOverflow
+	}
+	return a / b, nil
+}
+
+// ratFloor returns the greatest integer not above r.
+func ratFloor(r *big.Rat) *big.Int {
+	q, m := new(big.Int).QuoRem(r.Num(), r.Denom(), new(big.Int))
+	if m.Sign() < 0 {
+		q.Sub(q, big.NewInt(1))
+	}
+	return q
+}
+
+// ratCeil returns the least integer not below r.
+func ratCeil(r *big.Rat) *big.Int {
+	z := ratFloor(new(big.Rat).Neg(r))
+	return z.Neg(z)
+}
+
+// ratRound returns the integer nearest to r, rounding half away from zero.
+func ratRound(r *big.Rat) *big.Int {
+	z := ratFloor(new(big.Rat).Add(new(big.Rat).Abs(r), big.NewRat(1, 2)))
+	if r.Sign() < 0 {
+		z.Neg(z)
+	}
+	return z
+}
+
+// ratTrunc returns r truncated towards zero to an integer.
+func ratTrunc(r *big.Rat) *big.Int {
+	return new(big.Int).Quo(r.Num(), r.Denom())
+}
+
+// ratRem returns the remainder of a divided by b, given the function
+// that rounds their quotient to an integer.
+func ratRem(a, b *big.Rat, round func(*big.Rat) *big.Int) (*big.Rat, error) {
+	if b.Sign() == 0 {
+		return nil, errRatDivZero
+	}
+	q := new(big.Rat).SetInt(round(new(big.Rat).Quo(a, b)))
+	return q.Sub(a, q.Mul(q, b)), nil
+}
+
+// arith folds args with op from left to right. The values are operated
+// on as numbers of the greatest kind among them, so integers are only
+// operated on as such when all of the values are integers, for example,
+// and a single float turns all of them into floats. A division of
+// decimals without a finite decimal result turns the values still to be
+// operated on into rationals.
+func (st *state) arith(op *arithOp, args []interface{}) (interface{}, error) {
+	kind := intKind
+	for _, arg := range args {
+		k := kindOf(arg)
+		if k == notNumber {
+			return nil, fmt.Errorf(op.errFmt, arg)
+		}
+		if k > kind {
+			kind = k
+		}
+	}
+	acc := args[0]
+	for _, arg := range args[1:] {
+		var err error
+		if acc, err = st.operate(op, kind, acc, arg); err != nil {
+			return nil, err
+		}
+		if k := kindOf(acc); k > kind {
+			kind = k
+		}
+	}
+	if kind == decimalKind {
+		return toDecimal(acc), nil
+	}
+	return acc, nil
+}
+
+// operate applies op to a and b as numbers of the given kind.
+func (st *state) operate(op *arithOp, kind numKind, a, b interface{}) (interface{}, error) {
+	switch kind {
+	case floatKind:
+		x, _ := toFloat(a)
+		y, _ := toFloat(b)
+		return op.floats(x, y), nil
+	case ratKind:
+		r, err := op.rats(toRat(a), toRat(b))
+		if err != nil {
+			return nil, err
+		}
+		return normalizeRat(r), nil
+	case decimalKind:
+		x, y := toDecimal(a), toDecimal(b)
+		r, err := op.rats(x.Rat(), y.Rat())
+		if err != nil {
+			return nil, err
+		}
+		if d := decimalOf(r, op.scale(x.Scale, y.Scale)); d != nil {
+			return d, nil
+		}
+		return r, nil
+	}
+	return st.intOp(op, a, b)
+}
+
+// intOp applies op to the integers a and b. Big integers are used when
+// either of them is one, or when the result overflows and promotion to
+// big integers is enabled.
+func (st *state) intOp(op *arithOp, a, b interface{}) (interface{}, error) {
+	x, ok1 := a.(int64)
+	y, ok2 := b.(int64)
+	if ok1 && ok2 {
+		z, err := op.ints(x, y)
+		if err == nil {
+			return z, nil
+		}
+		if err != errOverflow || !st.promote {
+			return nil, err
+		}
+	}
+	z, err := op.bigs(toBig(a), toBig(b))
+	if err != nil {
+		return nil, err
+	}
+	return normalize(z), nil
+}
+
+// integer returns z as an int64 if it fits in one, or as is if promotion
+// to big integers is enabled.
+func (st *state) integer(z *big.Int) (interface{}, error) {
+	if z.IsInt64() {
+		return z.Int64(), nil
+	}
+	if st.promote {
+		return z, nil
+	}
+	return nil, errOverflow
+}
+
+func modFn(st *state, args []interface{}) (value interface{}, err error) {
+	if len(args) != 2 {
+		return nil, errors.New("mod takes two numbers")
+	}
+	return st.arith(modOp, args)
+}
+
+func remFn(st *state, args []interface{}) (value interface{}, err error) {
+	if len(args) != 2 {
+		return nil, errors.New("rem takes two numbers")
+	}
+	return st.arith(remOp, args)
+}
+
+func absFn(st *state, args []interface{}) (value interface{}, err error) {
+	if len(args) == 1 {
+		switch x := args[0].(type) {
+		case int64:
+			if x == math.MinInt64 {
+				return st.integer(new(big.Int).Neg(big.NewInt(x)))
+			}
+			if x < 0 {
+				return -x, nil
+			}
+			return x, nil
+		case *big.Int:
+			return normalize(new(big.Int).Abs(x)), nil
+		case *big.Rat:
+			return new(big.Rat).Abs(x), nil
+		case *Decimal:
+			return &Decimal{new(big.Int).Abs(x.Unscaled), x.Scale}, nil
+		case float64:
+			return math.Abs(x), nil
+		}
+	}
+	return nil, errors.New("abs takes a single number")
+}
+
+// extremeFn returns a function that results in the value among its
+// numeric arguments for which compare results in c when comparing it
+// with each of the others.
+func extremeFn(name string, c int) func(args []interface{}) (interface{}, error) {
+	return func(args []interface{}) (value interface{}, err error) {
+		if len(args) == 0 {
+			return nil, fmt.Errorf("%s takes one or more numbers", name)
+		}
+		for i, arg := range args {
+			if kindOf(arg) == notNumber {
+				return nil, fmt.Errorf("%s takes one or more numbers", name)
+			}
+			if i == 0 {
+				value = arg
+				continue
+			}
+			if r, _ := compare(arg, value); r == c {
+				value = arg
+			}
+		}
+		return value, nil
+	}
+}
+
+var (
+	minFn = extremeFn("min", -1)
+	maxFn = extremeFn("max", 1)
+)
+
+func powFn(st *state, args []interface{}) (value interface{}, err error) {
+	if len(args) == 2 {
+		x, ok1 := toFloat(args[0])
+		y, ok2 := toFloat(args[1])
+		if ok1 && ok2 {
+			if n, ok := args[1].(int64); ok && n >= 0 {
+				switch x := args[0].(type) {
+				case int64, *big.Int:
+					return st.powInt(x, n)
+				case *Decimal:
+					if err := st.checkBits(powBits(x.Unscaled.BitLen(), n)); err != nil {
+						return nil, err
+					}
+					return &Decimal{new(big.Int).Exp(x.Unscaled, big.NewInt(n), nil), x.Scale * int(n)}, nil
+				case *big.Rat:
+					if err := st.checkBits(powBits(x.Num().BitLen()+x.Denom().BitLen(), n)); err != nil {
+						return nil, err
+					}
+					num := new(big.Int).Exp(x.Num(), big.NewInt(n), nil)
+					den := new(big.Int).Exp(x.Denom(), big.NewInt(n), nil)
+					return normalizeRat(new(big.Rat).SetFrac(num, den)), nil
+				}
+			}
+			return math.Pow(x, y), nil
+		}
+	}
+	return nil, errors.New("pow takes two numbers")
+}
+
+// powInt returns the integer x raised to the power of n.
+func (st *state) powInt(x interface{}, n int64) (interface{}, error) {
+	if base, ok := x.(int64); ok {
+		result, err := int64(1), error(nil)
+		for e := n; e > 0 && err == nil; e >>= 1 {
+			if e&1 == 1 {
+				result, err = mulInt(result, base)
+			}
+			if e > 1 && err == nil {
+				base, err = mulInt(base, base)
+			}
+		}
+		if err == nil {
+			return result, nil
+		}
+		if !st.promote {
+			return nil, err
+		}
+	}
+	z := toBig(x)
+	if err := st.checkBits(powBits(z.BitLen(), n)); err != nil {
+		return nil, err
+	}
+	return normalize(new(big.Int).Exp(z, big.NewInt(n), nil)), nil
+}
+
+// floatFn returns a function that results in f applied to its single
+// numeric argument as a float.
+func floatFn(name string, f func(float64) float64) func(args []interface{}) (interface{}, error) {
+	return func(args []interface{}) (value interface{}, err error) {
+		if len(args) == 1 {
+			if x, ok := toFloat(args[0]); ok {
+				return f(x), nil
+			}
+		}
+		return nil, fmt.Errorf("%s takes a single number", name)
+	}
+}
+
+// roundFn returns a function that results in f applied to its single
+// argument if it is a float, or in fr applied to it if it is a decimal
+// or a rational. Integers result in themselves.
+func roundFn(name string, f func(float64) float64, fr func(*big.Rat) *big.Int) func(args []interface{}) (interface{}, error) {
+	return func(args []interface{}) (value interface{}, err error) {
+		if len(args) == 1 {
+			switch x := args[0].(type) {
+			case int64, *big.Int:
+				return x, nil
+			case *Decimal, *big.Rat:
+				return normalize(fr(toRat(x))), nil
+			case float64:
+				return f(x), nil
+			}
+		}
+		return nil, fmt.Errorf("%s takes a single number", name)
+	}
+}
+
+func atan2Fn(args []interface{}) (value interface{}, err error) {
+	if len(args) == 2 {
+		y, ok1 := toFloat(args[0])
+		x, ok2 := toFloat(args[1])
+		if ok1 && ok2 {
+			return math.Atan2(y, x), nil
+		}
+	}
+	return nil, errors.New("atan2 takes two numbers")
+}
+
+// bitFn returns a function that results in f applied to its integer
+// arguments from left to right.
+func bitFn(name string, f func(z, a, b *big.Int) *big.Int) builtin {
+	return func(st *state, args []interface{}) (value interface{}, err error) {
+		if len(args) < 2 {
+			return nil, fmt.Errorf("%s takes two or more integers", name)
+		}
+		acc := toBig(args[0])
+		for _, arg := range args[1:] {
+			x := toBig(arg)
+			if acc == nil || x == nil {
+				return nil, fmt.Errorf("%s takes two or more integers", name)
+			}
+			acc = f(new(big.Int), acc, x)
+		}
+		return normalize(acc), nil
+	}
+}
+
+func bitNotFn(st *state, args []interface{}) (value interface{}, err error) {
+	if len(args) == 1 {
+		switch x := args[0].(type) {
+		case int64:
+			return ^x, nil
+		case *big.Int:
+			return normalize(new(big.Int).Not(x)), nil
+		}
+	}
+	return nil, errors.New("bit-not takes a single integer")
+}
+
+// shiftArgs checks that args hold an integer and a non-negative shift
+// count, as taken by shift-left and shift-right, and returns them.
+func shiftArgs(name string, args []interface{}) (x *big.Int, n uint, err error) {
+	if len(args) == 2 {
+		x := toBig(args[0])
+		n, ok := args[1].(int64)
+		if x != nil && ok && n >= 0 && n <= math.MaxInt32 {
+			return x, uint(n), nil
+		}
+	}
+	return nil, 0, fmt.Errorf("%s takes an integer and a non-negative bit count", name)
+}
+
+func shiftLeftFn(st *state, args []interface{}) (value interface{}, err error) {
+	x, n, err := shiftArgs("shift-left", args)
+	if err != nil {
+		return nil, err
+	}
+	if x.Sign() != 0 {
+		// Check the size of the result before computing it.
+		if _, ok := args[0].(int64); ok && !st.promote && n > 63 {
+			return nil, errOverflow
+		}
+		if err := st.checkBits(int64(x.BitLen()) + int64(n)); err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := args[0].(int64); ok {
+		return st.integer(new(big.Int).Lsh(x, n))
+	}
+	return normalize(new(big.Int).Lsh(x, n)), nil
+}
+
+func shiftRightFn(st *state, args []interface{}) (value interface{}, err error) {
+	x, n, err := shiftArgs("shift-right", args)
+	if err != nil {
+		return nil, err
+	}
+	return normalize(new(big.Int).Rsh(x, n)), nil
+}
+
+func intFn(st *state, args []interface{}) (value interface{}, err error) {
+	if len(args) == 1 {
+		switch x := args[0].(type) {
+		case int64, *big.Int:
+			return x, nil
+		case *Decimal, *big.Rat:
+			return normalize(ratTrunc(toRat(x))), nil
+		case float64:
+			if math.IsNaN(x) || math.IsInf(x, 0) {
+				return nil, fmt.Errorf("cannot convert %v to an integer", x)
+			}
+			z, _ := big.NewFloat(x).Int(nil)
+			return st.integer(z)
+		}
+	}
+	return nil, errors.New("int takes a single number")
+}
+
+func floatConvFn(args []interface{}) (value interface{}, err error) {
+	if len(args) == 1 {
+		if x, ok := toFloat(args[0]); ok {
+			return x, nil
+		}
+	}
+	return nil, errors.New("float takes a single number")
+}
@@ -0,0 +1,146 @@
+package twik_test
+
+import (
+	"math"
+	"math/big"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/twik.v1"
+	"gopkg.in/twik.v1/ast"
+)
+
+var mathList = []struct {
+	code  string
+	value interface{}
+}{
+	{
+		`(list (mod 7 3) (mod -7 3) (mod 7 -3) (rem -7 3) (rem 7 -3))`,
+		[]interface{}{int64(1), int64(2), int64(-2), int64(-1), int64(1)},
+	}, {
+		`(list (mod 7.5 2) (mod -7.5 2) (rem -7.5 2))`,
+		[]interface{}{1.5, 0.5, -1.5},
+	}, {
+		`(mod 1 0)`,
+		errorf("twik source:1:2: integer division by zero"),
+	}, {
+		`(rem 1 "a")`,
+		errorf(`twik source:1:2: rem takes two numbers, got "a"`),
+	}, {
+		`(mod 1)`,
+		errorf("twik source:1:2: mod takes two numbers"),
+	}, {
+		`(list (abs -3) (abs 3) (abs -1.5))`,
+		[]interface{}{int64(3), int64(3), 1.5},
+	}, {
+		`(abs -9223372036854775808)`,
+		errorf("twik source:1:2: integer overflow"),
+	}, {
+		`(list (min 3 1 2) (max 3 1.5 2) (min 2))`,
+		[]interface{}{int64(1), int64(3), int64(2)},
+	}, {
+		`(max 1 "a")`,
+		errorf("twik source:1:2: max takes one or more numbers"),
+	}, {
+		`(list (pow 2 10) (pow 2 62) (pow 2 -1) (pow 2.0 3) (pow -3 3))`,
+		[]interface{}{int64(1024), int64(4611686018427387904), 0.5, 8.0, int64(-27)},
+	}, {
+		`(pow 3 40)`,
+		errorf("twik source:1:2: integer overflow"),
+	}, {
+		`(list (sqrt 16) (floor 1.5) (floor 3) (ceil 1.2) (round 2.5) (round -2.5))`,
+		[]interface{}{4.0, 1.0, int64(3), 2.0, 3.0, -3.0},
+	}, {
+		`(list (sin 0) (cos 0) (atan2 1 1) (log 1) (log2 8) (log10 1000) (exp 0))`,
+		[]interface{}{0.0, 1.0, math.Pi / 4, 0.0, 3.0, math.Log10(1000), 1.0},
+	}, {
+		`(sqrt "a")`,
+		errorf("twik source:1:2: sqrt takes a single number"),
+	}, {
+		`(list (bit-and 12 10) (bit-or 12 10 1) (bit-xor 12 10) (bit-not 0))`,
+		[]interface{}{int64(8), int64(15), int64(6), int64(-1)},
+	}, {
+		`(list (shift-left 1 4) (shift-right -16 2) (shift-right 1 70))`,
+		[]interface{}{int64(16), int64(-4), int64(0)},
+	}, {
+		`(shift-left 1 63)`,
+		errorf("twik source:1:2: integer overflow"),
+	}, {
+		`(shift-left 1 2000000000)`,
+		errorf("twik source:1:2: integer overflow"),
+	}, {
+		`(shift-left 0 2000000000)`,
+		0,
+	}, {
+		`(shift-left 1 -1)`,
+		errorf("twik source:1:2: shift-left takes an integer and a non-negative bit count"),
+	}, {
+		`(bit-and 1)`,
+		errorf("twik source:1:2: bit-and takes two or more integers"),
+	}, {
+		`(list (int 2.7) (int -2.7) (int 3) (float 2))`,
+		[]interface{}{int64(2), int64(-2), int64(3), 2.0},
+	}, {
+		`(int 1.0e19)`,
+		errorf("twik source:1:2: integer overflow"),
+	}, {
+		`(int (/ 0.0 0))`,
+		errorf("twik source:1:2: cannot convert NaN to an integer"),
+	},
+}
+
+func newMathScope(fset *ast.FileSet) *twik.Scope {
+	scope := twik.NewScope(fset)
+	scope.Use(twik.Math, twik.Lists)
+	return scope
+}
+
+func (S) TestMath(c *C) {
+	checkBackends(c, mathList, newMathScope)
+}
+
+func bigInt(s string) *big.Int {
+	z, ok := new(big.Int).SetString(s, 10)
+	if !ok {
+		panic("invalid big integer: " + s)
+	}
+	return z
+}
+
+var promotionList = []struct {
+	code  string
+	value interface{}
+}{
+	{
+		`(+ 9223372036854775807 1)`,
+		bigInt("9223372036854775808"),
+	}, {
+		`(- (+ 9223372036854775807 1) 1)`,
+		int64(9223372036854775807),
+	}, {
+		`(list (* 4294967296 4294967296) (- -9223372036854775808))`,
+		[]interface{}{bigInt("18446744073709551616"), bigInt("9223372036854775808")},
+	}, {
+		`(list (pow 2 100) (/ (pow 2 100) (pow 2 98)) (mod (pow 2 100) 7))`,
+		[]interface{}{bigInt("1267650600228229401496703205376"), int64(4), int64(2)},
+	}, {
+		`(list (== (pow 2 100) (pow 2 100)) (< 1 (pow 2 100) 1.0e40) (== (pow 2 100) 1))`,
+		[]interface{}{true, true, false},
+	}, {
+		`(list (abs (- (pow 2 70))) (+ (pow 2 64) 0.5))`,
+		[]interface{}{bigInt("1180591620717411303424"), 18446744073709551616.0},
+	}, {
+		`(list (shift-left 1 64) (int 1.0e19) (bit-and (pow 2 70) (- (pow 2 70) 1)))`,
+		[]interface{}{bigInt("18446744073709551616"), bigInt("10000000000000000000"), int64(0)},
+	}, {
+		`(/ (pow 2 100) 0)`,
+		errorf("twik source:1:2: integer division by zero"),
+	},
+}
+
+func (S) TestBigIntPromotion(c *C) {
+	checkBackends(c, promotionList, func(fset *ast.FileSet) *twik.Scope {
+		scope := newMathScope(fset)
+		scope.SetBigIntPromotion(true)
+		return scope
+	})
+}
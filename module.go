@@ -0,0 +1,45 @@
+package twik
+
+import (
+	"fmt"
+)
+
+// Module is a set of symbols that may be defined in a scope all at once
+// with Scope.Use, such as the Strings module. Unlike the standard symbols
+// every scope holds, modules are opt-in.
+type Module struct {
+	symbols []moduleSymbol
+}
+
+type moduleSymbol struct {
+	name  string
+	value interface{}
+}
+
+// builtin is a function that is provided with the state of the current
+// evaluation, so that it may call other functions with state.apply, as
+// done by map.
+type builtin func(st *state, args []interface{}) (interface{}, error)
+
+// Use defines in the s scope the symbols of the given modules. It is an
+// error to redefine an existent symbol, or to define the same symbol in
+// more than one of the modules, in which case no symbols are defined.
+func (s *Scope) Use(modules ...*Module) error {
+	seen := make(map[string]bool)
+	for _, m := range modules {
+		for _, sym := range m.symbols {
+			if _, ok := s.vars[sym.name]; ok || seen[sym.name] {
+				return fmt.Errorf("symbol already defined in current scope: %s", sym.name)
+			}
+			seen[sym.name] = true
+		}
+	}
+	for _, m := range modules {
+		for _, sym := range m.symbols {
+			if err := s.Create(sym.name, sym.value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
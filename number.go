@@ -0,0 +1,243 @@
+package twik
+
+import (
+	"math"
+	"math/big"
+	"strings"
+
+	"gopkg.in/twik.v1/ast"
+)
+
+// Decimal is a fixed-point decimal number, such as the one written as
+// 12.50m in twik code, holding the value Unscaled * 10^-Scale. Unlike
+// floats, decimals represent values such as 0.1 exactly, and keep the
+// scale they were written with, so 12.50m is formatted as 12.50.
+//
+// Numbers in twik are integers, held as int64 values or as *big.Int
+// values when they don't fit in one, decimals, rationals such as 1/3,
+// held as *big.Rat values, and floats. The + - * / functions and the
+// Math module operate on numbers of different kinds as numbers of the
+// last kind among them in that order, so adding an integer to a decimal
+// results in a decimal, and adding a float to either results in a
+// float. Sums and differences of decimals have the greatest scale among
+// them, and products have the sum of their scales. Dividing integers
+// truncates the quotient, while dividing decimals results in a decimal
+// when the quotient has a finite decimal representation, and in a
+// rational otherwise. Rationals with an integer value and big integers
+// that fit in an int64 are always turned into int64 values. Numbers are
+// compared by their exact values, except for int64 values and floats,
+// which are compared as floats.
+//
+// Decimal values must not be modified once created.
+type Decimal struct {
+	Unscaled *big.Int
+	Scale    int
+}
+
+// String returns d in decimal notation, with Scale digits after the dot.
+func (d *Decimal) String() string {
+	digits := new(big.Int).Abs(d.Unscaled).String()
+	if len(digits) <= d.Scale {
+		digits = strings.Repeat("0", d.Scale-len(digits)+1) + digits
+	}
+	if d.Scale > 0 {
+		digits = digits[:len(digits)-d.Scale] + "." + digits[len(digits)-d.Scale:]
+	}
+	if d.Unscaled.Sign() < 0 {
+		return "-" + digits
+	}
+	return digits
+}
+
+// Rat returns the value of d as a rational number.
+func (d *Decimal) Rat() *big.Rat {
+	return new(big.Rat).SetFrac(d.Unscaled, pow10(d.Scale))
+}
+
+// Float64 returns the float64 value nearest to d.
+func (d *Decimal) Float64() float64 {
+	f, _ := d.Rat().Float64()
+	return f
+}
+
+func pow10(n int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+}
+
+// decimalOf returns r as a decimal with the least scale not below the
+// given one that represents r exactly, or nil if r has no finite decimal
+// representation, as is the case of 1/3.
+func decimalOf(r *big.Rat, scale int) *Decimal {
+	den := new(big.Int).Set(r.Denom())
+	need := 0
+	for _, factor := range []int64{2, 5} {
+		n := 0
+		f := big.NewInt(factor)
+		m := new(big.Int)
+		for {
+			q, _ := new(big.Int).QuoRem(den, f, m)
+			if m.Sign() != 0 {
+				break
+			}
+			den = q
+			n++
+		}
+		if n > need {
+			need = n
+		}
+	}
+	if den.Cmp(big.NewInt(1)) != 0 {
+		return nil
+	}
+	if need > scale {
+		scale = need
+	}
+	unscaled := new(big.Int).Mul(r.Num(), pow10(scale))
+	return &Decimal{unscaled.Quo(unscaled, r.Denom()), scale}
+}
+
+// numKind identifies the kinds of numbers handled by twik, ordered so
+// that arithmetic on numbers of different kinds operates on all of them
+// as numbers of the greatest kind among them.
+type numKind int
+
+const (
+	notNumber   numKind = iota
+	intKind             // int64 or *big.Int
+	decimalKind         // *Decimal
+	ratKind             // *big.Rat
+	floatKind           // float64
+)
+
+// kindOf returns the kind of the number v, or notNumber if v isn't one.
+func kindOf(v interface{}) numKind {
+	switch v.(type) {
+	case int64, *big.Int:
+		return intKind
+	case *Decimal:
+		return decimalKind
+	case *big.Rat:
+		return ratKind
+	case float64:
+		return floatKind
+	}
+	return notNumber
+}
+
+// normalize returns z as an int64 if it fits in one, or as is otherwise.
+func normalize(z *big.Int) interface{} {
+	if z.IsInt64() {
+		return z.Int64()
+	}
+	return z
+}
+
+// normalizeRat returns r as an integer if it is one, or as is otherwise.
+func normalizeRat(r *big.Rat) interface{} {
+	if r.IsInt() {
+		return normalize(new(big.Int).Set(r.Num()))
+	}
+	return r
+}
+
+// numberOf returns the value of a numeric literal node.
+func numberOf(node ast.Node) interface{} {
+	switch node := node.(type) {
+	case *ast.Int:
+		if node.Big != nil {
+			return node.Big
+		}
+		return node.Value
+	case *ast.Ratio:
+		return normalizeRat(node.Value)
+	case *ast.Decimal:
+		return &Decimal{node.Unscaled, node.Scale}
+	}
+	panic("internal error: not a numeric literal")
+}
+
+// toFloat returns the number v as a float64.
+func toFloat(v interface{}) (f float64, ok bool) {
+	switch v := v.(type) {
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	case *big.Int:
+		f, _ = new(big.Float).SetInt(v).Float64()
+		return f, true
+	case *big.Rat:
+		f, _ = v.Float64()
+		return f, true
+	case *Decimal:
+		return v.Float64(), true
+	}
+	return 0, false
+}
+
+// toBig returns the integer v as a *big.Int, or nil if v isn't an integer.
+func toBig(v interface{}) *big.Int {
+	switch v := v.(type) {
+	case int64:
+		return big.NewInt(v)
+	case *big.Int:
+		return v
+	}
+	return nil
+}
+
+// toDecimal returns the integer or decimal v as a decimal.
+func toDecimal(v interface{}) *Decimal {
+	if d, ok := v.(*Decimal); ok {
+		return d
+	}
+	return &Decimal{toBig(v), 0}
+}
+
+// toRat returns the exact number v as a rational number.
+func toRat(v interface{}) *big.Rat {
+	switch v := v.(type) {
+	case *big.Rat:
+		return v
+	case *Decimal:
+		return v.Rat()
+	}
+	return new(big.Rat).SetInt(toBig(v))
+}
+
+// compareNumbers returns -1, 0, or +1 depending on whether the number a
+// is less than, equal to, or greater than the number b, or unordered if
+// either is NaN. Floats are compared with int64 values as floats, and
+// with the other numbers exactly.
+func compareNumbers(a, b interface{}) int {
+	x, ok1 := a.(int64)
+	y, ok2 := b.(int64)
+	ka, kb := kindOf(a), kindOf(b)
+	switch {
+	case ok1 && ok2:
+		return compareInt(x, y)
+	case (ok1 || ka == floatKind) && (ok2 || kb == floatKind):
+		f, _ := toFloat(a)
+		g, _ := toFloat(b)
+		return compareFloat(f, g)
+	case ka == floatKind:
+		if c := compareExact(b, a.(float64)); c != unordered {
+			return -c
+		}
+		return unordered
+	case kb == floatKind:
+		return compareExact(a, b.(float64))
+	}
+	return toRat(a).Cmp(toRat(b))
+}
+
+// compareExact compares the exact number a with the float f.
+func compareExact(a interface{}, f float64) int {
+	switch {
+	case math.IsNaN(f):
+		return unordered
+	case math.IsInf(f, 0):
+		return -int(math.Copysign(1, f))
+	}
+	return toRat(a).Cmp(new(big.Rat).SetFloat64(f))
+}
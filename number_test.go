@@ -0,0 +1,83 @@
+package twik_test
+
+import (
+	"math"
+	"math/big"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/twik.v1"
+	"gopkg.in/twik.v1/ast"
+)
+
+func dec(unscaled int64, scale int) *twik.Decimal {
+	return &twik.Decimal{Unscaled: big.NewInt(unscaled), Scale: scale}
+}
+
+var numberList = []struct {
+	code  string
+	value interface{}
+}{
+	{
+		`(list (+ 1.10m 2.205m) (- 5m 1.5m) (* 1.5m 2.0m) (/ 10.00m 4) (/ 1m 8))`,
+		[]interface{}{dec(3305, 3), dec(35, 1), dec(300, 2), dec(250, 2), dec(125, 3)},
+	}, {
+		`(/ 1.00m 3)`,
+		big.NewRat(1, 3),
+	}, {
+		`(list (+ 1/3 2/3) (+ 1/2 1) (* 2/3 3/4) (- 1/2 0.5) (+ 0.10m 1/3) 4/2)`,
+		[]interface{}{int64(1), big.NewRat(3, 2), big.NewRat(1, 2), 0.0, big.NewRat(13, 30), int64(2)},
+	}, {
+		`(list (/ 7 2 1/2) (/ 7 2 0.5) (+ 1.5m 0.25))`,
+		[]interface{}{int64(7), 7.0, 1.75},
+	}, {
+		`(list (+ 99999999999999999999 1) (- 9223372036854775808 1))`,
+		[]interface{}{bigInt("100000000000000000000"), int64(math.MaxInt64)},
+	}, {
+		`(list (< 1/3 0.34m 1/2 0.5001) (== 1.50m 1.5m) (== 1/2 0.5) (== 2/2 1) (> 9223372036854775808 9223372036854775807))`,
+		[]interface{}{true, true, false, true, true},
+	}, {
+		`(list (< 1/3 (/ 0.0 0)) (< 1/3 (/ 1.0 0)) (> 99999999999999999999 1.0))`,
+		[]interface{}{false, true, true},
+	}, {
+		`(/ 1/2 0)`,
+		errorf("twik source:1:2: division by zero"),
+	}, {
+		`(/ 1.0m 0.0m)`,
+		errorf("twik source:1:2: division by zero"),
+	}, {
+		`(switch 1.50m (case (1/2 1.5m) "a") (else "b"))`,
+		"a",
+	}, {
+		`(list (floor -7/2) (ceil 7/2) (round 5/2) (round -2.5m) (int 9.99m) (abs -1.25m))`,
+		[]interface{}{int64(-4), int64(4), int64(3), int64(-3), int64(9), dec(125, 2)},
+	}, {
+		`(list (pow 1.5m 2) (pow 2/3 2) (pow 99999999999999999999 2) (mod 7.5m 2) (rem -7/2 2) (float 1/4))`,
+		[]interface{}{dec(225, 2), big.NewRat(4, 9), bigInt("9999999999999999999800000000000000000001"), dec(15, 1), big.NewRat(-3, 2), 0.25},
+	}, {
+		`'(1/3 1.50m 99999999999999999999)`,
+		[]interface{}{big.NewRat(1, 3), dec(150, 2), bigInt("99999999999999999999")},
+	},
+}
+
+func (S) TestNumbers(c *C) {
+	checkBackends(c, numberList, newMathScope)
+}
+
+func (S) TestDecimalString(c *C) {
+	c.Assert(dec(1250, 2).String(), Equals, "12.50")
+	c.Assert(dec(-5, 3).String(), Equals, "-0.005")
+	c.Assert(dec(7, 0).String(), Equals, "7")
+}
+
+func (S) TestNodeOfNumbers(c *C) {
+	value := []interface{}{bigInt("99999999999999999999"), big.NewRat(-1, 3), dec(1250, 2)}
+	node, err := twik.NodeOf(value, 1)
+	c.Assert(err, IsNil)
+	nodes := node.(*ast.List).Nodes
+	c.Assert(nodes[0].(*ast.Int).Input, Equals, "99999999999999999999")
+	c.Assert(nodes[1].(*ast.Ratio).Input, Equals, "-1/3")
+	c.Assert(nodes[2].(*ast.Decimal).Input, Equals, "12.50m")
+	again, err := twik.ValueOf(node)
+	c.Assert(err, IsNil)
+	c.Assert(again, DeepEquals, value)
+}
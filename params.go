@@ -0,0 +1,208 @@
+package twik
+
+import (
+	"fmt"
+
+	"gopkg.in/twik.v1/ast"
+)
+
+// Keyword is the value of a symbol starting with a colon, such as :name,
+// which evaluates to itself. Keywords name the keyword arguments in calls
+// to functions defined with func, as in (f 1 :name "x"). Since such
+// symbols always evaluate to keywords, Scope.Create and var refuse to
+// define them.
+type Keyword string
+
+// GoString returns the keyword as written in code, as in :name.
+func (k Keyword) GoString() string {
+	return ":" + string(k)
+}
+
+// isKeyword returns whether the symbol name is a keyword such as :name.
+func isKeyword(name string) bool {
+	return len(name) > 1 && name[0] == ':'
+}
+
+// signature describes the parameters of a function defined with func.
+// Its list of parameters holds required parameters, followed by optional
+// ones written as (name default), a rest parameter following & that gets
+// the remaining arguments as a list, and keyword parameters written as
+// :name or (:name default), which are set with :name value pairs in calls.
+// Missing optional and keyword arguments get their default values, or
+// nil if there is no default.
+type signature struct {
+	// names holds the positional parameters, then the rest parameter,
+	// then the keyword parameters, in the order they are bound.
+	names    []string
+	defaults []ast.Node
+	required int
+	optional int
+	rest     bool
+	keys     int
+}
+
+// parseSignature parses the list of parameters of the form with the
+// given name, either func or macro.
+func parseSignature(form string, list *ast.List) (*signature, error) {
+	sig := &signature{}
+	seen := make(map[string]bool)
+	add := func(name string, def ast.Node) error {
+		if seen[name] {
+			return fmt.Errorf("%s has duplicated parameter %s", form, name)
+		}
+		seen[name] = true
+		sig.names = append(sig.names, name)
+		sig.defaults = append(sig.defaults, def)
+		return nil
+	}
+	nodes := list.Nodes
+	for i := 0; i < len(nodes); i++ {
+		name, def, ok := param(nodes[i])
+		if !ok {
+			return nil, fmt.Errorf("%s's parameters must be symbols or (symbol default) pairs", form)
+		}
+		switch {
+		case isKeyword(name):
+			name = name[1:]
+			sig.keys++
+		case sig.keys > 0:
+			return nil, fmt.Errorf("%s's keyword parameters must come last", form)
+		case sig.rest:
+			return nil, fmt.Errorf("%s takes a single symbol after &", form)
+		case name == "&":
+			if def != nil || i+1 == len(nodes) {
+				return nil, fmt.Errorf("%s takes a single symbol after &", form)
+			}
+			i++
+			name, def, ok = param(nodes[i])
+			if !ok || def != nil || name == "&" || isKeyword(name) {
+				return nil, fmt.Errorf("%s takes a single symbol after &", form)
+			}
+			sig.rest = true
+		case def != nil:
+			sig.optional++
+		case sig.optional > 0:
+			return nil, fmt.Errorf("%s's required parameters must come before optional ones", form)
+		default:
+			sig.required++
+		}
+		if err := add(name, def); err != nil {
+			return nil, err
+		}
+	}
+	return sig, nil
+}
+
+// param returns the name and the default expression of the parameter
+// in node, which is either a symbol or a (symbol default) pair.
+func param(node ast.Node) (name string, def ast.Node, ok bool) {
+	switch node := node.(type) {
+	case *ast.Symbol:
+		return node.Name, nil, true
+	case *ast.List:
+		if len(node.Nodes) == 2 {
+			if symbol, ok := node.Nodes[0].(*ast.Symbol); ok && symbol.Name != "&" {
+				return symbol.Name, node.Nodes[1], true
+			}
+		}
+	}
+	return "", nil, false
+}
+
+// simple returns whether the signature holds only required parameters.
+func (sig *signature) simple() bool {
+	return sig.optional == 0 && !sig.rest && sig.keys == 0
+}
+
+// bind arranges the arguments of a call to the function with the given
+// name in the order of sig.names. Missing optional and keyword arguments
+// are left undefined.
+func (sig *signature) bind(name string, args []interface{}) ([]interface{}, error) {
+	npos := sig.required + sig.optional
+	if sig.simple() {
+		if len(args) != npos {
+			return nil, arityError(name, npos, npos)
+		}
+		return args, nil
+	}
+	bound := make([]interface{}, len(sig.names))
+	for i := range bound {
+		bound[i] = undefined
+	}
+	positional := args
+	if sig.keys > 0 {
+		positional = make([]interface{}, 0, len(args))
+		first := len(sig.names) - sig.keys
+		for i := 0; i < len(args); i++ {
+			key, ok := args[i].(Keyword)
+			if !ok {
+				positional = append(positional, args[i])
+				continue
+			}
+			index := -1
+			for j, n := range sig.names[first:] {
+				if n == string(key) {
+					index = first + j
+				}
+			}
+			if index < 0 {
+				return nil, fmt.Errorf("%s has no keyword parameter %#v", funcDesc(name), key)
+			}
+			if i+1 == len(args) {
+				return nil, fmt.Errorf("keyword argument %#v takes a value", key)
+			}
+			i++
+			bound[index] = args[i]
+		}
+	}
+	if len(positional) < sig.required || len(positional) > npos && !sig.rest {
+		max := npos
+		if sig.rest {
+			max = -1
+		}
+		return nil, arityError(name, sig.required, max)
+	}
+	if len(positional) > npos {
+		copy(bound, positional[:npos])
+	} else {
+		copy(bound, positional)
+	}
+	if sig.rest {
+		rest := []interface{}{}
+		if len(positional) > npos {
+			rest = append(rest, positional[npos:]...)
+		}
+		bound[npos] = rest
+	}
+	return bound, nil
+}
+
+// funcDesc describes the function defined with the given name, or an
+// anonymous one if name is empty, in error messages.
+func funcDesc(name string) string {
+	if name == "" {
+		return "anonymous function"
+	}
+	return fmt.Sprintf("function %q", name)
+}
+
+// arityError returns the error reported when the function defined with
+// the given name, or an anonymous one if name is empty, is called with
+// a number of arguments other than from min to max, or min or more if
+// max is -1.
+func arityError(name string, min, max int) error {
+	desc := funcDesc(name)
+	switch {
+	case min == max && min == 0:
+		return fmt.Errorf("%s takes no arguments", desc)
+	case min == max && min == 1:
+		return fmt.Errorf("%s takes one argument", desc)
+	case min == max:
+		return fmt.Errorf("%s takes %d arguments", desc, min)
+	case max < 0 && min == 1:
+		return fmt.Errorf("%s takes one or more arguments", desc)
+	case max < 0:
+		return fmt.Errorf("%s takes %d or more arguments", desc, min)
+	}
+	return fmt.Errorf("%s takes %d to %d arguments", desc, min, max)
+}
@@ -0,0 +1,320 @@
+package twik
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"gopkg.in/twik.v1/ast"
+)
+
+// Symbol is the value of a quoted symbol, as in 'x. Quoted lists hold
+// their symbols as Symbol values, so that code may be handled as data.
+type Symbol string
+
+// GoString returns the symbol in its quoted form, as in 'x.
+func (s Symbol) GoString() string {
+	return "'" + string(s)
+}
+
+// ValueOf returns node as a value that may be handled by twik code,
+// as done by the quote special form. Symbols become Symbol values,
+// literals become the respective values, lists become lists, and map
+// literals become maps. Quoted expressions such as 'x become lists
+// such as (quote x).
+func ValueOf(node ast.Node) (interface{}, error) {
+	switch node := node.(type) {
+	case *ast.Symbol:
+		return Symbol(node.Name), nil
+	case *ast.Int, *ast.Ratio, *ast.Decimal:
+		return numberOf(node), nil
+	case *ast.Float:
+		return node.Value, nil
+	case *ast.String:
+		return node.Value, nil
+	case *ast.List:
+		list := make([]interface{}, len(node.Nodes))
+		for i, n := range node.Nodes {
+			value, err := ValueOf(n)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = value
+		}
+		return list, nil
+	case *ast.Map:
+		m := make(map[string]interface{}, len(node.Nodes)/2)
+		for i := 0; i+1 < len(node.Nodes); i += 2 {
+			key, ok := node.Nodes[i].(*ast.String)
+			if !ok {
+				return nil, errors.New("quoted map keys must be string literals")
+			}
+			value, err := ValueOf(node.Nodes[i+1])
+			if err != nil {
+				return nil, err
+			}
+			m[key.Value] = value
+		}
+		return m, nil
+	case *ast.Quote:
+		return ValueOf(node.List())
+	}
+	return nil, fmt.Errorf("cannot quote %#v", node)
+}
+
+// NodeOf returns value as code, reversing the conversion done by ValueOf.
+// Booleans and nil become the symbols true, false, and nil, and map keys
+// are sorted. The resulting nodes are all positioned at pos.
+func NodeOf(value interface{}, pos ast.Pos) (ast.Node, error) {
+	switch value := value.(type) {
+	case Symbol:
+		return &ast.Symbol{Name: string(value), NamePos: pos}, nil
+	case Keyword:
+		return &ast.Symbol{Name: ":" + string(value), NamePos: pos}, nil
+	case nil:
+		return &ast.Symbol{Name: "nil", NamePos: pos}, nil
+	case bool:
+		return &ast.Symbol{Name: strconv.FormatBool(value), NamePos: pos}, nil
+	case int64:
+		return &ast.Int{Input: strconv.FormatInt(value, 10), InputPos: pos, Value: value}, nil
+	case *big.Int:
+		return &ast.Int{Input: value.String(), InputPos: pos, Big: value}, nil
+	case *big.Rat:
+		return &ast.Ratio{Input: value.String(), InputPos: pos, Value: value}, nil
+	case *Decimal:
+		return &ast.Decimal{Input: value.String() + "m", InputPos: pos, Unscaled: value.Unscaled, Scale: value.Scale}, nil
+	case float64:
+		input := strconv.FormatFloat(value, 'g', -1, 64)
+		if !strings.ContainsAny(input, ".eIN") {
+			input += ".0"
+		}
+		return &ast.Float{Input: input, InputPos: pos, Value: value}, nil
+	case string:
+		return &ast.String{Input: strconv.Quote(value), InputPos: pos, Value: value}, nil
+	case []interface{}:
+		list := &ast.List{LParens: pos, RParens: pos, Nodes: make([]ast.Node, len(value))}
+		for i, elem := range value {
+			node, err := NodeOf(elem, pos)
+			if err != nil {
+				return nil, err
+			}
+			list.Nodes[i] = node
+		}
+		return list, nil
+	case map[string]interface{}:
+		m := &ast.Map{LBrace: pos, RBrace: pos, Nodes: make([]ast.Node, 0, 2*len(value))}
+		for _, key := range sortedKeys(value) {
+			node, err := NodeOf(value[key], pos)
+			if err != nil {
+				return nil, err
+			}
+			m.Nodes = append(m.Nodes, &ast.String{Input: strconv.Quote(key), InputPos: pos, Value: key}, node)
+		}
+		return m, nil
+	}
+	return nil, fmt.Errorf("cannot use %#v as code", value)
+}
+
+func quoteFn(scope *Scope, args []ast.Node) (value interface{}, err error) {
+	if len(args) != 1 {
+		return nil, errors.New("quote takes one argument")
+	}
+	return ValueOf(args[0])
+}
+
+func quasiquoteFn(scope *Scope, args []ast.Node) (value interface{}, err error) {
+	if len(args) != 1 {
+		return nil, errors.New("quasiquote takes one argument")
+	}
+	return scope.quasiquote(args[0], 1)
+}
+
+func unquoteFn(scope *Scope, args []ast.Node) (value interface{}, err error) {
+	return nil, errors.New("unquote used outside of quasiquote")
+}
+
+func unquoteSplicingFn(scope *Scope, args []ast.Node) (value interface{}, err error) {
+	return nil, errors.New("unquote-splicing used outside of quasiquote")
+}
+
+// quoted returns the name of the quoting form in node, one of quote,
+// quasiquote, unquote, or unquote-splicing, and the expression quoted,
+// whether written with a quoting mark as in ,x or as in (unquote x).
+func quoted(node ast.Node) (name string, arg ast.Node) {
+	switch node := node.(type) {
+	case *ast.Quote:
+		return node.Name(), node.Node
+	case *ast.List:
+		if len(node.Nodes) == 2 {
+			if symbol, ok := node.Nodes[0].(*ast.Symbol); ok {
+				switch symbol.Name {
+				case "quote", "quasiquote", "unquote", "unquote-splicing":
+					return symbol.Name, node.Nodes[1]
+				}
+			}
+		}
+	}
+	return "", nil
+}
+
+// quasiquote returns node as a value like ValueOf, except that unquoted
+// expressions at the given nesting depth of quasiquote are evaluated,
+// and the elements of lists unquoted with unquote-splicing are inserted
+// into the enclosing list.
+func (s *Scope) quasiquote(node ast.Node, depth int) (interface{}, error) {
+	switch name, arg := quoted(node); name {
+	case "quote", "quasiquote":
+		inner := depth
+		if name == "quasiquote" {
+			inner++
+		}
+		value, err := s.quasiquote(arg, inner)
+		if err != nil {
+			return nil, err
+		}
+		return []interface{}{Symbol(name), value}, nil
+	case "unquote", "unquote-splicing":
+		if depth == 1 {
+			if name == "unquote-splicing" {
+				return nil, s.errorAt(node, errors.New("unquote-splicing used outside of a list"))
+			}
+			return s.Eval(arg)
+		}
+		value, err := s.quasiquote(arg, depth-1)
+		if err != nil {
+			return nil, err
+		}
+		return []interface{}{Symbol(name), value}, nil
+	}
+	switch node := node.(type) {
+	case *ast.List:
+		list := make([]interface{}, 0, len(node.Nodes))
+		for _, n := range node.Nodes {
+			if name, arg := quoted(n); name == "unquote-splicing" && depth == 1 {
+				value, err := s.Eval(arg)
+				if err != nil {
+					return nil, err
+				}
+				elems, ok := value.([]interface{})
+				if !ok && value != nil {
+					return nil, s.errorAt(n, fmt.Errorf("unquote-splicing takes a list, got %#v", value))
+				}
+				list = append(list, elems...)
+				continue
+			}
+			value, err := s.quasiquote(n, depth)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, value)
+		}
+		return list, nil
+	case *ast.Map:
+		m := make(map[string]interface{}, len(node.Nodes)/2)
+		for i := 0; i+1 < len(node.Nodes); i += 2 {
+			key, err := s.quasiquote(node.Nodes[i], depth)
+			if err != nil {
+				return nil, err
+			}
+			skey, ok := key.(string)
+			if !ok {
+				return nil, s.errorAt(node.Nodes[i], fmt.Errorf("map key must be a string: %#v", key))
+			}
+			value, err := s.quasiquote(node.Nodes[i+1], depth)
+			if err != nil {
+				return nil, err
+			}
+			m[skey] = value
+		}
+		return m, nil
+	}
+	return ValueOf(node)
+}
+
+func evalFn(scope *Scope, args []ast.Node) (value interface{}, err error) {
+	if len(args) != 1 {
+		return nil, errors.New("eval takes one argument")
+	}
+	value, err = scope.Eval(args[0])
+	if err != nil {
+		return nil, err
+	}
+	node, err := NodeOf(value, args[0].Pos())
+	if err != nil {
+		return nil, err
+	}
+	st := scope.shared()
+	if err := st.enter(); err != nil {
+		return nil, err
+	}
+	defer st.leave()
+	return scope.Eval(node)
+}
+
+// macroArgs checks the arguments of the macro special form, and returns
+// the name of the macro, its signature, and its body.
+func macroArgs(args []ast.Node) (name *ast.Symbol, sig *signature, body []ast.Node, err error) {
+	var ok bool
+	var params *ast.List
+	if len(args) < 3 {
+		return nil, nil, nil, errors.New("macro takes a name, a list of parameters, and a body sequence")
+	}
+	if name, ok = args[0].(*ast.Symbol); !ok {
+		return nil, nil, nil, errors.New("macro takes a symbol as first argument")
+	}
+	if params, ok = args[1].(*ast.List); !ok {
+		return nil, nil, nil, errors.New("macro takes a list of parameters")
+	}
+	if sig, err = parseSignature("macro", params); err != nil {
+		return nil, nil, nil, err
+	}
+	return name, sig, args[2:], nil
+}
+
+func macroFn(scope *Scope, args []ast.Node) (value interface{}, err error) {
+	name, sig, body, err := macroArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	fn := macro(name, scope.closure(name.Name, sig, body))
+	if err = scope.Create(name.Name, fn); err != nil {
+		return nil, err
+	}
+	return fn, nil
+}
+
+// macro returns a special form that calls expander, a function defined
+// with func, with its unevaluated arguments as values, and evaluates the
+// code returned in the scope it was called in. The code is positioned
+// at the first argument, or at name if there are no arguments.
+func macro(name *ast.Symbol, expander interface{}) func(*Scope, []ast.Node) (interface{}, error) {
+	return func(scope *Scope, args []ast.Node) (value interface{}, err error) {
+		vargs := make([]interface{}, len(args))
+		for i, arg := range args {
+			vargs[i], err = ValueOf(arg)
+			if err != nil {
+				return nil, err
+			}
+		}
+		st := scope.shared()
+		value, err = st.apply(expander, vargs)
+		if err != nil {
+			return nil, err
+		}
+		pos := name.Pos()
+		if len(args) > 0 {
+			pos = args[0].Pos()
+		}
+		node, err := NodeOf(value, pos)
+		if err != nil {
+			return nil, fmt.Errorf("macro %s expanded into invalid code: %v", name.Name, err)
+		}
+		if err := st.enter(); err != nil {
+			return nil, err
+		}
+		defer st.leave()
+		return scope.Eval(node)
+	}
+}
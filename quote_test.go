@@ -0,0 +1,44 @@
+package twik_test
+
+import (
+	. "gopkg.in/check.v1"
+	"gopkg.in/twik.v1"
+	"gopkg.in/twik.v1/ast"
+)
+
+func (S) TestValueOfNodeOf(c *C) {
+	fset := twik.NewFileSet()
+	node, err := twik.ParseString(fset, "", `(a 1 -2.5 "s\n" {"k" true} nil 'b)`)
+	c.Assert(err, IsNil)
+	value, err := twik.ValueOf(node.(*ast.Root).Nodes[0])
+	c.Assert(err, IsNil)
+	c.Assert(value, DeepEquals, []interface{}{
+		twik.Symbol("a"), int64(1), -2.5, "s\n",
+		map[string]interface{}{"k": twik.Symbol("true")},
+		twik.Symbol("nil"),
+		[]interface{}{twik.Symbol("quote"), twik.Symbol("b")},
+	})
+	back, err := twik.NodeOf(value, 7)
+	c.Assert(err, IsNil)
+	again, err := twik.ValueOf(back)
+	c.Assert(err, IsNil)
+	c.Assert(again, DeepEquals, value)
+	c.Assert(back.Pos(), Equals, ast.Pos(7))
+}
+
+func (S) TestNodeOf(c *C) {
+	node, err := twik.NodeOf([]interface{}{2.0, true, nil, "a"}, 1)
+	c.Assert(err, IsNil)
+	c.Assert(node, DeepEquals, &ast.List{
+		LParens: 1,
+		Nodes: []ast.Node{
+			&ast.Float{Input: "2.0", InputPos: 1, Value: 2},
+			&ast.Symbol{Name: "true", NamePos: 1},
+			&ast.Symbol{Name: "nil", NamePos: 1},
+			&ast.String{Input: `"a"`, InputPos: 1, Value: "a"},
+		},
+		RParens: 1,
+	})
+	_, err = twik.NodeOf([]interface{}{struct{}{}}, 1)
+	c.Assert(err, ErrorMatches, `cannot use struct \{\}\{\} as code`)
+}
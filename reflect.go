@@ -0,0 +1,246 @@
+package twik
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"reflect"
+	"runtime"
+)
+
+var (
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	symbolType  = reflect.TypeOf(Symbol(""))
+)
+
+// callable returns whether fn may be called by twik code.
+func callable(fn interface{}) bool {
+	if _, ok := fn.(*Function); ok {
+		return true
+	}
+	return fn != nil && reflect.TypeOf(fn).Kind() == reflect.Func
+}
+
+// funcName returns a human-oriented name for the Go function fn.
+func funcName(fn reflect.Value) string {
+	if f := runtime.FuncForPC(fn.Pointer()); f != nil {
+		return f.Name()
+	}
+	return "Go function"
+}
+
+// callReflect calls the arbitrary Go function fn with args. Each argument
+// is converted into the respective parameter type, and the results are
+// converted back into twik values. A trailing error result is reported
+// as an error, a single remaining result is returned as the value, and
+// further results are returned as a list. If the first parameter is a
+// context.Context, ctx is provided for it. Errors refer to the function
+// by the name of the Go function named, which is usually fn itself.
+func callReflect(ctx context.Context, fn, named reflect.Value, args []interface{}) (value interface{}, err error) {
+	t := fn.Type()
+	in := make([]reflect.Value, 0, len(args)+1)
+	if t.NumIn() > 0 && t.In(0) == contextType {
+		in = append(in, reflect.ValueOf(&ctx).Elem())
+	}
+	first := len(in)
+	nin := t.NumIn() - first
+	if t.IsVariadic() {
+		if len(args) < nin-1 {
+			return nil, fmt.Errorf("function %q takes %d or more arguments", funcName(named), nin-1)
+		}
+	} else if len(args) != nin {
+		switch nin {
+		case 0:
+			return nil, fmt.Errorf("function %q takes no arguments", funcName(named))
+		case 1:
+			return nil, fmt.Errorf("function %q takes one argument", funcName(named))
+		default:
+			return nil, fmt.Errorf("function %q takes %d arguments", funcName(named), nin)
+		}
+	}
+	for i, arg := range args {
+		var pt reflect.Type
+		if t.IsVariadic() && i >= nin-1 {
+			pt = t.In(t.NumIn() - 1).Elem()
+		} else {
+			pt = t.In(first + i)
+		}
+		v, err := convertValue(arg, pt)
+		if err != nil {
+			return nil, fmt.Errorf("%v in argument %d to %s", err, i+1, funcName(named))
+		}
+		in = append(in, v)
+	}
+	out := fn.Call(in)
+	if n := len(out); n > 0 && t.Out(n-1) == errorType {
+		if err, _ := out[n-1].Interface().(error); err != nil {
+			return nil, err
+		}
+		out = out[:n-1]
+	}
+	switch len(out) {
+	case 0:
+		return nil, nil
+	case 1:
+		return twikValue(out[0])
+	}
+	list := make([]interface{}, len(out))
+	for i, v := range out {
+		if list[i], err = twikValue(v); err != nil {
+			return nil, err
+		}
+	}
+	return list, nil
+}
+
+// convertValue converts the twik value into a Go value of type t.
+func convertValue(value interface{}, t reflect.Type) (reflect.Value, error) {
+	if value == nil {
+		switch t.Kind() {
+		case reflect.Interface, reflect.Ptr, reflect.Slice, reflect.Map, reflect.Func, reflect.Chan:
+			return reflect.Zero(t), nil
+		}
+		return reflect.Value{}, fmt.Errorf("cannot use nil as %s", t)
+	}
+	v := reflect.ValueOf(value)
+	if v.Type().AssignableTo(t) {
+		return v, nil
+	}
+	if fn, ok := value.(*Function); ok {
+		if v := reflect.ValueOf(fn.Call); v.Type().AssignableTo(t) {
+			return v, nil
+		}
+	}
+	r := reflect.New(t).Elem()
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if i, ok := value.(int64); ok {
+			if r.OverflowInt(i) {
+				return reflect.Value{}, fmt.Errorf("%d overflows %s", i, t)
+			}
+			r.SetInt(i)
+			return r, nil
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if i, ok := value.(int64); ok {
+			if i < 0 || r.OverflowUint(uint64(i)) {
+				return reflect.Value{}, fmt.Errorf("%d overflows %s", i, t)
+			}
+			r.SetUint(uint64(i))
+			return r, nil
+		}
+	case reflect.Float32, reflect.Float64:
+		switch f := value.(type) {
+		case int64:
+			r.SetFloat(float64(f))
+			return r, nil
+		case float64:
+			r.SetFloat(f)
+			return r, nil
+		}
+	case reflect.String, reflect.Bool:
+		if v.Kind() == t.Kind() {
+			return v.Convert(t), nil
+		}
+	case reflect.Slice:
+		if list, ok := value.([]interface{}); ok {
+			r = reflect.MakeSlice(t, len(list), len(list))
+			for i, elem := range list {
+				ev, err := convertValue(elem, t.Elem())
+				if err != nil {
+					return reflect.Value{}, err
+				}
+				r.Index(i).Set(ev)
+			}
+			return r, nil
+		}
+		if s, ok := value.(string); ok && t.Elem().Kind() == reflect.Uint8 {
+			return reflect.ValueOf([]byte(s)).Convert(t), nil
+		}
+	case reflect.Map:
+		if m, ok := value.(map[string]interface{}); ok && t.Key().Kind() == reflect.String {
+			r = reflect.MakeMapWithSize(t, len(m))
+			for k, elem := range m {
+				ev, err := convertValue(elem, t.Elem())
+				if err != nil {
+					return reflect.Value{}, err
+				}
+				r.SetMapIndex(reflect.ValueOf(k).Convert(t.Key()), ev)
+			}
+			return r, nil
+		}
+	}
+	return reflect.Value{}, fmt.Errorf("cannot use %#v as %s", value, t)
+}
+
+// twikValue converts the Go value v into the respective twik value.
+// Integers become int64, floats become float64, slices become lists,
+// and maps with string keys become map[string]interface{} values.
+func twikValue(v reflect.Value) (interface{}, error) {
+	switch v.Kind() {
+	case reflect.Invalid:
+		return nil, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if v.Uint() > math.MaxInt64 {
+			return nil, fmt.Errorf("%d overflows int64", v.Uint())
+		}
+		return int64(v.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), nil
+	case reflect.String:
+		if v.Type() == symbolType {
+			return Symbol(v.String()), nil
+		}
+		return v.String(), nil
+	case reflect.Bool:
+		return v.Bool(), nil
+	case reflect.Interface:
+		if v.IsNil() {
+			return nil, nil
+		}
+		return twikValue(v.Elem())
+	case reflect.Ptr, reflect.Func, reflect.Chan:
+		if v.IsNil() {
+			return nil, nil
+		}
+	case reflect.Map:
+		if v.IsNil() {
+			return nil, nil
+		}
+		if m, ok := v.Interface().(map[string]interface{}); ok {
+			return m, nil
+		}
+		if v.Type().Key().Kind() == reflect.String {
+			m := make(map[string]interface{}, v.Len())
+			iter := v.MapRange()
+			for iter.Next() {
+				elem, err := twikValue(iter.Value())
+				if err != nil {
+					return nil, err
+				}
+				m[iter.Key().String()] = elem
+			}
+			return m, nil
+		}
+	case reflect.Slice:
+		if list, ok := v.Interface().([]interface{}); ok {
+			return list, nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return string(v.Bytes()), nil
+		}
+		list := make([]interface{}, v.Len())
+		for i := range list {
+			elem, err := twikValue(v.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			list[i] = elem
+		}
+		return list, nil
+	}
+	return v.Interface(), nil
+}
@@ -7,7 +7,9 @@
 package twik
 
 import (
+	"context"
 	"fmt"
+	"reflect"
 
 	"gopkg.in/twik.v1/ast"
 )
@@ -17,16 +19,20 @@ type Scope struct {
 	parent *Scope
 	fset   *ast.FileSet
 	vars   map[string]interface{}
+	state  *state
 }
 
-// Error holds an error and the source position where the error was found.
-type Error struct {
-	Err     error
-	PosInfo *ast.PosInfo
-}
+// state holds details shared by a scope and all the scopes branched from it.
+type state struct {
+	ctx     context.Context
+	limits  Limits
+	running bool
 
-func (e *Error) Error() string {
-	return fmt.Sprintf("%s %v", e.PosInfo, e.Err)
+	// promote holds whether integer results that overflow int64 are
+	// promoted to big integers, as set with SetBigIntPromotion.
+	promote bool
+	steps   int64
+	depth   int
 }
 
 // NewScope returns a new scope for evaluating logic that was parsed into fset.
@@ -35,12 +41,16 @@ func NewScope(fset *ast.FileSet) *Scope {
 	for _, global := range defaultGlobals {
 		vars[global.name] = global.value
 	}
-	return &Scope{fset: fset, vars: vars}
+	return &Scope{fset: fset, vars: vars, state: newState()}
 }
 
 // Create defines a new symbol with the given value in the s scope.
-// It is an error to redefine an existent symbol.
+// It is an error to redefine an existent symbol, or to define a keyword
+// symbol such as :name, as those always evaluate to themselves.
 func (s *Scope) Create(symbol string, value interface{}) error {
+	if isKeyword(symbol) {
+		return fmt.Errorf("cannot define keyword symbol: %s", symbol)
+	}
 	if _, ok := s.vars[symbol]; ok {
 		return fmt.Errorf("symbol already defined in current scope: %s", symbol)
 	}
@@ -78,29 +88,73 @@ func (s *Scope) Get(symbol string) (value interface{}, err error) {
 
 // Branch returns a new scope that has s as a parent.
 func (s *Scope) Branch() *Scope {
-	return &Scope{parent: s, fset: s.fset}
+	return &Scope{parent: s, fset: s.fset, state: s.state}
+}
+
+func newState() *state {
+	return &state{ctx: context.Background()}
+}
+
+// shared returns the state shared by s and the scopes branched from it.
+func (s *Scope) shared() *state {
+	if s.state == nil {
+		s.state = newState()
+	}
+	return s.state
+}
+
+// checkContext returns the error of the context being observed if it is done.
+func (st *state) checkContext() error {
+	select {
+	case <-st.ctx.Done():
+		return st.ctx.Err()
+	default:
+	}
+	return nil
 }
 
 var emptyList = make([]interface{}, 0)
 
 func (s *Scope) errorAt(node ast.Node, err error) error {
-	if _, ok := err.(*Error); ok {
-		return err
-	}
-	return &Error{err, s.fset.PosInfo(node.Pos())}
+	return errorAt(s.fset, node, err)
+}
+
+// EvalContext evaluates node in the s scope and returns the resulting value.
+// Loops, function calls, and calls to Go functions stop with an error
+// holding the error of ctx once it is done. Go functions that take a
+// context.Context as their first parameter are provided with ctx.
+func (s *Scope) EvalContext(ctx context.Context, node ast.Node) (value interface{}, err error) {
+	st := s.shared()
+	old := st.ctx
+	st.ctx = ctx
+	defer func() { st.ctx = old }()
+	return s.Eval(node)
 }
 
 // Eval evaluates node in the s scope and returns the resulting value.
 func (s *Scope) Eval(node ast.Node) (value interface{}, err error) {
+	if st := s.shared(); !st.running {
+		st.running = true
+		st.steps = 0
+		st.depth = 0
+		defer func() { st.running = false }()
+	}
+	return s.eval(node)
+}
+
+func (s *Scope) eval(node ast.Node) (value interface{}, err error) {
 	switch node := node.(type) {
 	case *ast.Symbol:
-		value, err := s.Get(node.Name)
+		if isKeyword(node.Name) {
+			return Keyword(node.Name[1:]), nil
+		}
+		value, err := s.lookup(node.Name)
 		if err != nil {
 			return nil, s.errorAt(node, err)
 		}
 		return value, nil
-	case *ast.Int:
-		return node.Value, nil
+	case *ast.Int, *ast.Ratio, *ast.Decimal:
+		return numberOf(node), nil
 	case *ast.Float:
 		return node.Value, nil
 	case *ast.String:
@@ -109,7 +163,10 @@ func (s *Scope) Eval(node ast.Node) (value interface{}, err error) {
 		if len(node.Nodes) == 0 {
 			return emptyList, nil
 		}
-		fn, err := s.Eval(node.Nodes[0])
+		if err := s.shared().step(); err != nil {
+			return nil, s.errorAt(node.Nodes[0], err)
+		}
+		fn, err := s.eval(node.Nodes[0])
 		if err != nil {
 			return nil, s.errorAt(node.Nodes[0], err)
 		}
@@ -118,9 +175,29 @@ func (s *Scope) Eval(node ast.Node) (value interface{}, err error) {
 			return nil, s.errorAt(node.Nodes[0], err)
 		}
 		return value, nil
+	case *ast.Map:
+		m := make(map[string]interface{}, len(node.Nodes)/2)
+		for i := 0; i+1 < len(node.Nodes); i += 2 {
+			key, err := s.eval(node.Nodes[i])
+			if err != nil {
+				return nil, err
+			}
+			skey, ok := key.(string)
+			if !ok {
+				return nil, s.errorAt(node.Nodes[i], fmt.Errorf("map key must be a string: %#v", key))
+			}
+			value, err := s.eval(node.Nodes[i+1])
+			if err != nil {
+				return nil, err
+			}
+			m[skey] = value
+		}
+		return m, nil
+	case *ast.Quote:
+		return s.eval(node.List())
 	case *ast.Root:
 		for _, node := range node.Nodes {
-			value, err = s.Eval(node)
+			value, err = s.eval(node)
 			if err != nil {
 				return nil, s.errorAt(node, err)
 			}
@@ -132,18 +209,52 @@ func (s *Scope) Eval(node ast.Node) (value interface{}, err error) {
 
 func (s *Scope) call(fn interface{}, args []ast.Node) (value interface{}, err error) {
 	if fn, ok := fn.(func(*Scope, []ast.Node) (interface{}, error)); ok {
-		return fn(s, args)
+		value, err = fn(s, args)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.shared().checkValue(value); err != nil {
+			return nil, err
+		}
+		return value, nil
 	}
-	if fn, ok := fn.(func([]interface{}) (interface{}, error)); ok {
-		vargs := make([]interface{}, len(args))
-		for i, arg := range args {
-			value, err := s.Eval(arg)
-			if err != nil {
-				return nil, err
-			}
-			vargs[i] = value
+	if !callable(fn) {
+		return nil, fmt.Errorf("cannot use %#v as a function", fn)
+	}
+	vargs := make([]interface{}, len(args))
+	for i, arg := range args {
+		value, err := s.Eval(arg)
+		if err != nil {
+			return nil, err
 		}
-		return fn(vargs)
+		vargs[i] = value
+	}
+	return s.shared().apply(fn, vargs)
+}
+
+// apply calls fn with the already evaluated args, unless the context
+// being observed is done, and checks the resulting value against the
+// configured limits.
+func (st *state) apply(fn interface{}, args []interface{}) (value interface{}, err error) {
+	if err := st.checkContext(); err != nil {
+		return nil, err
+	}
+	if f, ok := fn.(*Function); ok {
+		value, err = f.Call(args)
+	} else if f, ok := fn.(func([]interface{}) (interface{}, error)); ok {
+		value, err = f(args)
+	} else if f, ok := fn.(builtin); ok {
+		value, err = f(st, args)
+	} else if v := reflect.ValueOf(fn); v.Kind() == reflect.Func {
+		value, err = callReflect(st.ctx, v, v, args)
+	} else {
+		return nil, fmt.Errorf("cannot use %#v as a function", fn)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := st.checkValue(value); err != nil {
+		return nil, err
 	}
-	return nil, fmt.Errorf("cannot use %#v as a function", fn)
+	return value, nil
 }
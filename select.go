@@ -0,0 +1,193 @@
+package twik
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"gopkg.in/twik.v1/ast"
+)
+
+// splitPath splits a symbol such as "req.User.Name" into the root symbol
+// and the names of the fields or methods selected from it. The returned
+// path is nil if name holds no selection.
+func splitPath(name string) (root string, path []string) {
+	parts := strings.Split(name, ".")
+	if len(parts) < 2 {
+		return "", nil
+	}
+	for _, part := range parts {
+		if part == "" {
+			return "", nil
+		}
+	}
+	return parts[0], parts[1:]
+}
+
+// lookup returns the value of symbol in s. If symbol is undefined and
+// holds a selection such as "req.Name", the named fields or methods are
+// selected from the value of the root symbol instead.
+func (s *Scope) lookup(symbol string) (interface{}, error) {
+	value, err := s.Get(symbol)
+	if err != nil {
+		if root, path := splitPath(symbol); path != nil {
+			if rvalue, rerr := s.Get(root); rerr == nil {
+				return s.shared().selectPath(rvalue, path)
+			}
+		}
+		return nil, err
+	}
+	return value, nil
+}
+
+// assign sets symbol to value in s. If symbol is undefined and holds a
+// selection such as "req.Name", the named field is set instead.
+func (s *Scope) assign(symbol string, value interface{}) error {
+	err := s.Set(symbol, value)
+	if err != nil {
+		if root, path := splitPath(symbol); path != nil {
+			if rvalue, rerr := s.Get(root); rerr == nil {
+				return setPath(rvalue, path, value)
+			}
+		}
+	}
+	return err
+}
+
+// selectPath selects each of the fields or methods named in path in turn,
+// starting from value.
+func (st *state) selectPath(value interface{}, path []string) (interface{}, error) {
+	v := reflect.ValueOf(value)
+	for _, name := range path {
+		if fn := st.method(v, name); fn != nil {
+			v = reflect.ValueOf(fn)
+			continue
+		}
+		f, err := field(v, name)
+		if err != nil {
+			return nil, err
+		}
+		v = f
+	}
+	return twikValue(v)
+}
+
+// setPath sets the field selected by path from value to newValue.
+func setPath(value interface{}, path []string, newValue interface{}) error {
+	v := reflect.ValueOf(value)
+	for _, name := range path {
+		f, err := field(v, name)
+		if err != nil {
+			return err
+		}
+		v = f
+	}
+	name := path[len(path)-1]
+	if !v.CanSet() {
+		return fmt.Errorf("cannot set field %s of a value that is not a pointer", name)
+	}
+	nv, err := convertValue(newValue, v.Type())
+	if err != nil {
+		return fmt.Errorf("%v in assignment to field %s", err, name)
+	}
+	v.Set(nv)
+	return nil
+}
+
+// field returns the exported field called name of the struct held in v,
+// following pointers and embedded structs as necessary.
+func field(v reflect.Value, name string) (reflect.Value, error) {
+	if !v.IsValid() {
+		return reflect.Value{}, fmt.Errorf("cannot select %s from nil", name)
+	}
+	t := v.Type()
+	v, err := indirect(v, name)
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	if v.Kind() == reflect.Struct {
+		if sf, ok := v.Type().FieldByName(name); ok && sf.PkgPath == "" {
+			for i, x := range sf.Index {
+				if i > 0 {
+					if v, err = indirect(v, name); err != nil {
+						return reflect.Value{}, err
+					}
+				}
+				v = v.Field(x)
+			}
+			return v, nil
+		}
+	}
+	return reflect.Value{}, fmt.Errorf("%s has no field or method %s", t, name)
+}
+
+// indirect follows the pointers and interfaces in v.
+func indirect(v reflect.Value, name string) (reflect.Value, error) {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return reflect.Value{}, fmt.Errorf("cannot select %s from nil", name)
+		}
+		v = v.Elem()
+	}
+	return v, nil
+}
+
+// method returns the exported method called name of v as a function
+// that may be called by twik code, or nil if there is no such method.
+func (st *state) method(v reflect.Value, name string) func([]interface{}) (interface{}, error) {
+	for v.Kind() == reflect.Interface && !v.IsNil() {
+		v = v.Elem()
+	}
+	if !v.IsValid() || v.Kind() == reflect.Interface {
+		return nil
+	}
+	m, ok := v.Type().MethodByName(name)
+	if !ok && v.CanAddr() {
+		v = v.Addr()
+		m, ok = v.Type().MethodByName(name)
+	}
+	if !ok {
+		return nil
+	}
+	fn := v.Method(m.Index)
+	return func(args []interface{}) (interface{}, error) {
+		return callReflect(st.ctx, fn, m.Func, args)
+	}
+}
+
+var errDot = errors.New(". takes a value, a field or method name, and the method arguments")
+
+func dotFn(scope *Scope, args []ast.Node) (value interface{}, err error) {
+	if len(args) < 2 {
+		return nil, errDot
+	}
+	symbol, ok := args[1].(*ast.Symbol)
+	if !ok {
+		return nil, errDot
+	}
+	value, err = scope.Eval(args[0])
+	if err != nil {
+		return nil, err
+	}
+	st := scope.shared()
+	v := reflect.ValueOf(value)
+	if fn := st.method(v, symbol.Name); fn != nil {
+		vargs := make([]interface{}, len(args)-2)
+		for i, arg := range args[2:] {
+			vargs[i], err = scope.Eval(arg)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return st.apply(fn, vargs)
+	}
+	f, err := field(v, symbol.Name)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) > 2 {
+		return nil, fmt.Errorf("cannot call field %s of %s", symbol.Name, v.Type())
+	}
+	return twikValue(f)
+}
@@ -0,0 +1,291 @@
+package twik
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"gopkg.in/twik.v1/ast"
+)
+
+// Strings is a module of functions for handling strings:
+//
+//	(string-len s)                  the number of runes in s
+//	(string-concat s...)            the strings concatenated
+//	(substring s start [end])       the runes of s from start up to end
+//	(string-index s sub)            the position of sub in s, or -1
+//	(string-split s sep)            the list of strings in s separated by sep
+//	(string-join list sep)          the strings in list separated by sep
+//	(string-trim s [cutset])        s without leading and trailing spaces,
+//	                                or runes in cutset
+//	(string-upper s)                s in upper case
+//	(string-lower s)                s in lower case
+//	(string-replace s old new [n])  s with the first n, or all, instances
+//	                                of old replaced by new
+//	(has-prefix s prefix)           whether s starts with prefix
+//	(has-suffix s suffix)           whether s ends with suffix
+//	(format f args...)              args formatted per the Go verbs in f,
+//	                                as done by fmt.Sprintf
+//	(string-runes s)                the list of runes in s, as strings
+//	(string->number s)              the number in s, as written in code
+//	(number->string n)              the number n as a string
+//
+// Positions and lengths are counted in runes rather than bytes.
+var Strings = &Module{[]moduleSymbol{
+	{"string-len", stringLenFn},
+	{"string-concat", stringConcatFn},
+	{"substring", substringFn},
+	{"string-index", stringIndexFn},
+	{"string-split", stringSplitFn},
+	{"string-join", stringJoinFn},
+	{"string-trim", stringTrimFn},
+	{"string-upper", stringUpperFn},
+	{"string-lower", stringLowerFn},
+	{"string-replace", stringReplaceFn},
+	{"has-prefix", hasPrefixFn},
+	{"has-suffix", hasSuffixFn},
+	{"format", formatFn},
+	{"string-runes", stringRunesFn},
+	{"string->number", stringToNumberFn},
+	{"number->string", numberToStringFn},
+}}
+
+func stringLenFn(args []interface{}) (value interface{}, err error) {
+	if len(args) == 1 {
+		if s, ok := args[0].(string); ok {
+			return int64(utf8.RuneCountInString(s)), nil
+		}
+	}
+	return nil, errors.New("string-len takes a single string argument")
+}
+
+func stringConcatFn(args []interface{}) (value interface{}, err error) {
+	var buf strings.Builder
+	for _, arg := range args {
+		s, ok := arg.(string)
+		if !ok {
+			return nil, fmt.Errorf("string-concat takes strings, got %#v", arg)
+		}
+		buf.WriteString(s)
+	}
+	return buf.String(), nil
+}
+
+func substringFn(args []interface{}) (value interface{}, err error) {
+	if len(args) == 2 || len(args) == 3 {
+		s, ok1 := args[0].(string)
+		start, ok2 := args[1].(int64)
+		end, ok3 := int64(utf8.RuneCountInString(s)), true
+		if len(args) == 3 {
+			end, ok3 = args[2].(int64)
+		}
+		if ok1 && ok2 && ok3 {
+			runes := []rune(s)
+			if start < 0 || start > end || end > int64(len(runes)) {
+				return nil, fmt.Errorf("substring range %d to %d is out of bounds for string of length %d", start, end, len(runes))
+			}
+			return string(runes[start:end]), nil
+		}
+	}
+	return nil, errors.New("substring takes a string, a start index, and an optional end index")
+}
+
+func stringIndexFn(args []interface{}) (value interface{}, err error) {
+	if len(args) == 2 {
+		s, ok1 := args[0].(string)
+		sub, ok2 := args[1].(string)
+		if ok1 && ok2 {
+			i := strings.Index(s, sub)
+			if i < 0 {
+				return int64(-1), nil
+			}
+			return int64(utf8.RuneCountInString(s[:i])), nil
+		}
+	}
+	return nil, errors.New("string-index takes two strings")
+}
+
+func stringSplitFn(args []interface{}) (value interface{}, err error) {
+	if len(args) == 2 {
+		s, ok1 := args[0].(string)
+		sep, ok2 := args[1].(string)
+		if ok1 && ok2 {
+			parts := strings.Split(s, sep)
+			list := make([]interface{}, len(parts))
+			for i, part := range parts {
+				list[i] = part
+			}
+			return list, nil
+		}
+	}
+	return nil, errors.New("string-split takes a string and a separator")
+}
+
+func stringJoinFn(args []interface{}) (value interface{}, err error) {
+	if len(args) == 2 {
+		list, ok1 := args[0].([]interface{})
+		sep, ok2 := args[1].(string)
+		if ok1 && ok2 {
+			parts := make([]string, len(list))
+			for i, elem := range list {
+				if parts[i], ok1 = elem.(string); !ok1 {
+					return nil, fmt.Errorf("string-join takes a list of strings, got %#v in it", elem)
+				}
+			}
+			return strings.Join(parts, sep), nil
+		}
+	}
+	return nil, errors.New("string-join takes a list of strings and a separator")
+}
+
+func stringTrimFn(args []interface{}) (value interface{}, err error) {
+	if len(args) == 1 {
+		if s, ok := args[0].(string); ok {
+			return strings.TrimSpace(s), nil
+		}
+	}
+	if len(args) == 2 {
+		s, ok1 := args[0].(string)
+		cutset, ok2 := args[1].(string)
+		if ok1 && ok2 {
+			return strings.Trim(s, cutset), nil
+		}
+	}
+	return nil, errors.New("string-trim takes a string and an optional cutset")
+}
+
+func stringUpperFn(args []interface{}) (value interface{}, err error) {
+	if len(args) == 1 {
+		if s, ok := args[0].(string); ok {
+			return strings.ToUpper(s), nil
+		}
+	}
+	return nil, errors.New("string-upper takes a single string argument")
+}
+
+func stringLowerFn(args []interface{}) (value interface{}, err error) {
+	if len(args) == 1 {
+		if s, ok := args[0].(string); ok {
+			return strings.ToLower(s), nil
+		}
+	}
+	return nil, errors.New("string-lower takes a single string argument")
+}
+
+func stringReplaceFn(args []interface{}) (value interface{}, err error) {
+	if len(args) == 3 || len(args) == 4 {
+		s, ok1 := args[0].(string)
+		old, ok2 := args[1].(string)
+		new, ok3 := args[2].(string)
+		n, ok4 := int64(-1), true
+		if len(args) == 4 {
+			n, ok4 = args[3].(int64)
+		}
+		if ok1 && ok2 && ok3 && ok4 {
+			return strings.Replace(s, old, new, int(n)), nil
+		}
+	}
+	return nil, errors.New("string-replace takes a string, the old and new strings, and an optional count")
+}
+
+func hasPrefixFn(args []interface{}) (value interface{}, err error) {
+	if len(args) == 2 {
+		s, ok1 := args[0].(string)
+		prefix, ok2 := args[1].(string)
+		if ok1 && ok2 {
+			return strings.HasPrefix(s, prefix), nil
+		}
+	}
+	return nil, errors.New("has-prefix takes two strings")
+}
+
+func hasSuffixFn(args []interface{}) (value interface{}, err error) {
+	if len(args) == 2 {
+		s, ok1 := args[0].(string)
+		suffix, ok2 := args[1].(string)
+		if ok1 && ok2 {
+			return strings.HasSuffix(s, suffix), nil
+		}
+	}
+	return nil, errors.New("has-suffix takes two strings")
+}
+
+func formatFn(args []interface{}) (value interface{}, err error) {
+	if len(args) > 0 {
+		if format, ok := args[0].(string); ok {
+			return fmt.Sprintf(format, args[1:]...), nil
+		}
+	}
+	return nil, errors.New("format takes a format string and the values to format")
+}
+
+func stringRunesFn(args []interface{}) (value interface{}, err error) {
+	if len(args) == 1 {
+		if s, ok := args[0].(string); ok {
+			list := make([]interface{}, 0, len(s))
+			for _, r := range s {
+				list = append(list, string(r))
+			}
+			return list, nil
+		}
+	}
+	return nil, errors.New("string-runes takes a single string argument")
+}
+
+func stringToNumberFn(args []interface{}) (value interface{}, err error) {
+	if len(args) == 1 {
+		if s, ok := args[0].(string); ok {
+			if n, ok := parseNumber(s); ok {
+				return n, nil
+			}
+			return nil, fmt.Errorf("string->number cannot parse %q as a number", s)
+		}
+	}
+	return nil, errors.New("string->number takes a single string argument")
+}
+
+// parseNumber returns the number in s, which must be written as a numeric
+// literal in code, such as 42, 99999999999999999999, 1/3, 1.5m, or 1.5e3.
+func parseNumber(s string) (n interface{}, ok bool) {
+	if root, err := ast.ParseString(ast.NewFileSet(), "", s); err == nil {
+		if nodes := root.(*ast.Root).Nodes; len(nodes) == 1 {
+			switch node := nodes[0].(type) {
+			case *ast.Int:
+				// Character literals such as 'a' are not numbers.
+				if node.Input == s && !strings.HasPrefix(s, "'") {
+					return numberOf(node), true
+				}
+			case *ast.Ratio:
+				if node.Input == s {
+					return numberOf(node), true
+				}
+			case *ast.Decimal:
+				if node.Input == s {
+					return numberOf(node), true
+				}
+			case *ast.Float:
+				if node.Input == s {
+					return node.Value, true
+				}
+			}
+		}
+	}
+	return nil, false
+}
+
+func numberToStringFn(args []interface{}) (value interface{}, err error) {
+	if len(args) == 1 {
+		switch n := args[0].(type) {
+		case int64:
+			return strconv.FormatInt(n, 10), nil
+		case float64:
+			return strconv.FormatFloat(n, 'g', -1, 64), nil
+		case *big.Int, *big.Rat, *Decimal:
+			return fmt.Sprint(n), nil
+		}
+	}
+	return nil, errors.New("number->string takes a single number argument")
+}
@@ -0,0 +1,175 @@
+package twik_test
+
+import (
+	"math/big"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/twik.v1"
+	"gopkg.in/twik.v1/ast"
+)
+
+var stringsList = []struct {
+	code  string
+	value interface{}
+}{
+	{
+		`(string-len "héllo")`,
+		5,
+	}, {
+		`(string-len 1)`,
+		errorf("twik source:1:2: string-len takes a single string argument"),
+	}, {
+		`(string-concat "a" "b" "c")`,
+		"abc",
+	}, {
+		`(string-concat)`,
+		"",
+	}, {
+		`(string-concat "a" 1)`,
+		errorf("twik source:1:2: string-concat takes strings, got 1"),
+	}, {
+		`(substring "héllo" 1 3)`,
+		"él",
+	}, {
+		`(substring "héllo" 2)`,
+		"llo",
+	}, {
+		`(substring "héllo" 3 6)`,
+		errorf("twik source:1:2: substring range 3 to 6 is out of bounds for string of length 5"),
+	}, {
+		`(substring "héllo" "a")`,
+		errorf("twik source:1:2: substring takes a string, a start index, and an optional end index"),
+	}, {
+		`(list (string-index "héllo" "l") (string-index "héllo" "x"))`,
+		[]interface{}{int64(2), int64(-1)},
+	}, {
+		`(string-split "a,b,c" ",")`,
+		[]interface{}{"a", "b", "c"},
+	}, {
+		`(string-join (string-split "a,b,c" ",") "-")`,
+		"a-b-c",
+	}, {
+		`(string-join (list "a" 1) "-")`,
+		errorf("twik source:1:2: string-join takes a list of strings, got 1 in it"),
+	}, {
+		`(list (string-trim "  a b  ") (string-trim "--a--" "-"))`,
+		[]interface{}{"a b", "a"},
+	}, {
+		`(list (string-upper "aB") (string-lower "aB"))`,
+		[]interface{}{"AB", "ab"},
+	}, {
+		`(list (string-replace "aaa" "a" "b") (string-replace "aaa" "a" "b" 2))`,
+		[]interface{}{"bbb", "bba"},
+	}, {
+		`(list (has-prefix "abc" "ab") (has-prefix "abc" "bc") (has-suffix "abc" "bc"))`,
+		[]interface{}{true, false, true},
+	}, {
+		`(format "%s=%d (%.1f) %v" "a" 1 2.25 true)`,
+		"a=1 (2.2) true",
+	}, {
+		`(format 1)`,
+		errorf("twik source:1:2: format takes a format string and the values to format"),
+	}, {
+		`(var l ()) (range (i r) (string-runes "hé") (set l (append l (string-upper r)))) l`,
+		[]interface{}{"H", "É"},
+	}, {
+		`(list (string->number "42") (string->number "-1.5") (string->number "1.5e3"))`,
+		[]interface{}{int64(42), -1.5, 1500.0},
+	}, {
+		`(list (string->number "99999999999999999999") (string->number "1/3") (string->number "1.50m"))`,
+		[]interface{}{bigInt("99999999999999999999"), big.NewRat(1, 3), &twik.Decimal{Unscaled: big.NewInt(150), Scale: 2}},
+	}, {
+		`(string->number "'a'")`,
+		errorf(`twik source:1:2: string->number cannot parse "'a'" as a number`),
+	}, {
+		`(string->number " 42")`,
+		errorf(`twik source:1:2: string->number cannot parse " 42" as a number`),
+	}, {
+		`(string->number "4x")`,
+		errorf(`twik source:1:2: string->number cannot parse "4x" as a number`),
+	}, {
+		`(string->number "1e3")`,
+		errorf(`twik source:1:2: string->number cannot parse "1e3" as a number`),
+	}, {
+		`(string->number "NaN")`,
+		errorf(`twik source:1:2: string->number cannot parse "NaN" as a number`),
+	}, {
+		`(string->number "Inf")`,
+		errorf(`twik source:1:2: string->number cannot parse "Inf" as a number`),
+	}, {
+		`(string->number "-Inf")`,
+		errorf(`twik source:1:2: string->number cannot parse "-Inf" as a number`),
+	}, {
+		`(string->number "infinity")`,
+		errorf(`twik source:1:2: string->number cannot parse "infinity" as a number`),
+	}, {
+		`(string->number "0x1p3")`,
+		errorf(`twik source:1:2: string->number cannot parse "0x1p3" as a number`),
+	}, {
+		`(string->number "0x1.8p1")`,
+		errorf(`twik source:1:2: string->number cannot parse "0x1.8p1" as a number`),
+	}, {
+		`(string->number "1_000")`,
+		errorf(`twik source:1:2: string->number cannot parse "1_000" as a number`),
+	}, {
+		`(string->number "1_0.5")`,
+		errorf(`twik source:1:2: string->number cannot parse "1_0.5" as a number`),
+	}, {
+		`(list (number->string 42) (number->string 1.5) (number->string 2.0))`,
+		[]interface{}{"42", "1.5", "2"},
+	}, {
+		`(number->string "1")`,
+		errorf("twik source:1:2: number->string takes a single number argument"),
+	},
+}
+
+func (S) TestStrings(c *C) {
+	checkBackends(c, stringsList, func(fset *ast.FileSet) *twik.Scope {
+		scope := twik.NewScope(fset)
+		c.Assert(scope.Use(twik.Strings, twik.Lists), IsNil)
+		return scope
+	})
+}
+
+// checkBackends checks that each of the tests results in the expected
+// value when evaluated by Scope.Eval, Program.Run, and Bytecode.Run in
+// a scope made by newScope.
+func checkBackends(c *C, tests []struct {
+	code  string
+	value interface{}
+}, newScope func(*ast.FileSet) *twik.Scope) {
+	for _, test := range tests {
+		fset := twik.NewFileSet()
+		node, err := twik.ParseString(fset, "", test.code)
+		c.Assert(err, IsNil)
+		prog, err := twik.Compile(fset, node)
+		c.Assert(err, IsNil)
+		bc, err := twik.CompileBytecode(fset, node)
+		c.Assert(err, IsNil)
+		for _, run := range []func(*twik.Scope) (interface{}, error){
+			func(scope *twik.Scope) (interface{}, error) { return scope.Eval(node) },
+			prog.Run,
+			bc.Run,
+		} {
+			value, err := run(newScope(fset))
+			checkEval(c, test.code, test.value, value, err)
+		}
+	}
+}
+
+func (S) TestUse(c *C) {
+	scope := twik.NewScope(twik.NewFileSet())
+	scope.Create("format", "taken")
+	c.Assert(scope.Use(twik.Strings), ErrorMatches, "symbol already defined in current scope: format")
+	_, err := scope.Get("string-len")
+	c.Assert(err, ErrorMatches, "undefined symbol: string-len")
+}
+
+func (S) TestUseDuplicateModules(c *C) {
+	scope := twik.NewScope(twik.NewFileSet())
+	c.Assert(scope.Use(twik.Lists, twik.Strings, twik.Strings), ErrorMatches, "symbol already defined in current scope: .*")
+	_, err := scope.Get("string-len")
+	c.Assert(err, ErrorMatches, "undefined symbol: string-len")
+	_, err = scope.Get("map")
+	c.Assert(err, ErrorMatches, "undefined symbol: map")
+}
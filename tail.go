@@ -0,0 +1,228 @@
+package twik
+
+import (
+	"gopkg.in/twik.v1/ast"
+)
+
+// tailCall holds a call to a function defined with func that was found
+// in tail position of the body of another such function. Rather than
+// being made where it was found, the call is made by the function whose
+// body was being evaluated once that evaluation returns, so that chains
+// of tail calls run in constant Go stack.
+type tailCall struct {
+	fn   *Function
+	args []interface{}
+	fset *ast.FileSet
+	node ast.Node
+}
+
+// funcBody evaluates the body of a function defined with func with args
+// bound to its parameters. A call found in tail position to another
+// function defined with func is returned rather than made.
+type funcBody func(args []interface{}) (value interface{}, next *tailCall, err error)
+
+// Function is a function defined with func. Twik code calls it as any
+// other function, and Go code may call it with its Call method, or have
+// it provided to Go functions taking a parameter of type
+// func([]interface{}) (interface{}, error).
+//
+// Functions defined with func are *Function values rather than Go funcs,
+// so Go code must type-assert them to *Function, and may use the Func
+// method where a func value is needed.
+type Function struct {
+	name string
+	sig  *signature
+	body funcBody
+	st   *state
+}
+
+// function returns a function defined with func that evaluates body
+// with the arguments it is called with bound according to sig.
+func (st *state) function(name string, sig *signature, body funcBody) *Function {
+	return &Function{name: name, sig: sig, body: body, st: st}
+}
+
+// Call calls fn with args. Tail calls found in its body are made in a
+// loop, and do not count towards Limits.MaxDepth.
+func (fn *Function) Call(args []interface{}) (value interface{}, err error) {
+	st := fn.st
+	if err := st.enter(); err != nil {
+		return nil, err
+	}
+	defer st.leave()
+	value, next, err := fn.run(args)
+	if err != nil {
+		return nil, err
+	}
+	for next != nil {
+		value, next, err = st.bounce(next)
+		if err != nil {
+			return nil, pushFrame(fn.name, err)
+		}
+	}
+	return value, nil
+}
+
+// Func returns the Call method of fn as a func value.
+func (fn *Function) Func() func(args []interface{}) (interface{}, error) {
+	return fn.Call
+}
+
+// run evaluates the body of fn once with args bound to its parameters,
+// and returns the call found in tail position of the body, if any,
+// rather than making it.
+func (fn *Function) run(args []interface{}) (value interface{}, next *tailCall, err error) {
+	args, err = fn.sig.bind(fn.name, args)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := fn.st.checkContext(); err != nil {
+		return nil, nil, err
+	}
+	value, next, err = funcExit(fn.body(args))
+	if err != nil {
+		return nil, nil, pushFrame(fn.name, err)
+	}
+	return value, next, nil
+}
+
+// bounce makes the tail call next on behalf of the function it was found
+// in, and returns the tail call found in turn by the function called.
+func (st *state) bounce(next *tailCall) (value interface{}, after *tailCall, err error) {
+	value, after, err = next.fn.run(next.args)
+	if err == nil && after == nil {
+		err = st.checkValue(value)
+	}
+	if err != nil {
+		return nil, nil, errorAt(next.fset, next.node, err)
+	}
+	return value, after, nil
+}
+
+// tail evaluates node in tail position of the body of a function
+// defined with func. Calls to functions defined with func are returned
+// rather than made, including the ones found in tail position of the
+// standard if, cond, switch, when, unless, do, let, let*, and, and or
+// special forms.
+func (s *Scope) tail(node ast.Node) (value interface{}, next *tailCall, err error) {
+	list, ok := node.(*ast.List)
+	if !ok || len(list.Nodes) == 0 {
+		value, err = s.eval(node)
+		return value, nil, err
+	}
+	head, args := list.Nodes[0], list.Nodes[1:]
+	if err := s.shared().step(); err != nil {
+		return nil, nil, s.errorAt(head, err)
+	}
+	fn, err := s.eval(head)
+	if err != nil {
+		return nil, nil, s.errorAt(head, err)
+	}
+	value, next, err = s.tailCall(fn, head, args)
+	if err != nil {
+		return nil, nil, s.errorAt(head, err)
+	}
+	return value, next, nil
+}
+
+// tailBranch evaluates the conditional special form with the given name
+// like Scope.conditional, but with the selected body in tail position.
+func (s *Scope) tailBranch(form string, args []ast.Node) (interface{}, *tailCall, error) {
+	body, value, err := s.branch(form, args)
+	if err != nil || body == nil {
+		return value, nil, err
+	}
+	s = s.Branch()
+	for _, node := range body[:len(body)-1] {
+		if _, err = s.Eval(node); err != nil {
+			return nil, nil, err
+		}
+	}
+	return s.tail(body[len(body)-1])
+}
+
+// tailLet evaluates the let or let* special form like Scope.let, but with
+// the last node of the body in tail position.
+func (s *Scope) tailLet(form string, args []ast.Node) (interface{}, *tailCall, error) {
+	s, body, err := s.letScope(form, args)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, node := range body[:len(body)-1] {
+		if _, err = s.Eval(node); err != nil {
+			return nil, nil, err
+		}
+	}
+	return s.tail(body[len(body)-1])
+}
+
+func (s *Scope) tailCall(fn interface{}, head ast.Node, args []ast.Node) (value interface{}, next *tailCall, err error) {
+	switch {
+	case sameFunc(fn, ifFn) && (len(args) == 2 || len(args) == 3):
+		value, err = s.Eval(args[0])
+		if err != nil {
+			return nil, nil, err
+		}
+		if value == false {
+			if len(args) == 3 {
+				return s.tail(args[2])
+			}
+			return false, nil, nil
+		}
+		return s.tail(args[1])
+	case sameFunc(fn, condFn):
+		return s.tailBranch("cond", args)
+	case sameFunc(fn, switchFn):
+		return s.tailBranch("switch", args)
+	case sameFunc(fn, whenFn):
+		return s.tailBranch("when", args)
+	case sameFunc(fn, unlessFn):
+		return s.tailBranch("unless", args)
+	case sameFunc(fn, letFn):
+		return s.tailLet("let", args)
+	case sameFunc(fn, letStarFn):
+		return s.tailLet("let*", args)
+	case sameFunc(fn, doFn) && len(args) > 0:
+		s = s.Branch()
+		for _, arg := range args[:len(args)-1] {
+			if _, err = s.Eval(arg); err != nil {
+				return nil, nil, err
+			}
+		}
+		return s.tail(args[len(args)-1])
+	case sameFunc(fn, andFn) && len(args) > 0:
+		for _, arg := range args[:len(args)-1] {
+			value, err = s.Eval(arg)
+			if err != nil {
+				return nil, nil, err
+			}
+			if value == false {
+				return false, nil, nil
+			}
+		}
+		return s.tail(args[len(args)-1])
+	case sameFunc(fn, orFn) && len(args) > 0:
+		for _, arg := range args[:len(args)-1] {
+			value, err = s.Eval(arg)
+			if err != nil {
+				return nil, nil, err
+			}
+			if value != false {
+				return value, nil, nil
+			}
+		}
+		return s.tail(args[len(args)-1])
+	}
+	if fn, ok := fn.(*Function); ok {
+		vargs := make([]interface{}, len(args))
+		for i, arg := range args {
+			vargs[i], err = s.Eval(arg)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		return nil, &tailCall{fn, vargs, s.fset, head}, nil
+	}
+	value, err = s.call(fn, args)
+	return value, nil, err
+}
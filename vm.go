@@ -0,0 +1,408 @@
+package twik
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+
+	"gopkg.in/twik.v1/ast"
+)
+
+// machine runs Bytecode.
+type machine struct {
+	*run
+	prog *Bytecode
+
+	// stack holds the values of every chunk in progress. Its slice
+	// must be updated before calls that may run further chunks.
+	stack []interface{}
+}
+
+// loop holds what is needed to handle break and continue in a loop.
+type loop struct {
+	brk, cont int
+	height    int
+	f         *frame
+}
+
+// iterator holds the progress of a range over an integer, a list, or a map.
+type iterator struct {
+	kind iterKind
+	n    int64
+	list []interface{}
+	m    map[string]interface{}
+	keys []string
+	i    int64
+}
+
+type iterKind int
+
+const (
+	iterInt iterKind = iota
+	iterList
+	iterMap
+)
+
+// exec runs the instructions in ch with f as the current frame. A call
+// to a function defined with func made by opTailCall is returned in next
+// rather than made.
+func (m *machine) exec(ch *chunk, f *frame) (value interface{}, next *tailCall, err error) {
+	prog := m.prog
+	code := ch.code
+	base := len(m.stack)
+	stack := m.stack
+	defer func() { m.stack = stack[:base] }()
+	var loops []loop
+	pc := 0
+	for pc < len(code) {
+		in := code[pc]
+		pc++
+		switch in.op {
+		case opConst:
+			stack = append(stack, prog.consts[in.a])
+		case opGet:
+			value, err = m.get(f, prog.refs[in.a])
+			stack = append(stack, value)
+		case opSet:
+			top := len(stack) - 1
+			err = m.set(f, prog.refs[in.a], stack[top])
+			stack[top] = nil
+		case opVar:
+			top := len(stack) - 1
+			if f.slots[in.a] != undefined {
+				err = fmt.Errorf("symbol already defined in current scope: %s", f.block.names[in.a])
+				break
+			}
+			f.slots[in.a] = stack[top]
+			stack[top] = nil
+		case opFunc:
+			fc := prog.funcs[in.a]
+			fn := m.closure(fc, f)
+			if in.b >= 0 {
+				if f.slots[in.b] != undefined {
+					err = fmt.Errorf("symbol already defined in current scope: %s", fc.name)
+					break
+				}
+				f.slots[in.b] = fn
+			}
+			stack = append(stack, fn)
+		case opMacro:
+			top := len(stack) - 1
+			name := prog.nodes[in.b][0].(*ast.Symbol)
+			if f.slots[in.a] != undefined {
+				err = fmt.Errorf("symbol already defined in current scope: %s", name.Name)
+				break
+			}
+			stack[top] = macro(name, stack[top])
+			f.slots[in.a] = stack[top]
+		case opPop:
+			stack = stack[:len(stack)-1]
+		case opReplace:
+			top := len(stack) - 1
+			stack[top-1] = stack[top]
+			stack = stack[:top]
+		case opDefault:
+			if f.slots[in.b] != undefined {
+				pc = int(in.a)
+			}
+		case opJump:
+			pc = int(in.a)
+		case opJumpFalse:
+			top := len(stack) - 1
+			if stack[top] == false {
+				pc = int(in.a)
+			}
+			stack = stack[:top]
+		case opAndJump:
+			if stack[len(stack)-1] == false {
+				pc = int(in.a)
+			} else {
+				stack = stack[:len(stack)-1]
+			}
+		case opOrJump:
+			if stack[len(stack)-1] != false {
+				pc = int(in.a)
+			} else {
+				stack = stack[:len(stack)-1]
+			}
+		case opCase:
+			if equal(stack[len(stack)-1], prog.consts[in.b]) {
+				pc = int(in.a)
+			}
+		case opStep:
+			err = m.st.step()
+		case opForm:
+			form := &prog.forms[in.b]
+			fn, ferr := m.get(f, form.ref)
+			if ferr != nil || sameFunc(fn, form.fn) {
+				err = ferr
+				break
+			}
+			m.stack = stack
+			value, err = m.bridge(f, fn, form.nodes)
+			stack = append(m.stack, value)
+			pc = int(in.a)
+		case opSpecial:
+			top := len(stack) - 1
+			fn := stack[top]
+			if _, ok := fn.(func(*Scope, []ast.Node) (interface{}, error)); ok {
+				m.stack = stack
+				value, err = m.bridge(f, fn, prog.nodes[in.b])
+				stack = m.stack
+				stack[top] = value
+				pc = int(in.a)
+			} else if !callable(fn) {
+				err = fmt.Errorf("cannot use %#v as a function", fn)
+			}
+		case opCall:
+			n := int(in.a)
+			top := len(stack) - n
+			args := make([]interface{}, n)
+			copy(args, stack[top:])
+			stack = stack[:top]
+			fn := stack[top-1]
+			m.stack = stack
+			value, err = m.st.apply(fn, args)
+			stack = m.stack
+			stack[top-1] = value
+		case opTailCall:
+			n := int(in.a)
+			top := len(stack) - n
+			fn := stack[top-1]
+			if fn, ok := fn.(*Function); ok {
+				args := make([]interface{}, n)
+				copy(args, stack[top:])
+				return nil, &tailCall{fn, args, m.fset, ch.nodes[pc-1]}, nil
+			}
+			args := make([]interface{}, n)
+			copy(args, stack[top:])
+			stack = stack[:top]
+			m.stack = stack
+			value, err = m.st.apply(fn, args)
+			stack = m.stack
+			stack[top-1] = value
+		case opUnpack:
+			top := len(stack) - 1
+			var list []interface{}
+			if list, err = destructure(stack[top], int(in.a)); err == nil {
+				stack = append(stack[:top], list...)
+			}
+		case opKey:
+			if key := stack[len(stack)-1]; !isString(key) {
+				err = fmt.Errorf("map key must be a string: %#v", key)
+			}
+		case opMap:
+			n := int(in.a)
+			base := len(stack) - 2*n
+			mv := make(map[string]interface{}, n)
+			for i := base; i < len(stack); i += 2 {
+				mv[stack[i].(string)] = stack[i+1]
+			}
+			stack = append(stack[:base], mv)
+		case opEnter:
+			f = newFrame(f, prog.blocks[in.a])
+		case opLeave:
+			f = f.parent
+		case opCheck:
+			err = m.st.checkContext()
+		case opRange:
+			top := len(stack) - 1
+			it, rerr := newIterator(stack[top])
+			if rerr != nil {
+				err = rerr
+				break
+			}
+			if it.kind == iterMap {
+				f.slots[in.b] = ""
+			} else {
+				f.slots[in.b] = int64(0)
+			}
+			if in.c >= 0 && it.kind != iterInt {
+				f.slots[in.c] = nil
+			}
+			stack = append(stack[:top], it, stack[top])
+		case opNext:
+			if err = m.st.checkContext(); err != nil {
+				break
+			}
+			if !stack[len(stack)-2].(*iterator).next(f, int(in.b), int(in.c)) {
+				pc = int(in.a)
+			}
+		case opLoop:
+			loops = append(loops, loop{int(in.a), int(in.b), len(stack), f})
+		case opEndLoop:
+			loops = loops[:len(loops)-1]
+		case opError:
+			err = prog.consts[in.a].(error)
+		default:
+			panic("twik: unknown opcode")
+		}
+		if err != nil {
+			if c := controlOf(err); c != nil && c.name != "return" && len(loops) > 0 {
+				l := loops[len(loops)-1]
+				stack = stack[:l.height]
+				f = l.f
+				if c.name == "break" {
+					stack[l.height-1] = c.value
+					pc = l.brk
+				} else {
+					stack[l.height-1] = nil
+					pc = l.cont
+				}
+				err = nil
+				continue
+			}
+			return nil, nil, m.errorAt(ch.nodes[pc-1], err)
+		}
+	}
+	return stack[len(stack)-1], nil, nil
+}
+
+// closure returns a function that runs the instructions in fc with
+// a frame whose parent is f.
+func (m *machine) closure(fc *chunk, f *frame) *Function {
+	return m.st.function(fc.name, fc.sig, func(args []interface{}) (interface{}, *tailCall, error) {
+		f := newFrame(f, fc.block)
+		for i, arg := range args {
+			f.slots[fc.params[i]] = arg
+		}
+		return m.exec(fc, f)
+	})
+}
+
+func isString(value interface{}) bool {
+	_, ok := value.(string)
+	return ok
+}
+
+func newIterator(value interface{}) (*iterator, error) {
+	switch value := value.(type) {
+	case int64:
+		return &iterator{kind: iterInt, n: value}, nil
+	case []interface{}:
+		return &iterator{kind: iterList, n: int64(len(value)), list: value}, nil
+	case map[string]interface{}:
+		return &iterator{kind: iterMap, n: int64(len(value)), m: value, keys: sortedKeys(value)}, nil
+	}
+	return nil, errors.New(`range takes an integer, a list, or a map as second argument`)
+}
+
+// next sets slot index to the next index or key, and slot eindex to the
+// respective element unless it is -1. It returns false when done.
+func (it *iterator) next(f *frame, index, eindex int) bool {
+	if it.i >= it.n {
+		return false
+	}
+	switch it.kind {
+	case iterInt:
+		f.slots[index] = it.i
+	case iterList:
+		f.slots[index] = it.i
+		if eindex >= 0 {
+			f.slots[eindex] = it.list[it.i]
+		}
+	case iterMap:
+		k := it.keys[it.i]
+		f.slots[index] = k
+		if eindex >= 0 {
+			f.slots[eindex] = it.m[k]
+		}
+	}
+	it.i++
+	return true
+}
+
+// Disassemble returns a listing of the instructions in b, with the top
+// level logic followed by every function defined with func. Each line
+// holds the instruction address, the source position it reports errors
+// at, the operation, and its operands.
+func (b *Bytecode) Disassemble() string {
+	var buf bytes.Buffer
+	b.disassemble(&buf, b.main)
+	for i, fc := range b.funcs {
+		params := make([]string, len(fc.params))
+		for j, p := range fc.params {
+			params[j] = fc.block.names[p]
+		}
+		name := fc.name
+		if name == "" {
+			name = "anonymous function"
+		}
+		fmt.Fprintf(&buf, "\nfunc %d %s (%s):\n", i, name, strings.Join(params, " "))
+		b.disassemble(&buf, fc)
+	}
+	return buf.String()
+}
+
+func (b *Bytecode) disassemble(buf *bytes.Buffer, ch *chunk) {
+	if ch == b.main {
+		buf.WriteString("top level:\n")
+	}
+	// Blocks are entered and left in the order instructions are laid out,
+	// so the block of each instruction is tracked while going over them.
+	blocks := []*block{ch.block}
+	for pc, in := range ch.code {
+		switch in.op {
+		case opEnter:
+			blocks = append(blocks, b.blocks[in.a])
+		case opLeave:
+			blocks = blocks[:len(blocks)-1]
+		}
+		pos := ""
+		if node := ch.nodes[pc]; node != nil {
+			info := b.fset.PosInfo(node.Pos())
+			pos = fmt.Sprintf("%d:%d", info.Line, info.Column)
+		}
+		if args := b.operands(blocks[len(blocks)-1], in); args != "" {
+			fmt.Fprintf(buf, "%04d %-6s %-9s %s\n", pc, pos, opNames[in.op], args)
+		} else {
+			fmt.Fprintf(buf, "%04d %-6s %s\n", pc, pos, opNames[in.op])
+		}
+	}
+}
+
+func (b *Bytecode) operands(blk *block, in instr) string {
+	switch in.op {
+	case opConst:
+		return fmt.Sprintf("%#v", b.consts[in.a])
+	case opGet, opSet:
+		return b.refs[in.a].name
+	case opVar, opMacro:
+		return blk.names[in.a]
+	case opFunc:
+		if in.b >= 0 {
+			return fmt.Sprintf("%d %s", in.a, b.funcs[in.a].name)
+		}
+		return fmt.Sprintf("%d", in.a)
+	case opDefault:
+		return fmt.Sprintf("%s %04d", blk.names[in.b], in.a)
+	case opLoop:
+		return fmt.Sprintf("%04d %04d", in.a, in.b)
+	case opCase:
+		return fmt.Sprintf("%#v %04d", b.consts[in.b], in.a)
+	case opJump, opJumpFalse, opAndJump, opOrJump:
+		return fmt.Sprintf("%04d", in.a)
+	case opForm:
+		return fmt.Sprintf("%s %04d", b.forms[in.b].ref.name, in.a)
+	case opSpecial:
+		return fmt.Sprintf("%04d", in.a)
+	case opCall, opTailCall, opMap, opUnpack:
+		return fmt.Sprintf("%d", in.a)
+	case opEnter:
+		return "(" + strings.Join(b.blocks[in.a].names, " ") + ")"
+	case opRange:
+		if in.c >= 0 {
+			return fmt.Sprintf("%s %s", blk.names[in.b], blk.names[in.c])
+		}
+		return blk.names[in.b]
+	case opNext:
+		if in.c >= 0 {
+			return fmt.Sprintf("%s %s %04d", blk.names[in.b], blk.names[in.c], in.a)
+		}
+		return fmt.Sprintf("%s %04d", blk.names[in.b], in.a)
+	case opError:
+		return fmt.Sprintf("%q", b.consts[in.a].(error).Error())
+	}
+	return ""
+}